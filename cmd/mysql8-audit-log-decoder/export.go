@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	proxylog "github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/log"
+	"github.com/masahide/mysql8-audit-proxy/pkg/parquet"
+)
+
+// maxRowGroupRows bounds the memory used to buffer one row group.
+const maxRowGroupRows = 1 << 20
+
+var exportColumns = []parquet.Column{
+	{Name: "time", Type: parquet.Int64, Converted: parquet.TimestampMillis},
+	{Name: "session", Type: parquet.Int64},
+	{Name: "user", Type: parquet.ByteArray, Converted: parquet.UTF8},
+	{Name: "db", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "addr", Type: parquet.ByteArray, Converted: parquet.UTF8},
+	{Name: "target", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "state", Type: parquet.ByteArray, Converted: parquet.UTF8},
+	{Name: "command", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "sql", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "error", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "duration_us", Type: parquet.Int64, Optional: true},
+	{Name: "rows", Type: parquet.Int64, Optional: true},
+	{Name: "affected", Type: parquet.Int64, Optional: true},
+	{Name: "digest", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "normalized", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "class", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+	{Name: "tables", Type: parquet.ByteArray, Converted: parquet.UTF8, Optional: true},
+}
+
+// exportMain implements "mysql8-audit-log-decoder export -o out.parquet files...".
+func exportMain(args []string, opts []proxylog.ReaderOption) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "audit.parquet", "Output Parquet file")
+	ff := addFilterFlags(fs)
+	fs.Parse(args)
+	filter, err := ff.filter()
+	if err != nil {
+		return err
+	}
+	files, err := ff.files(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no log files given")
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pw, err := parquet.NewWriter(f, exportColumns)
+	if err != nil {
+		return err
+	}
+	pw.CreatedBy = "mysql8-audit-log-decoder version " + version
+	e := &exporter{w: pw, filter: filter, joiner: decoder.NewJoiner(), opts: opts}
+	for _, filename := range files {
+		if err := e.exportFile(filename); err != nil {
+			return fmt.Errorf("cannot export file:%s, err:%w", filename, err)
+		}
+	}
+	for _, rec := range e.joiner.Flush() {
+		if err := e.write(rec); err != nil {
+			return err
+		}
+	}
+	if err := pw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type exporter struct {
+	w      *parquet.Writer
+	filter *decoder.Filter
+	joiner *decoder.Joiner // puts the result of a statement on its row
+	hour   time.Time
+	opts   []proxylog.ReaderOption
+}
+
+func (e *exporter) exportFile(filename string) error {
+	r, err := proxylog.NewFileReader(filename, e.opts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rec := decoder.Record{}
+	for {
+		err := r.ReadRecord(&rec)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		for _, rec := range e.joiner.Add(rec) {
+			if err := e.write(rec); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// write appends rec, starting a new row group for every hour so that
+// readers can skip row groups by time.
+func (e *exporter) write(rec decoder.Record) error {
+	if !e.filter.Match(&rec) {
+		return nil
+	}
+	hour := rec.Datetime.Truncate(time.Hour)
+	if !hour.Equal(e.hour) || e.w.Rows() >= maxRowGroupRows {
+		if err := e.w.Flush(); err != nil {
+			return err
+		}
+		e.hour = hour
+	}
+	var duration, rows, affected any
+	if rec.HasResult() {
+		duration, rows, affected = rec.Duration, int64(rec.Rows), int64(rec.Affected)
+	}
+	return e.w.Write(
+		rec.Datetime.UnixMilli(),
+		int64(rec.ConnectionID),
+		rec.User,
+		nullString(rec.Db),
+		rec.Addr,
+		nullString(rec.Target),
+		rec.State,
+		nullString(rec.Command),
+		nullString(rec.Cmd),
+		nullString(rec.Err),
+		duration,
+		rows,
+		affected,
+		nullString(rec.Digest),
+		nullString(rec.Normalized),
+		nullString(rec.Class),
+		nullString(tableList(rec.Tables)),
+	)
+}
+
+// tableList formats tables as "billing.invoices:write db1.t:read".
+func tableList(tables []decoder.TableAccess) string {
+	s := make([]string, len(tables))
+	for i, t := range tables {
+		s[i] = t.String()
+	}
+	return strings.Join(s, " ")
+}
+
+func nullString(s string) any {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
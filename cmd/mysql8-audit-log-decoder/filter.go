@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	proxylog "github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/log"
+)
+
+const defaultLogFileName = "mysql-audit.%Y%m%d%H.log.gz"
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+type filterFlags struct {
+	from, to    string
+	user        string
+	target      string
+	addr        string
+	id          uint
+	state       string
+	command     string
+	sql         string
+	digest      string
+	normalized  string
+	class       string
+	table       string
+	access      string
+	logFileName string
+}
+
+// addFilterFlags defines the flags that select records and log files on fs.
+func addFilterFlags(fs *flag.FlagSet) *filterFlags {
+	ff := &filterFlags{}
+	fs.StringVar(&ff.from, "from", "", "Only records at or after this time, e.g. \"2024-01-02 15:04:05\" (local time) or RFC3339")
+	fs.StringVar(&ff.to, "to", "", "Only records before this time")
+	fs.StringVar(&ff.user, "user", "", "Only records of this target user")
+	fs.StringVar(&ff.target, "target", "", "Only records of this target mysql address (host or host:port)")
+	fs.StringVar(&ff.addr, "addr", "", "Only records of this client address (host or host:port)")
+	fs.UintVar(&ff.id, "id", 0, "Only records of this connection ID")
+	fs.StringVar(&ff.state, "state", "", "Only records in this state (connect, est, disconnect)")
+	fs.StringVar(&ff.command, "command", "", "Only records of this command type, e.g. COM_QUERY or query")
+	fs.StringVar(&ff.sql, "sql", "", "Only records whose SQL text matches this regular expression")
+	fs.StringVar(&ff.digest, "digest", "", "Only queries with this digest, or a digest starting with it")
+	fs.StringVar(&ff.normalized, "normalized", "", "Only queries whose normalized text matches this regular expression, e.g. \"^select .* from `orders`\"")
+	fs.StringVar(&ff.class, "class", "", "Only queries of this class: DQL, DML, DDL, DCL, TCL or ADMIN")
+	fs.StringVar(&ff.table, "table", "", "Only queries touching this table, as schema.table or a table name in any schema")
+	fs.StringVar(&ff.access, "access", "", "Only queries accessing -table (or any table) this way: read, write, ddl, dcl or lock")
+	logFileName := os.Getenv("LOG_FILE_NAME")
+	if len(logFileName) == 0 {
+		logFileName = defaultLogFileName
+	}
+	fs.StringVar(&ff.logFileName, "log-file-name", logFileName, "The LOG_FILE_NAME of the proxy, used to pick files from a directory or glob by time")
+	return ff
+}
+
+func (ff *filterFlags) filter() (*decoder.Filter, error) {
+	f := &decoder.Filter{
+		User:         ff.user,
+		Target:       ff.target,
+		Addr:         ff.addr,
+		ConnectionID: uint32(ff.id),
+		State:        ff.state,
+		Command:      ff.command,
+		Digest:       ff.digest,
+		Class:        ff.class,
+		Table:        ff.table,
+		Access:       ff.access,
+	}
+	var err error
+	if f.From, err = parseTime(ff.from); err != nil {
+		return nil, fmt.Errorf("-from: %w", err)
+	}
+	if f.To, err = parseTime(ff.to); err != nil {
+		return nil, fmt.Errorf("-to: %w", err)
+	}
+	if len(ff.sql) > 0 {
+		if f.SQL, err = regexp.Compile(ff.sql); err != nil {
+			return nil, fmt.Errorf("-sql: %w", err)
+		}
+	}
+	if len(ff.normalized) > 0 {
+		if f.Normalized, err = regexp.Compile(ff.normalized); err != nil {
+			return nil, fmt.Errorf("-normalized: %w", err)
+		}
+	}
+	return f, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time:%q", s)
+}
+
+// files expands the arguments into log files. Plain files are used as they
+// are. For a directory or a glob, the files named after -log-file-name are
+// picked in time order, skipping those outside the range of f.
+func (ff *filterFlags) files(args []string, f *decoder.Filter) ([]string, error) {
+	res := []string{}
+	for _, arg := range args {
+		var candidates []string
+		if st, err := os.Stat(arg); err == nil && st.IsDir() {
+			entries, err := os.ReadDir(arg)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				candidates = append(candidates, filepath.Join(arg, e.Name()))
+			}
+		} else if strings.ContainsAny(arg, "*?[") {
+			if candidates, err = filepath.Glob(arg); err != nil {
+				return nil, err
+			}
+		} else {
+			res = append(res, arg)
+			continue
+		}
+		res = append(res, proxylog.SelectFiles(candidates, ff.logFileName, f.From, f.To)...)
+	}
+	return res, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	proxylog "github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/log"
+)
+
+// followInterval is how often a followed file is checked for new records.
+// The proxy flushes the current file every LOG_FLUSH (1s by default).
+const followInterval = 500 * time.Millisecond
+
+// follow prints the records of the current log file as it grows and moves
+// on to the next file when the proxy rotates. It starts from the file that
+// holds -from, or from the latest file.
+func follow(args []string, ff *filterFlags, f *decoder.Filter, opts []proxylog.ReaderOption) error {
+	list := func() ([]string, error) { return ff.files(args, &decoder.Filter{}) }
+	files, err := list()
+	if err != nil {
+		return err
+	}
+	current := ""
+	if f.From.IsZero() {
+		if len(files) > 0 {
+			current = files[len(files)-1]
+		}
+	} else if selected, err := ff.files(args, &decoder.Filter{From: f.From}); err != nil {
+		return err
+	} else if len(selected) > 0 {
+		current = selected[0]
+	}
+	for len(current) == 0 {
+		// no log file yet
+		time.Sleep(followInterval)
+		if files, err = list(); err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			current = files[0]
+		}
+	}
+	for {
+		next := ""
+		rotated := func() bool {
+			files, err := list()
+			if err != nil {
+				return false
+			}
+			next = nextFile(files, current)
+			return len(next) > 0
+		}
+		if err := followFile(current, rotated, f, opts); err != nil {
+			return fmt.Errorf("cannot follow file:%s, err:%w", current, err)
+		}
+		current = next
+	}
+}
+
+// nextFile returns the file after current in files, which are in time order.
+func nextFile(files []string, current string) string {
+	i := slices.Index(files, current)
+	if i < 0 || i+1 == len(files) {
+		return ""
+	}
+	return files[i+1]
+}
+
+func followFile(filename string, rotated func() bool, f *decoder.Filter, opts []proxylog.ReaderOption) error {
+	r, err := proxylog.NewTailReader(filename, followInterval, rotated, opts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rec := decoder.Record{}
+	for {
+		err := r.ReadRecord(&rec)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if f.Match(&rec) {
+			os.Stdout.Write(fmtJSON(rec))
+		}
+	}
+}
@@ -1,18 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"time"
 
-	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
 	proxylog "github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/log"
-	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
 )
 
 var (
@@ -20,6 +17,9 @@ var (
 	commit  = "none"
 	date    = "unknown"
 	showVer = flag.Bool("version", false, "Show version")
+	follows = flag.Bool("follow", false, "Keep printing records as the current log file grows, and follow rotations")
+	keyFile = flag.String("key", os.Getenv("LOG_DECRYPT_KEY"), "PEM file of the RSA private key to decrypt encrypted log files (env LOG_DECRYPT_KEY)")
+	filters = addFilterFlags(flag.CommandLine)
 )
 
 func main() {
@@ -29,38 +29,72 @@ func main() {
 		fmt.Printf("version: %v\ncommit: %v\nbuilt_at: %v\n", version, commit, date)
 		return
 	}
-	for _, arg := range flag.Args() {
-		err := filePrint(arg)
+	// how log files are opened, by every command
+	var opts []proxylog.ReaderOption
+	if len(*keyFile) > 0 {
+		key, err := proxylog.LoadPrivateKey(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, proxylog.WithPrivateKey(key))
+	}
+	switch flag.Arg(0) {
+	case "export":
+		if err := exportMain(flag.Args()[1:], opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "session":
+		if err := sessionMain(flag.Args()[1:], opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "report":
+		if err := reportMain(flag.Args()[1:], opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	f, err := filters.filter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *follows {
+		if err := follow(flag.Args(), filters, f, opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	files, err := filters.files(flag.Args(), f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, arg := range files {
+		err := filePrint(arg, f, opts)
 		if err != nil {
 			log.Printf("cannot print file:%s, err:%s", arg, err)
 		}
 	}
 }
 
-func filePrint(filename string) error {
-	r, err := proxylog.NewFileReader(filename)
+func filePrint(filename string, f *decoder.Filter, opts []proxylog.ReaderOption) error {
+	r, err := proxylog.NewFileReader(filename, opts...)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	bp := sendpacket.SendPacket{}
+	rec := decoder.Record{}
 	for {
-		err := r.Decode(&bp)
+		err := r.ReadRecord(&rec)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
-		os.Stdout.Write(fmtJSON(formatPacket(bp)))
-		/*
-			b, err := trim(bp.Packets)
-			if err != nil {
-				log.Printf("cannot trim err:%s packet:%s", err, fmtJSON(bp))
-			} else {
-				fmt.Printf("%s: size:%d, %v\n", time.Unix(bp.Datetime, 0).Format("2006-01-02 15:04:05"), len(b), b)
-			}
-		*/
+		if f.Match(&rec) {
+			os.Stdout.Write(fmtJSON(rec))
+		}
 	}
 	return nil
 }
@@ -73,99 +107,3 @@ func fmtJSON(v any) []byte {
 	}
 	return append([]byte(b), byte('\n'))
 }
-
-type packet struct {
-	Datetime     time.Time `json:"time"`
-	ConnectionID uint32    `json:"con_id,omitempty"`
-	User         string    `json:"user,omitempty"`
-	Db           string    `json:"db,omitempty"`
-	Addr         string    `json:"addr,omitempty"`
-	State        string    `json:"state,omitempty"`
-	Err          string    `json:"err,omitempty"`
-	Packets      []byte    `json:"packets,omitempty"`
-	Cmd          string    `json:"cmd,omitempty"`
-}
-
-func formatPacket(sp sendpacket.SendPacket) (res packet) {
-	res = packet{
-		Datetime:     time.Unix(sp.Datetime, 0),
-		ConnectionID: sp.ConnectionID,
-		User:         sp.User,
-		Db:           sp.Db,
-		Addr:         sp.Addr,
-		State:        sp.State,
-		Err:          sp.Err,
-	}
-	data, err := trim(sp.Packets)
-	if err != nil {
-		res.Packets = sp.Packets
-		return
-	}
-	if len(data) == 0 {
-		res.Packets = sp.Packets
-		return
-	}
-	cmd := data[0]
-	data = data[1:]
-	switch cmd {
-	case mysql.COM_QUIT:
-		res.Cmd = "quit"
-		res.Packets = nil
-	case mysql.COM_QUERY:
-		res.Cmd = string(data)
-		res.Packets = nil
-	case mysql.COM_PING:
-		res.Cmd = "ping"
-		res.Packets = nil
-	case mysql.COM_INIT_DB:
-		res.Cmd = "use " + string(data)
-		res.Packets = nil
-	case mysql.COM_FIELD_LIST:
-		index := bytes.IndexByte(data, 0x00)
-		table := string(data[0:index])
-		res.Cmd = "fieldList " + table
-		wildcard := string(data[index+1:])
-		if len(wildcard) > 0 {
-			res.Cmd = res.Cmd + " " + wildcard
-		}
-		res.Packets = nil
-	case mysql.COM_STMT_PREPARE:
-		res.Cmd = "stmt_prepare"
-		res.Packets = sp.Packets
-	case mysql.COM_STMT_EXECUTE:
-		res.Cmd = "stmt_execute"
-		res.Packets = sp.Packets
-	case mysql.COM_STMT_CLOSE:
-		res.Cmd = "stmt_close"
-		res.Packets = sp.Packets
-	case mysql.COM_STMT_SEND_LONG_DATA:
-		res.Cmd = "stmt_send_long_data"
-		res.Packets = sp.Packets
-	case mysql.COM_STMT_RESET:
-		res.Cmd = "stmt_reset"
-		res.Packets = sp.Packets
-	case mysql.COM_SET_OPTION:
-		res.Cmd = "set_option"
-		res.Packets = sp.Packets
-	case mysql.COM_REGISTER_SLAVE:
-		res.Cmd = "register_slave"
-		res.Packets = sp.Packets
-	case mysql.COM_BINLOG_DUMP:
-		res.Cmd = "binlog_dump"
-		res.Packets = sp.Packets
-	case mysql.COM_BINLOG_DUMP_GTID:
-		res.Cmd = "binlog_dump"
-		res.Packets = sp.Packets
-	default:
-		res.Cmd = GetComName(cmd)
-		res.Packets = sp.Packets
-	}
-	return
-}
-
-func trim(dst []byte) ([]byte, error) {
-	if len(dst) < 4 {
-		return nil, fmt.Errorf("dst too small %v", dst)
-	}
-	return dst[4:], nil
-}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	proxylog "github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/log"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/report"
+)
+
+// reportMain implements "mysql8-audit-log-decoder report [-format table|json|csv] files...".
+func reportMain(args []string, opts []proxylog.ReaderOption) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "table", "Output format: table, json or csv")
+	top := fs.Int("top", 10, "Number of queries in the top query lists")
+	groupBy := fs.String("group-by", "", "Also count statements by these comma separated keys: user, db, addr, target, command, type, class, digest or normalized")
+	section := fs.String("section", "", "Print only this section in csv: sessions, statements, top_by_count, top_by_time, errors, ddl, clients or groups (with -group-by)")
+	ff := addFilterFlags(fs)
+	fs.Parse(args)
+	filter, err := ff.filter()
+	if err != nil {
+		return err
+	}
+	files, err := ff.files(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	var write func(r *report.Report, w io.Writer) error
+	switch *format {
+	case "table":
+		write = (*report.Report).WriteTable
+	case "json":
+		write = (*report.Report).WriteJSON
+	case "csv":
+		write = func(r *report.Report, w io.Writer) error { return r.WriteCSV(w, *section) }
+	default:
+		return fmt.Errorf("unknown format:%q", *format)
+	}
+
+	b := report.NewBuilder(*top)
+	b.Filter = filter
+	if len(*groupBy) > 0 {
+		if err := b.SetGroupBy(strings.Split(*groupBy, ",")); err != nil {
+			return err
+		}
+	}
+	for _, filename := range files {
+		r, err := proxylog.NewFileReader(filename, opts...)
+		if err != nil {
+			return fmt.Errorf("cannot read file:%s, err:%w", filename, err)
+		}
+		rec := decoder.Record{}
+		for {
+			if err = r.ReadRecord(&rec); err != nil {
+				break
+			}
+			b.Add(rec)
+		}
+		r.Close()
+		if err != io.EOF {
+			return fmt.Errorf("cannot read file:%s, err:%w", filename, err)
+		}
+	}
+	return write(b.Report(), os.Stdout)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	proxylog "github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/log"
+)
+
+// sessionMain implements "mysql8-audit-log-decoder session [-format text|json] files...".
+// It prints every session in which a record matches the filters.
+func sessionMain(args []string, opts []proxylog.ReaderOption) error {
+	fs := flag.NewFlagSet("session", flag.ExitOnError)
+	format := fs.String("format", "text", "Output format: text (a transcript) or json (one session per line)")
+	ff := addFilterFlags(fs)
+	fs.Parse(args)
+	filter, err := ff.filter()
+	if err != nil {
+		return err
+	}
+	files, err := ff.files(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	var print func(w io.Writer, s *decoder.Session)
+	switch *format {
+	case "text":
+		print = printTranscript
+	case "json":
+		print = func(w io.Writer, s *decoder.Session) { w.Write(fmtJSON(s)) }
+	default:
+		return fmt.Errorf("unknown format:%q", *format)
+	}
+
+	sessions := decoder.NewSessions()
+	matched := map[uint32]bool{}
+	output := func(ended []*decoder.Session) {
+		for _, s := range ended {
+			if matched[s.ConnectionID] {
+				print(os.Stdout, s)
+			}
+			delete(matched, s.ConnectionID)
+		}
+	}
+	for _, filename := range files {
+		r, err := proxylog.NewFileReader(filename, opts...)
+		if err != nil {
+			return fmt.Errorf("cannot read file:%s, err:%w", filename, err)
+		}
+		rec := decoder.Record{}
+		for {
+			if err = r.ReadRecord(&rec); err != nil {
+				break
+			}
+			if filter.Match(&rec) {
+				matched[rec.ConnectionID] = true
+			}
+			output(sessions.Add(rec))
+		}
+		r.Close()
+		if err != io.EOF {
+			return fmt.Errorf("cannot read file:%s, err:%w", filename, err)
+		}
+	}
+	output(sessions.Flush())
+	return nil
+}
+
+const transcriptTime = "2006-01-02 15:04:05"
+
+// printTranscript prints a session like the history of a mysql client.
+func printTranscript(w io.Writer, s *decoder.Session) {
+	fmt.Fprintf(w, "# session %d: %s from %s to %s\n", s.ConnectionID, s.User, s.Addr, s.Target)
+	if s.Connected {
+		fmt.Fprintf(w, "# %s connect\n", s.Start.Format(transcriptTime))
+	} else {
+		fmt.Fprintf(w, "# connected before %s\n", s.Start.Format(transcriptTime))
+	}
+	db := s.Db
+	for _, rec := range splitStatements(s.Statements) {
+		if rec.State == "failover" {
+			fmt.Fprintf(w, "# %s %s\n", rec.Datetime.Format(transcriptTime), failoverLine(rec))
+			continue
+		}
+		prompt := "mysql> "
+		if len(db) > 0 {
+			prompt = "mysql [" + db + "]> "
+		}
+		switch rec.Command {
+		case "COM_QUERY":
+			fmt.Fprintf(w, "[%s] %s%s;\n", rec.Datetime.Format(transcriptTime), prompt, strings.TrimRight(strings.TrimSpace(rec.Cmd), ";"))
+		case "COM_INIT_DB":
+			fmt.Fprintf(w, "[%s] %s%s;\n", rec.Datetime.Format(transcriptTime), prompt, rec.Cmd)
+			if len(rec.Err) == 0 {
+				db = strings.TrimPrefix(rec.Cmd, "use ")
+			}
+		default:
+			fmt.Fprintf(w, "[%s] %s/* %s */ %s\n", rec.Datetime.Format(transcriptTime), prompt, rec.Command, rec.Cmd)
+		}
+		if len(rec.Attributes) > 0 {
+			fmt.Fprintf(w, "# attributes %s\n", formatAttributes(rec.Attributes))
+		}
+		if len(rec.Target) > 0 && rec.Target != s.Target {
+			// a read of a session that splits reads and writes
+			fmt.Fprintf(w, "# served by %s\n", rec.Target)
+		}
+		if rec.Truncated > 0 {
+			fmt.Fprintf(w, "# logged in part, %d bytes in all\n", rec.Truncated)
+		}
+		if f := rec.Infile; f != nil {
+			fmt.Fprintf(w, "# local infile '%s': %d %s, sha256 %s\n", f.Name, f.Bytes, plural(uint64(f.Bytes), "byte"), f.SHA256)
+		}
+		if c := rec.Cursor; c != nil {
+			fmt.Fprintln(w, cursorLine(rec.StmtID, c))
+		}
+		for _, line := range resultLines(rec) {
+			fmt.Fprintln(w, line)
+		}
+	}
+	if s.Disconnected {
+		fmt.Fprintf(w, "# %s disconnect after %s", s.End.Format(transcriptTime), s.Duration)
+		if len(s.Err) > 0 && s.Err != "EOF" {
+			fmt.Fprintf(w, " (%s)", s.Err)
+		}
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintln(w, "# still connected at the end of the log")
+	}
+	fmt.Fprintln(w)
+}
+
+// splitStatements replaces each multi-statement query with its statements,
+// so that each one is printed with its own result.
+func splitStatements(recs []decoder.Record) []decoder.Record {
+	res := make([]decoder.Record, 0, len(recs))
+	for _, rec := range recs {
+		if len(rec.Statements) == 0 {
+			res = append(res, rec)
+			continue
+		}
+		for i, s := range rec.Statements {
+			r := rec
+			r.Cmd, r.Rows, r.Affected, r.Err, r.Duration = s.SQL, s.Rows, s.Affected, s.Err, s.Duration
+			r.Statements, r.Parts = nil, nil
+			if i > 0 {
+				r.Attributes, r.Truncated = nil, 0
+			}
+			if !strings.HasPrefix(strings.ToUpper(s.SQL), "LOAD") {
+				r.Infile = nil
+			}
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// resultLines formats the result of a statement like the mysql client
+// does, a line for each result set of e.g. a CALL.
+func resultLines(rec decoder.Record) []string {
+	if len(rec.Parts) == 0 {
+		if len(rec.Err) == 0 && !rec.HasResult() {
+			return nil
+		}
+		return []string{resultLine(rec.Rows, rec.Affected, rec.Err, rec.Duration)}
+	}
+	lines := []string{}
+	for _, p := range rec.Parts {
+		lines = append(lines, resultLine(p.Rows, p.Affected, p.Err, p.Duration))
+	}
+	return lines
+}
+
+func resultLine(rows, affected uint64, err string, duration int64) string {
+	if len(err) > 0 {
+		return err
+	}
+	elapsed := fmt.Sprintf("(%.3f sec)", (time.Duration(duration) * time.Microsecond).Seconds())
+	switch {
+	case rows > 0:
+		return fmt.Sprintf("%d %s in set %s", rows, plural(rows, "row"), elapsed)
+	case affected > 0:
+		return fmt.Sprintf("Query OK, %d %s affected %s", affected, plural(affected, "row"), elapsed)
+	}
+	return "OK " + elapsed
+}
+
+// failoverLine describes the backends of a logical target tried at connect.
+func failoverLine(rec decoder.Record) string {
+	if len(rec.Target) == 0 {
+		return fmt.Sprintf("no backend of target %s available (%s)", rec.Cmd, rec.Err)
+	}
+	return fmt.Sprintf("target %s failed over to %s (%s)", rec.Cmd, rec.Target, rec.Err)
+}
+
+// cursorLine describes the cursor asked for by COM_STMT_EXECUTE or read by
+// COM_STMT_FETCH.
+func cursorLine(stmtID uint32, c *decoder.Cursor) string {
+	if len(c.Type) > 0 {
+		state := "not opened"
+		if c.Open {
+			state = "opened"
+		}
+		return fmt.Sprintf("# %s cursor of statement %d %s", c.Type, stmtID, state)
+	}
+	line := fmt.Sprintf("# fetch %d %s from the cursor of statement %d", c.Asked, plural(uint64(c.Asked), "row"), stmtID)
+	if c.Execute > 0 {
+		line += fmt.Sprintf(", %d read since execute #%d", c.Fetched, c.Execute)
+	}
+	if c.Done {
+		line += ", last row read"
+	}
+	return line
+}
+
+func plural(n uint64, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
+
+// formatAttributes formats query attributes as name='value', sorted by name.
+func formatAttributes(attrs map[string]string) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s='%s'", name, attrs[name])
+	}
+	return strings.Join(names, " ")
+}
@@ -2,22 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy"
 	proxylog "github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/log"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/mask"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/route"
 	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sink"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/upload"
 	"github.com/masahide/mysql8-audit-proxy/pkg/serverconfig"
 )
 
+const sinkShutdownTimeout = 30 * time.Second
+
 var (
 	version = "dev"
 	commit  = "none"
@@ -47,20 +57,120 @@ func main() {
 		log.Printf("proxyConfig:\n%s\n", dumpJSON(proxyConf))
 	}
 	q := make(chan *sendpacket.SendPacket, 1000)
-	logHandler, err := proxylog.NewAuditLogWriter(q, proxyConf.LogFileName, proxyConf.RotateTime, time.Now())
+	logHandler, err := proxylog.NewAuditLogWriter(q, proxyConf.LogFileName, proxyConf.LogFormat, proxyConf.RotateTime, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	logHandler.SetAnalyze(proxyConf.LogAnalyze)
+	logHandler.SetFlushInterval(proxyConf.LogFlush)
+	logHandler.SetMemoryBudget(proxyConf.LogMemory)
+	if len(proxyConf.LogEncryptKey) > 0 {
+		pub, err := proxylog.LoadPublicKey(proxyConf.LogEncryptKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := logHandler.SetEncryptKey(pub); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(proxyConf.RotateCommand) > 0 {
+		if err := logHandler.OnClose(upload.Command(proxyConf.RotateCommand)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var shipper *upload.Shipper
+	if len(proxyConf.UploadURL) > 0 {
+		uploader, err := upload.New(proxyConf.UploadURL, upload.S3Config{
+			Endpoint:  proxyConf.S3Endpoint,
+			Region:    proxyConf.S3Region,
+			AccessKey: proxyConf.S3AccessKey,
+			SecretKey: proxyConf.S3SecretKey,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		shipper = upload.NewShipper(uploader, proxyConf.UploadRetry, time.Second)
+		if err := logHandler.OnClose(shipper.Enqueue); err != nil {
+			log.Fatal(err)
+		}
+		closed, err := logHandler.ClosedFiles()
+		if err != nil {
+			log.Fatal(err)
+		}
+		shipper.Recover(closed)
+	}
+	sinks, err := newSinks(proxyConf)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(sinks) > 0 {
+		logHandler.Subscribe(sinks)
+	}
+	masker, err := mask.New(mask.Config{
+		Credentials: proxyConf.MaskCredentials,
+		Regex:       strings.Fields(proxyConf.MaskRegex),
+		Literals:    strings.Fields(proxyConf.MaskLiterals),
+		HashKey:     proxyConf.MaskHashKey,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, pattern := range strings.Fields(proxyConf.CaptureUsers) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("capture users %q: %v", pattern, err)
+		}
+	}
+	switch proxyConf.TargetCompression {
+	case "client", "none", "zlib", "zstd":
+	default:
+		log.Fatalf("unknown target compression: %q", proxyConf.TargetCompression)
+	}
+	for _, pattern := range strings.Fields(proxyConf.InfileDenyUsers) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("infile deny users %q: %v", pattern, err)
+		}
+	}
+	var routes *route.File
+	if len(proxyConf.RouteFile) > 0 {
+		if routes, err = route.Open(proxyConf.RouteFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 	p := &mysqlproxy.ProxySrv{
 		AuditLogWriter: logHandler,
 		SvConfMng:      svConfMng,
 		Config:         proxyConf,
+		Masker:         masker,
+		Routes:         routes,
 	}
 
 	pctx, cancel := context.WithCancel(context.Background())
 	ctx, stop := signal.NotifyContext(pctx, os.Interrupt)
 	defer stop()
 	wg := sync.WaitGroup{}
+	if shipper != nil {
+		wg.Add(1)
+		go func() {
+			// not bound to ctx so that the last file is shipped on shutdown
+			if err := shipper.Run(context.Background()); err != nil {
+				log.Printf("shipper error: %v", err)
+			}
+			log.Println("shipper stopped")
+			wg.Done()
+		}()
+	}
+	// not bound to ctx so that queued events are sent on shutdown
+	sinkCtx, sinkCancel := context.WithCancel(context.Background())
+	defer sinkCancel()
+	for _, s := range sinks {
+		wg.Add(1)
+		go func(s *sink.Sink) {
+			if err := s.Run(sinkCtx); err != nil {
+				log.Printf("sink:%s error: %v", s, err)
+			}
+			wg.Done()
+		}(s)
+	}
 	wg.Add(1)
 	go func() {
 		err := logHandler.LogWriteWorker(ctx)
@@ -68,6 +178,12 @@ func main() {
 		if err != nil && err != context.Canceled {
 			log.Printf("Proxy error: %v", err)
 		}
+		if shipper != nil {
+			shipper.Close()
+		}
+		sinks.Close()
+		// give up sinks whose destination is still down
+		time.AfterFunc(sinkShutdownTimeout, sinkCancel)
 		wg.Done()
 	}()
 	wg.Add(1)
@@ -84,6 +200,37 @@ func main() {
 	wg.Wait()
 }
 
+func newSinks(conf *mysqlproxy.ProxyCfg) (sink.Group, error) {
+	opt := sink.Options{
+		QueueSize:     conf.SinkQueueSize,
+		BatchSize:     conf.SinkBatchSize,
+		FlushInterval: conf.SinkFlush,
+		Retries:       conf.SinkRetry,
+		Backoff:       time.Second,
+		Analyze:       conf.LogAnalyze,
+	}
+	if len(conf.SinkCAFile) > 0 {
+		pem, err := os.ReadFile(conf.SinkCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.SinkCAFile)
+		}
+		opt.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	sinks := sink.Group{}
+	for _, u := range strings.Fields(conf.Sinks) {
+		s, err := sink.New(u, opt)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
 func dumpJSON(v any) string {
 	s, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
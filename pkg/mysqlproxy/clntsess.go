@@ -15,6 +15,7 @@ import (
 	"github.com/go-mysql-org/go-mysql/client"
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/server"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
 	"github.com/masahide/mysql8-audit-proxy/pkg/timeoutnet"
 )
 
@@ -27,6 +28,11 @@ type ClientSess struct {
 	TargetUser     string
 	TargetPassword string
 	TargetDB       string
+	// replica taking the reads of a session that splits them, nil otherwise
+	ReplicaMysql *client.Conn
+	ReplicaAddr  string
+
+	targetCap uint32 // capabilities asked of the target
 }
 
 func DumpResult(res *mysql.Result, err error) {
@@ -50,6 +56,11 @@ func DumpResult(res *mysql.Result, err error) {
 }
 
 func PrintCapability(capability uint32) {
+	log.Printf("capabilitystring: %s", strings.Join(capabilityNames(capability), "|"))
+}
+
+// capabilityNames returns the names of the flags of capability.
+func capabilityNames(capability uint32) []string {
 	caps := make([]string, 0, bits.OnesCount32(capability))
 	for capability != 0 {
 		field := uint32(1 << bits.TrailingZeros32(capability))
@@ -124,36 +135,121 @@ func PrintCapability(capability uint32) {
 			caps = append(caps, fmt.Sprintf("(%d)", field))
 		}
 	}
-	log.Printf("capabilitystring: %s", strings.Join(caps, "|"))
+	return caps
 }
 
 // ClntSess methods
 // ConnectToMySQL connect to mysql target server
 func (c *ClientSess) ConnectToMySQL(ctx context.Context) error {
 	// PrintCapability(c.ClientMysql.Capability())
+	TargetConn, err := c.dial(ctx, c.TargetAddr, func(cap uint32) uint32 {
+		cap = c.targetCompression(cap)
+		c.targetCap = cap
+		return cap
+	})
+	if err != nil {
+		log.Printf("connect to mysql target err:%s", err)
+		return err
+	}
+	c.ProxySrv.learnProfile(c.TargetAddr, TargetConn.GetServerVersion(), TargetConn.Capability())
+	missing := c.ClientMysql.Capability() & negotiatedCaps &^ negotiated(TargetConn)
+	if c.ProxySrv.deniesInfile(c.TargetUser) {
+		// not asked of the target on purpose, LOAD DATA LOCAL INFILE fails
+		missing &^= mysql.CLIENT_LOCAL_FILES
+	}
+	if missing != 0 {
+		// the packets of the session would differ from what the client expects
+		TargetConn.Close()
+		names := strings.Join(capabilityNames(missing), "|")
+		log.Printf("target:%s lacks capabilities of the client: %s", c.TargetAddr, names)
+		return mysql.NewError(mysql.ER_UNKNOWN_ERROR, fmt.Sprintf("Target '%s' does not support capabilities the client negotiated with the proxy: %s", c.TargetAddr, names))
+	}
+	// ci := TargetConn.Conn.Conn
+	// TargetConn.Conn.Conn = WrapConn(ci, "targetConn:") // debug wrapper
+	// DumpResult(TargetConn.Execute("select @@version, @@version_comment, @@version_compile_os, @@version_compile_machine"))
+
+	c.TargetMysql = TargetConn
+	return nil
+}
+
+// ConnectToReplica connects to a replica at addr as the user of the
+// session. The replica is not asked for compression, and must negotiate
+// what the target did, since its responses go to the same client.
+func (c *ClientSess) ConnectToReplica(ctx context.Context, addr string) error {
+	const compress = mysql.CLIENT_COMPRESS | mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	conn, err := c.dial(ctx, addr, func(cap uint32) uint32 { return cap &^ compress })
+	if err != nil {
+		return err
+	}
+	if differ := negotiated(conn) ^ negotiated(c.TargetMysql); differ != 0 {
+		conn.Close()
+		return fmt.Errorf("%w: %s", errReplicaCaps, strings.Join(capabilityNames(differ), "|"))
+	}
+	c.ReplicaMysql, c.ReplicaAddr = conn, addr
+	return nil
+}
+
+// dial logs in to addr as the user of the session, asking for the
+// capabilities of the client that setCap leaves.
+func (c *ClientSess) dial(ctx context.Context, addr string, setCap func(uint32) uint32) (*client.Conn, error) {
 	dialer := &net.Dialer{}
 	clientDialer := dialer.DialContext
-	TargetConn, err := client.ConnectWithDialer(ctx,
-		c.TargetNet, c.TargetAddr, c.TargetUser, c.TargetPassword, c.TargetDB, clientDialer,
+	return client.ConnectWithDialer(ctx,
+		c.TargetNet, addr, c.TargetUser, c.TargetPassword, c.TargetDB, clientDialer,
 		func(con *client.Conn) error {
 			cap := c.ClientMysql.Capability() | mysql.CLIENT_LOCAL_FILES
+			if c.ProxySrv.deniesInfile(c.TargetUser) {
+				// the target refuses LOAD DATA LOCAL INFILE
+				cap &^= mysql.CLIENT_LOCAL_FILES
+			}
+			cap = setCap(cap)
 			// PrintCapability(cap)
 			con.SetCapability(cap)
-			con.UnsetCapability(mysql.CLIENT_QUERY_ATTRIBUTES) // disable CLIENT_QUERY_ATTRIBUTES for now
+			if cap&mysql.CLIENT_QUERY_ATTRIBUTES == 0 {
+				// the commands of the client come without query attributes
+				con.UnsetCapability(mysql.CLIENT_QUERY_ATTRIBUTES)
+			}
 			return nil
 		},
 	)
-	if err != nil {
-		log.Printf("connect to mysql target err:%s", err)
-		return err
+}
+
+// negotiated returns the capabilities of negotiatedCaps that conn uses.
+func negotiated(conn *client.Conn) uint32 {
+	var caps uint32
+	for flag := uint32(1); flag != 0 && flag <= negotiatedCaps; flag <<= 1 {
+		if flag&negotiatedCaps != 0 && conn.HasCapability(flag) {
+			caps |= flag
+		}
 	}
-	// TargetConn.UnsetCapability(mysql.CLIENT_QUERY_ATTRIBUTES) // disable CLIENT_QUERY_ATTRIBUTES for now
-	// ci := TargetConn.Conn.Conn
-	// TargetConn.Conn.Conn = WrapConn(ci, "targetConn:") // debug wrapper
-	// DumpResult(TargetConn.Execute("select @@version, @@version_comment, @@version_compile_os, @@version_compile_machine"))
+	return caps
+}
 
-	c.TargetMysql = TargetConn
-	return nil
+// targetCompression sets the compression asked of the target in cap, see
+// ProxyCfg.TargetCompression.
+func (c *ClientSess) targetCompression(cap uint32) uint32 {
+	const compress = mysql.CLIENT_COMPRESS | mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	cap &^= compress
+	switch c.ProxySrv.Config.TargetCompression {
+	case "none":
+		return cap
+	case "zlib":
+		return cap | mysql.CLIENT_COMPRESS
+	case "zstd":
+		return cap | mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	}
+	return cap | c.ClientMysql.Capability()&compress
+}
+
+// compression returns the compression negotiated with the client and the target.
+func (c *ClientSess) compression() (client, target int) {
+	targetCap := c.targetCap
+	for _, flag := range []uint32{mysql.CLIENT_COMPRESS, mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM} {
+		if !c.TargetMysql.HasCapability(flag) {
+			targetCap &^= flag
+		}
+	}
+	return protocol.Compression(c.ClientMysql.Capability()), protocol.Compression(targetCap)
 }
 
 func (c *ClientSess) Proxy(ctx context.Context) {
@@ -187,12 +283,68 @@ func (c *ClientSess) Proxy(ctx context.Context) {
 		ConnID:    c.ClientMysql.ConnectionID(),
 		Config:    c.ProxySrv.Config,
 		LogWriter: c.ProxySrv.AuditLogWriter,
+		Masker:    c.ProxySrv.Masker,
+	}
+	// a target without query attributes gets the commands without them
+	st.QueryAttributes = c.ClientMysql.Capability()&mysql.CLIENT_QUERY_ATTRIBUTES != 0
+	st.TargetAttributes = st.QueryAttributes && c.TargetMysql.HasCapability(mysql.CLIENT_QUERY_ATTRIBUTES)
+	deprecateEOF := c.ClientMysql.Capability()&mysql.CLIENT_DEPRECATE_EOF != 0 &&
+		c.TargetMysql.HasCapability(mysql.CLIENT_DEPRECATE_EOF)
+	st.Tracker = protocol.NewTracker(deprecateEOF, func(r protocol.Result) {
+		if len(r.Err) == 0 {
+			st.status.Store(uint32(r.Status))
+		}
+		st.sendResult(ctx, c.TargetAddr, r)
+	})
+	if c.ProxySrv.captures(c.TargetUser) {
+		st.Tracker.SetCapture(c.ProxySrv.Config.CaptureRows, c.ProxySrv.Config.CaptureBytes)
+		st.Capture = true
+	}
+	// compression ends at the proxy on each side, so that every packet is
+	// audited as it is
+	var toClient io.Writer = clientWriter
+	clientCompression, targetCompression := c.compression()
+	if clientCompression != protocol.CompressNone {
+		frames := protocol.NewCompressed(clientCompression)
+		st.Reader = newDecompressConn(clientReader, frames)
+		toClient = frames.NewCompressor(clientWriter)
+	}
+	// the Tracker sees a response before the client, so that what it
+	// changes, e.g. the current database or whether the target is in a
+	// transaction, is known before the client sends its next command
+	responses := io.MultiWriter(st.Tracker, toClient)
+	if c.ReplicaMysql != nil {
+		toClient = &lockedWriter{w: toClient}
+		responses = io.MultiWriter(st.Tracker, toClient)
+		st.Replica = NewReplica(c.ReplicaAddr,
+			&timeoutnet.TimeoutReader{Conn: c.ReplicaMysql.Conn, Timeout: c.ProxySrv.Config.ConTimeout, Ctx: cctx},
+			&timeoutnet.TimeoutWriter{Conn: c.ReplicaMysql.Conn, Timeout: c.ProxySrv.Config.ConTimeout, Ctx: cctx},
+			toClient, deprecateEOF)
+		if st.Capture {
+			st.Replica.Tracker.SetCapture(c.ProxySrv.Config.CaptureRows, c.ProxySrv.Config.CaptureBytes)
+		}
+		var status uint16
+		if c.TargetMysql.IsAutoCommit() {
+			status |= mysql.SERVER_STATUS_AUTOCOMMIT
+		}
+		if c.TargetMysql.IsInTransaction() {
+			status |= mysql.SERVER_STATUS_IN_TRANS
+		}
+		st.status.Store(uint32(status))
+	}
+	if targetCompression != protocol.CompressNone {
+		st.TargetFrames = protocol.NewCompressed(targetCompression)
+		st.Writer = st.TargetFrames.NewCompressor(targetWriter)
+		responses = st.TargetFrames.NewDecompressor(responses)
+	}
+	if clientCompression != protocol.CompressNone || targetCompression != protocol.CompressNone {
+		log.Printf("compression client:%s target:%s", protocol.CompressionName(clientCompression), protocol.CompressionName(targetCompression))
 	}
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
 		//_, err := CopyDebug("clientWriter:", clientWriter, targetReader)
-		_, err := io.Copy(clientWriter, targetReader)
+		_, err := io.Copy(responses, targetReader)
 		if err != nil {
 			log.Printf("clientWriter err:%v", err)
 		}
@@ -211,6 +363,11 @@ func (c *ClientSess) Proxy(ctx context.Context) {
 	if err := c.TargetMysql.Close(); err != nil {
 		log.Printf("targetMysql close err:%v", err)
 	}
+	if c.ReplicaMysql != nil {
+		if err := c.ReplicaMysql.Close(); err != nil {
+			log.Printf("replicaMysql close err:%v", err)
+		}
+	}
 }
 
 type DebugWriter struct {
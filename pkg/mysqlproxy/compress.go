@@ -0,0 +1,43 @@
+package mysqlproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+)
+
+// decompressConn reads the packets of a client that uses the compressed
+// protocol. A frame read in part is kept when the connection fails, e.g.
+// on a timeout, so that Read can be called again.
+type decompressConn struct {
+	net.Conn
+	frames io.Writer
+	buf    bytes.Buffer
+	raw    []byte
+}
+
+func newDecompressConn(conn net.Conn, c *protocol.Compressed) *decompressConn {
+	d := &decompressConn{Conn: conn, raw: make([]byte, 16*1024)}
+	d.frames = c.NewDecompressor(&d.buf)
+	return d
+}
+
+func (d *decompressConn) Read(p []byte) (int, error) {
+	for d.buf.Len() == 0 {
+		n, err := d.Conn.Read(d.raw)
+		if n > 0 {
+			if _, err := d.frames.Write(d.raw[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err != nil {
+			if d.buf.Len() == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	return d.buf.Read(p)
+}
@@ -0,0 +1,312 @@
+package decoder
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	_ "github.com/pingcap/tidb/parser/test_driver"
+)
+
+// Statement classes
+const (
+	ClassDQL   = "DQL"   // SELECT
+	ClassDML   = "DML"   // INSERT, UPDATE, DELETE, LOAD DATA, CALL
+	ClassDDL   = "DDL"   // CREATE, ALTER, DROP, TRUNCATE, RENAME
+	ClassDCL   = "DCL"   // GRANT, REVOKE and account management
+	ClassTCL   = "TCL"   // transactions and table locks
+	ClassAdmin = "ADMIN" // SET, SHOW, USE, KILL, FLUSH, ...
+)
+
+// Access kinds of a table
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessDDL   = "ddl"
+	AccessDCL   = "dcl"  // privileges granted or revoked on the table
+	AccessLock  = "lock" // LOCK TABLES
+)
+
+// TableAccess is a table touched by a statement.
+type TableAccess struct {
+	Name   string `json:"name"` // "schema.table", or "table" if no database is selected
+	Access string `json:"access"`
+}
+
+func (t TableAccess) String() string { return t.Name + ":" + t.Access }
+
+var parserPool = sync.Pool{New: func() any { return parser.New() }}
+
+// Classify returns the class of an SQL statement and the tables it
+// touches. Tables without a schema are qualified with db, the current
+// database. Statements the parser does not understand are classified by
+// their first keyword and have no tables.
+func Classify(sql, db string) (class string, tables []TableAccess) {
+	class, tables, _ = classify(sql, db)
+	return class, tables
+}
+
+// Tables returns the tables an SQL statement touches, qualified as by
+// Classify, or an error if the parser does not understand the statement.
+func Tables(sql, db string) ([]TableAccess, error) {
+	_, tables, err := classify(sql, db)
+	return tables, err
+}
+
+func classify(sql, db string) (class string, tables []TableAccess, err error) {
+	p := parserPool.Get().(*parser.Parser)
+	stmts, _, err := p.Parse(sql, "", "")
+	parserPool.Put(p)
+	if err != nil {
+		return keywordClasses[firstKeyword(sql)], nil, err
+	}
+	if len(stmts) == 0 {
+		return keywordClasses[firstKeyword(sql)], nil, nil
+	}
+	v := &tableVisitor{db: db, seen: map[TableAccess]bool{}, ctes: map[string]bool{}}
+	for i, stmt := range stmts {
+		c := stmtClass(stmt)
+		if i == 0 {
+			class = c
+		}
+		v.statement(stmt, c)
+	}
+	return class, v.tables, nil
+}
+
+func stmtClass(stmt ast.StmtNode) string {
+	switch s := stmt.(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		return ClassDQL
+	case *ast.InsertStmt, *ast.UpdateStmt, *ast.DeleteStmt, *ast.LoadDataStmt, *ast.CallStmt,
+		*ast.DoStmt, *ast.ImportIntoStmt, *ast.NonTransactionalDMLStmt:
+		return ClassDML
+	case *ast.GrantStmt, *ast.RevokeStmt, *ast.GrantRoleStmt, *ast.RevokeRoleStmt,
+		*ast.CreateUserStmt, *ast.AlterUserStmt, *ast.DropUserStmt, *ast.RenameUserStmt,
+		*ast.SetPwdStmt, *ast.SetRoleStmt, *ast.SetDefaultRoleStmt:
+		return ClassDCL
+	case *ast.BeginStmt, *ast.CommitStmt, *ast.RollbackStmt, *ast.SavepointStmt,
+		*ast.ReleaseSavepointStmt, *ast.LockTablesStmt, *ast.UnlockTablesStmt:
+		return ClassTCL
+	case ast.DDLNode:
+		return ClassDDL
+	case *ast.ExplainStmt:
+		if s.Analyze {
+			// EXPLAIN ANALYZE runs the statement
+			return stmtClass(s.Stmt)
+		}
+	}
+	return ClassAdmin
+}
+
+// tableVisitor collects the tables of statements. Tables read by a
+// statement that writes others, e.g. in INSERT ... SELECT, are read.
+type tableVisitor struct {
+	db      string
+	tables  []TableAccess
+	seen    map[TableAccess]bool
+	ctes    map[string]bool     // names of common table expressions, which are no tables
+	aliases map[string][]string // alias or name to the tables of the statement
+	modes   []string
+}
+
+func (v *tableVisitor) statement(stmt ast.StmtNode, class string) {
+	v.aliases = map[string][]string{}
+	switch s := stmt.(type) {
+	case *ast.InsertStmt:
+		// the written table first
+		v.modes = []string{AccessWrite}
+		s.Table.Accept(v)
+		v.walk(stmt, AccessWrite)
+	case *ast.UpdateStmt:
+		if s.TableRefs == nil || s.TableRefs.TableRefs == nil || s.TableRefs.TableRefs.Right == nil {
+			v.walk(stmt, AccessWrite)
+			return
+		}
+		// the tables of the join whose columns are assigned
+		targets := []string{}
+		for _, a := range s.List {
+			if a.Column.Table.L == "" {
+				// cannot tell without the schema, so any table may be written
+				v.walk(stmt, AccessWrite)
+				return
+			}
+			targets = append(targets, a.Column.Table.L)
+		}
+		v.walk(stmt, AccessRead)
+		v.targets(targets)
+	case *ast.DeleteStmt:
+		if !s.IsMultiTable || s.Tables == nil {
+			v.walk(stmt, AccessWrite)
+			return
+		}
+		v.walk(stmt, AccessRead)
+		targets := []string{}
+		for _, t := range s.Tables.Tables {
+			targets = append(targets, t.Name.L)
+		}
+		v.targets(targets)
+	case *ast.GrantStmt:
+		v.grant(s.Level)
+	case *ast.RevokeStmt:
+		v.grant(s.Level)
+	case *ast.LockTablesStmt:
+		v.walk(stmt, AccessLock)
+	default:
+		switch class {
+		case ClassDML:
+			v.walk(stmt, AccessWrite)
+		case ClassDDL:
+			v.walk(stmt, AccessDDL)
+		default:
+			v.walk(stmt, AccessRead)
+		}
+	}
+}
+
+func (v *tableVisitor) walk(stmt ast.StmtNode, mode string) {
+	v.modes = []string{mode}
+	stmt.Accept(v)
+}
+
+// targets adds the written tables of a multiple table UPDATE or DELETE.
+func (v *tableVisitor) targets(names []string) {
+	for _, n := range names {
+		for _, name := range v.aliases[n] {
+			v.add(name, AccessWrite)
+		}
+	}
+}
+
+func (v *tableVisitor) grant(level *ast.GrantLevel) {
+	if level == nil || level.Level != ast.GrantLevelTable {
+		return
+	}
+	v.add(v.qualify(level.DBName, level.TableName), AccessDCL)
+}
+
+func (v *tableVisitor) Enter(in ast.Node) (ast.Node, bool) {
+	switch n := in.(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		v.modes = append(v.modes, AccessRead)
+	case *ast.CommonTableExpression:
+		v.ctes[n.Name.L] = true
+	case *ast.TableSource:
+		if t, ok := n.Source.(*ast.TableName); ok && n.AsName.L != "" {
+			name := v.qualify(t.Schema.O, t.Name.O)
+			v.aliases[n.AsName.L] = append(v.aliases[n.AsName.L], name)
+		}
+	case *ast.TableName:
+		if n.Schema.L == "" && v.ctes[n.Name.L] {
+			return in, true
+		}
+		name := v.qualify(n.Schema.O, n.Name.O)
+		v.aliases[n.Name.L] = append(v.aliases[n.Name.L], name)
+		v.add(name, v.modes[len(v.modes)-1])
+	}
+	return in, false
+}
+
+func (v *tableVisitor) Leave(in ast.Node) (ast.Node, bool) {
+	switch in.(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		v.modes = v.modes[:len(v.modes)-1]
+	}
+	return in, true
+}
+
+func (v *tableVisitor) qualify(schema, table string) string {
+	switch {
+	case len(schema) > 0:
+		return schema + "." + table
+	case len(v.db) > 0:
+		return v.db + "." + table
+	}
+	return table
+}
+
+func (v *tableVisitor) add(name, access string) {
+	t := TableAccess{Name: name, Access: access}
+	if v.seen[t] {
+		return
+	}
+	v.seen[t] = true
+	v.tables = append(v.tables, t)
+}
+
+// UseDB returns the database a query selects with USE, the last one if
+// it holds several statements. Only queries starting with USE are parsed.
+func UseDB(sql string) (db string, ok bool) {
+	if firstKeyword(sql) != "USE" {
+		return "", false
+	}
+	p := parserPool.Get().(*parser.Parser)
+	stmts, _, err := p.Parse(sql, "", "")
+	parserPool.Put(p)
+	if err != nil {
+		return "", false
+	}
+	for _, stmt := range stmts {
+		if u, isUse := stmt.(*ast.UseStmt); isUse {
+			db, ok = u.DBName, true
+		}
+	}
+	return db, ok
+}
+
+// keywordClasses classifies statements the parser cannot read.
+var keywordClasses = map[string]string{
+	"SELECT": ClassDQL, "WITH": ClassDQL, "TABLE": ClassDQL, "VALUES": ClassDQL,
+	"INSERT": ClassDML, "UPDATE": ClassDML, "DELETE": ClassDML, "REPLACE": ClassDML,
+	"LOAD": ClassDML, "CALL": ClassDML, "DO": ClassDML,
+	"CREATE": ClassDDL, "ALTER": ClassDDL, "DROP": ClassDDL, "TRUNCATE": ClassDDL, "RENAME": ClassDDL,
+	"GRANT": ClassDCL, "REVOKE": ClassDCL,
+	"BEGIN": ClassTCL, "START": ClassTCL, "COMMIT": ClassTCL, "ROLLBACK": ClassTCL,
+	"SAVEPOINT": ClassTCL, "RELEASE": ClassTCL, "XA": ClassTCL, "LOCK": ClassTCL, "UNLOCK": ClassTCL,
+}
+
+// StatementType returns the first keyword of an SQL statement in upper
+// case, e.g. "SELECT", or the command name for other commands.
+func StatementType(rec Record) string {
+	if rec.Command != "COM_QUERY" {
+		return rec.Command
+	}
+	if kw := firstKeyword(rec.Cmd); len(kw) > 0 {
+		return kw
+	}
+	return "UNKNOWN"
+}
+
+// firstKeyword returns the first word of sql in upper case, skipping
+// comments and parentheses.
+func firstKeyword(sql string) string {
+	s := sql
+	for {
+		s = strings.TrimLeft(s, " \t\r\n(")
+		switch {
+		case strings.HasPrefix(s, "/*"):
+			end := strings.Index(s, "*/")
+			if end < 0 {
+				return ""
+			}
+			s = s[end+2:]
+			continue
+		case strings.HasPrefix(s, "--"), strings.HasPrefix(s, "#"):
+			end := strings.IndexByte(s, '\n')
+			if end < 0 {
+				return ""
+			}
+			s = s[end+1:]
+			continue
+		}
+		break
+	}
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || r == '_')
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.ToUpper(s[:end])
+}
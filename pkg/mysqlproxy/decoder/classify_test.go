@@ -0,0 +1,97 @@
+package decoder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClassify(t *testing.T) {
+	testcase := []struct {
+		sql    string
+		db     string
+		class  string
+		tables []TableAccess
+	}{
+		{sql: "select * from t", db: "db1", class: ClassDQL, tables: []TableAccess{{"db1.t", AccessRead}}},
+		{sql: "select * from t", class: ClassDQL, tables: []TableAccess{{"t", AccessRead}}},
+		{sql: "select * from a.t join b.u using (id)", db: "db1", class: ClassDQL, tables: []TableAccess{{"a.t", AccessRead}, {"b.u", AccessRead}}},
+		{sql: "with x as (select * from t) select * from x", db: "db1", class: ClassDQL, tables: []TableAccess{{"db1.t", AccessRead}}},
+		{sql: "insert into billing.invoices select * from staging", db: "db1", class: ClassDML,
+			tables: []TableAccess{{"billing.invoices", AccessWrite}, {"db1.staging", AccessRead}}},
+		{sql: "update t set a = 1 where id in (select id from u)", db: "db1", class: ClassDML,
+			tables: []TableAccess{{"db1.t", AccessWrite}, {"db1.u", AccessRead}}},
+		{sql: "update t1 a join t2 b on a.id = b.id set a.x = b.x", db: "db1", class: ClassDML,
+			tables: []TableAccess{{"db1.t1", AccessRead}, {"db1.t2", AccessRead}, {"db1.t1", AccessWrite}}},
+		{sql: "delete t1 from t1 join t2 on t1.id = t2.id", db: "db1", class: ClassDML,
+			tables: []TableAccess{{"db1.t1", AccessRead}, {"db1.t2", AccessRead}, {"db1.t1", AccessWrite}}},
+		{sql: "delete from t where id = 1", db: "db1", class: ClassDML, tables: []TableAccess{{"db1.t", AccessWrite}}},
+		{sql: "replace into t values (1)", db: "db1", class: ClassDML, tables: []TableAccess{{"db1.t", AccessWrite}}},
+		{sql: "alter table t add c int", db: "db1", class: ClassDDL, tables: []TableAccess{{"db1.t", AccessDDL}}},
+		{sql: "create view v as select * from t", db: "db1", class: ClassDDL, tables: []TableAccess{{"db1.v", AccessDDL}, {"db1.t", AccessRead}}},
+		{sql: "truncate table t", db: "db1", class: ClassDDL, tables: []TableAccess{{"db1.t", AccessDDL}}},
+		{sql: "grant select on billing.invoices to 'u'@'%'", class: ClassDCL, tables: []TableAccess{{"billing.invoices", AccessDCL}}},
+		{sql: "grant select on *.* to 'u'@'%'", class: ClassDCL},
+		{sql: "create user 'u'@'%' identified by 'p'", class: ClassDCL},
+		{sql: "begin", class: ClassTCL},
+		{sql: "lock tables t write", db: "db1", class: ClassTCL, tables: []TableAccess{{"db1.t", AccessLock}}},
+		{sql: "set autocommit = 1", class: ClassAdmin},
+		{sql: "show tables", class: ClassAdmin},
+		{sql: "insert into t values (1); select * from u", db: "db1", class: ClassDML,
+			tables: []TableAccess{{"db1.t", AccessWrite}, {"db1.u", AccessRead}}},
+		// not understood by the parser
+		{sql: "delete from t wher id = 1", db: "db1", class: ClassDML},
+		{sql: "frobnicate", class: ""},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.sql, func(t *testing.T) {
+			class, tables := Classify(tc.sql, tc.db)
+			if class != tc.class {
+				t.Errorf("class=%q want:%q", class, tc.class)
+			}
+			if diff := cmp.Diff(tc.tables, tables); diff != "" {
+				t.Errorf("tables mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	tests := []struct {
+		rec  Record
+		want string
+	}{
+		{Record{Command: "COM_QUERY", Cmd: "select 1"}, "SELECT"},
+		{Record{Command: "COM_QUERY", Cmd: "  (SELECT 1) UNION (SELECT 2)"}, "SELECT"},
+		{Record{Command: "COM_QUERY", Cmd: "/* a */ /* b */Insert into t values (1)"}, "INSERT"},
+		{Record{Command: "COM_QUERY", Cmd: "-- comment\nupdate t set a = 1"}, "UPDATE"},
+		{Record{Command: "COM_QUERY", Cmd: "/* unterminated"}, "UNKNOWN"},
+		{Record{Command: "COM_QUERY", Cmd: ""}, "UNKNOWN"},
+		{Record{Command: "COM_STMT_PREPARE", Cmd: "select ?"}, "COM_STMT_PREPARE"},
+	}
+	for _, tt := range tests {
+		if got := StatementType(tt.rec); got != tt.want {
+			t.Errorf("StatementType(%q) = %q, want %q", tt.rec.Cmd, got, tt.want)
+		}
+	}
+}
+
+func TestUseDB(t *testing.T) {
+	testcase := []struct {
+		sql string
+		db  string
+		ok  bool
+	}{
+		{"use hr", "hr", true},
+		{"USE `my db`;", "my db", true},
+		{"/* c */ use hr; use billing", "billing", true},
+		{"select 1", "", false},
+		{"use", "", false},
+	}
+	for _, tc := range testcase {
+		db, ok := UseDB(tc.sql)
+		if db != tc.db || ok != tc.ok {
+			t.Errorf("UseDB(%q) = %q, %v, want %q, %v", tc.sql, db, ok, tc.db, tc.ok)
+		}
+	}
+}
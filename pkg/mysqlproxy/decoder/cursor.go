@@ -0,0 +1,119 @@
+package decoder
+
+import (
+	"encoding/binary"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// flags of COM_STMT_EXECUTE asking for a cursor
+const (
+	cursorReadOnly   = 0x01
+	cursorForUpdate  = 0x02
+	cursorScrollable = 0x04
+)
+
+// Cursor is the server-side cursor of a COM_STMT_EXECUTE that asked for one,
+// or of a COM_STMT_FETCH reading from it.
+type Cursor struct {
+	Type    string `json:"type,omitempty"`        // of COM_STMT_EXECUTE: "read_only", "for_update" or "scrollable"
+	Open    bool   `json:"open,omitempty"`        // of COM_STMT_EXECUTE: the server opened it, its rows are fetched
+	Execute uint32 `json:"execute_seq,omitempty"` // of COM_STMT_FETCH: seq of the COM_STMT_EXECUTE that opened it
+	Asked   uint32 `json:"asked,omitempty"`       // of COM_STMT_FETCH: rows asked for
+	Fetched uint64 `json:"fetched,omitempty"`     // of COM_STMT_FETCH: rows read from the cursor so far, these included
+	Done    bool   `json:"done,omitempty"`        // of COM_STMT_FETCH: the last row was read
+}
+
+// cursorType names the cursor asked for by the flags of COM_STMT_EXECUTE,
+// "" if none.
+func cursorType(flags byte) string {
+	switch {
+	case flags&cursorScrollable != 0:
+		return "scrollable"
+	case flags&cursorForUpdate != 0:
+		return "for_update"
+	case flags&cursorReadOnly != 0:
+		return "read_only"
+	}
+	return ""
+}
+
+// decodeStmt fills the statement id of a COM_STMT_* command from data, the
+// payload after the command byte, and the cursor of an execute or a fetch.
+func (r *Record) decodeStmt(cmd byte, data []byte) {
+	if len(data) < 4 {
+		return
+	}
+	r.StmtID = binary.LittleEndian.Uint32(data)
+	switch cmd {
+	case mysql.COM_STMT_EXECUTE:
+		if len(data) > 4 {
+			if typ := cursorType(data[4]); len(typ) > 0 {
+				r.Cursor = &Cursor{Type: typ}
+			}
+		}
+	case mysql.COM_STMT_FETCH:
+		r.Cursor = &Cursor{}
+		if len(data) >= 8 {
+			r.Cursor.Asked = binary.LittleEndian.Uint32(data[4:])
+		}
+	}
+}
+
+// mergeCursor marks the cursor of a command open or read to the end after
+// the server status of its result.
+func (r *Record) mergeCursor() {
+	if r.Cursor == nil || len(r.Err) > 0 {
+		return
+	}
+	switch r.Command {
+	case "COM_STMT_EXECUTE":
+		r.Cursor.Open = r.Status&mysql.SERVER_STATUS_CURSOR_EXISTS != 0
+	case "COM_STMT_FETCH":
+		r.Cursor.Done = r.Status&mysql.SERVER_STATUS_LAST_ROW_SEND != 0
+	}
+}
+
+// openCursor is a cursor being fetched from.
+type openCursor struct {
+	execute uint32
+	fetched uint64
+}
+
+// linkCursor ties a fetch to the execute that opened its cursor. rec must
+// come after the earlier records of its connection.
+func (j *Joiner) linkCursor(rec *Record) {
+	id := rec.ConnectionID
+	if rec.State == "disconnect" {
+		delete(j.cursors, id)
+		return
+	}
+	if rec.State != "est" {
+		return
+	}
+	switch rec.Command {
+	case "COM_STMT_EXECUTE", "COM_STMT_CLOSE", "COM_STMT_RESET":
+		// each of them closes the cursor of the statement
+		delete(j.cursors[id], rec.StmtID)
+		if rec.Cursor == nil || !rec.Cursor.Open {
+			return
+		}
+		if j.cursors[id] == nil {
+			j.cursors[id] = map[uint32]*openCursor{}
+		}
+		j.cursors[id][rec.StmtID] = &openCursor{execute: rec.Seq}
+	case "COM_STMT_FETCH":
+		c := j.cursors[id][rec.StmtID]
+		if c == nil || rec.Cursor == nil {
+			// opened before the log begins
+			return
+		}
+		c.fetched += rec.Rows
+		rec.Cursor.Execute, rec.Cursor.Fetched = c.execute, c.fetched
+		if rec.Cursor.Done {
+			delete(j.cursors[id], rec.StmtID)
+		}
+	case "COM_RESET_CONNECTION", "COM_CHANGE_USER":
+		delete(j.cursors, id)
+	}
+}
@@ -0,0 +1,60 @@
+package decoder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+func TestCursors(t *testing.T) {
+	command := func(seq uint32, payload ...byte) sendpacket.SendPacket {
+		return sendpacket.SendPacket{ConnectionID: 1, State: "est", Seq: seq, Packets: append([]byte{byte(len(payload)), 0, 0, 0}, payload...)}
+	}
+	result := func(seq uint32, rows uint64, status uint16) sendpacket.SendPacket {
+		return sendpacket.SendPacket{ConnectionID: 1, State: "result", Seq: seq, Duration: 100, Rows: rows, Status: status}
+	}
+	log := []sendpacket.SendPacket{
+		// statement 1 read-only cursor
+		command(1, 0x17, 1, 0, 0, 0, 0x01, 1, 0, 0, 0),
+		result(1, 0, 0x42),
+		command(2, 0x1c, 1, 0, 0, 0, 100, 0, 0, 0),
+		result(2, 100, 0x42),
+		// statement 2 asks for a cursor, the server opens none
+		command(3, 0x17, 2, 0, 0, 0, 0x01, 1, 0, 0, 0),
+		result(3, 0, 0x02),
+		command(4, 0x1c, 1, 0, 0, 0, 100, 0, 0, 0),
+		result(4, 30, 0xc2),
+		// read to the end, the cursor is gone
+		command(5, 0x1c, 1, 0, 0, 0, 100, 0, 0, 0),
+		sendpacket.SendPacket{ConnectionID: 1, State: "result", Seq: 5, Duration: 100, Err: "ERROR 1421 (HY000): The statement (1) has no open cursor."},
+	}
+	j := NewJoiner()
+	got := []*Cursor{}
+	for _, sp := range log {
+		for _, rec := range j.Add(Decode(sp)) {
+			got = append(got, rec.Cursor)
+		}
+	}
+	for _, rec := range j.Flush() {
+		got = append(got, rec.Cursor)
+	}
+	want := []*Cursor{
+		{Type: "read_only", Open: true},
+		{Execute: 1, Asked: 100, Fetched: 100},
+		{Type: "read_only"},
+		{Execute: 1, Asked: 100, Fetched: 130, Done: true},
+		{Asked: 100},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("cursors mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCursorType(t *testing.T) {
+	for flags, want := range map[byte]string{0x00: "", 0x01: "read_only", 0x02: "for_update", 0x04: "scrollable", 0x08: ""} {
+		if got := cursorType(flags); got != want {
+			t.Errorf("cursorType(%#x) = %q, want %q", flags, got, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+// Record is the JSON schema of a decoded audit record, as printed by
+// mysql8-audit-log-decoder.
+type Record struct {
+	Datetime     time.Time         `json:"time"`
+	ConnectionID uint32            `json:"con_id,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Db           string            `json:"db,omitempty"`
+	Addr         string            `json:"addr,omitempty"`
+	Target       string            `json:"target,omitempty"`
+	State        string            `json:"state,omitempty"`
+	Err          string            `json:"err,omitempty"`
+	Packets      []byte            `json:"packets,omitempty"`
+	Command      string            `json:"command,omitempty"` // e.g. "COM_QUERY"
+	Cmd          string            `json:"cmd,omitempty"`
+	Seq          uint32            `json:"seq,omitempty"`
+	Duration     int64             `json:"duration_us,omitempty"`
+	Rows         uint64            `json:"rows,omitempty"`
+	Affected     uint64            `json:"affected,omitempty"`
+	Digest       string            `json:"digest,omitempty"`        // of COM_QUERY, see Fingerprint
+	Normalized   string            `json:"normalized,omitempty"`    // of COM_QUERY, see Fingerprint
+	Class        string            `json:"class,omitempty"`         // of COM_QUERY, see Classify
+	Tables       []TableAccess     `json:"tables,omitempty"`        // of COM_QUERY, see Classify
+	Capture      *protocol.Capture `json:"capture,omitempty"`       // captured result set of a command
+	Infile       *protocol.Infile  `json:"infile,omitempty"`        // file sent for LOAD DATA LOCAL INFILE
+	Truncated    uint64            `json:"truncated,omitempty"`     // payload length of a command logged in part
+	Attributes   map[string]string `json:"attributes,omitempty"`    // query attributes sent with a command
+	Statements   []Statement       `json:"statements,omitempty"`    // of a COM_QUERY that holds several, see SplitStatements
+	Parts        []protocol.Part   `json:"parts,omitempty"`         // results of a response that holds several
+	Status       uint16            `json:"server_status,omitempty"` // server status flags ending the response
+	StmtID       uint32            `json:"stmt_id,omitempty"`       // of COM_STMT_EXECUTE, COM_STMT_FETCH and the like
+	Cursor       *Cursor           `json:"cursor,omitempty"`        // cursor asked for by COM_STMT_EXECUTE or read by COM_STMT_FETCH
+}
+
+// Decode converts sp into a Record. Packets of the result may share memory with sp.
+func Decode(sp sendpacket.SendPacket) (res Record) {
+	res = Record{
+		Datetime:     time.Unix(sp.Datetime, 0),
+		ConnectionID: sp.ConnectionID,
+		User:         sp.User,
+		Db:           sp.Db,
+		Addr:         sp.Addr,
+		Target:       sp.Target,
+		State:        sp.State,
+		Err:          sp.Err,
+		Seq:          sp.Seq,
+		Duration:     sp.Duration,
+		Rows:         sp.Rows,
+		Affected:     sp.Affected,
+		Truncated:    sp.Truncated,
+		Status:       sp.Status,
+	}
+	if len(sp.Capture) > 0 {
+		res.Capture = &protocol.Capture{}
+		if err := json.Unmarshal(sp.Capture, res.Capture); err != nil {
+			res.Capture = nil
+		}
+	}
+	if len(sp.Infile) > 0 {
+		res.Infile = &protocol.Infile{}
+		if err := json.Unmarshal(sp.Infile, res.Infile); err != nil {
+			res.Infile = nil
+		}
+	}
+	if len(sp.Parts) > 0 {
+		if err := json.Unmarshal(sp.Parts, &res.Parts); err != nil {
+			res.Parts = nil
+		}
+	}
+	if len(sp.Attributes) > 0 {
+		if err := json.Unmarshal(sp.Attributes, &res.Attributes); err != nil {
+			res.Attributes = nil
+		}
+	}
+	if sp.State == "failover" {
+		// Cmd is the logical target, Target the backend connected to if any and
+		// Err why the others were not
+		res.Cmd = sp.Cmd
+		return
+	}
+	if sp.State == "infile" {
+		// content of a LOAD DATA LOCAL INFILE file, not a command
+		res.Packets = sp.Packets
+		return
+	}
+	data, err := trim(sp.Packets)
+	if err != nil {
+		res.Packets = sp.Packets
+		return
+	}
+	if len(data) == 0 {
+		res.Packets = sp.Packets
+		return
+	}
+	cmd := data[0]
+	data = data[1:]
+	res.Command = GetComName(cmd)
+	switch cmd {
+	case mysql.COM_QUIT:
+		res.Cmd = "quit"
+		res.Packets = nil
+	case mysql.COM_QUERY:
+		res.Cmd = string(data)
+		res.Packets = nil
+	case mysql.COM_PING:
+		res.Cmd = "ping"
+		res.Packets = nil
+	case mysql.COM_INIT_DB:
+		res.Cmd = "use " + string(data)
+		res.Packets = nil
+	case mysql.COM_FIELD_LIST:
+		table, wildcard, _ := bytes.Cut(data, []byte{0x00})
+		res.Cmd = "fieldList " + string(table)
+		if len(wildcard) > 0 {
+			res.Cmd = res.Cmd + " " + string(wildcard)
+		}
+		res.Packets = nil
+	case mysql.COM_STMT_PREPARE:
+		res.Cmd = "stmt_prepare"
+		res.Packets = sp.Packets
+	case mysql.COM_STMT_EXECUTE:
+		res.Cmd = "stmt_execute"
+		res.Packets = sp.Packets
+		res.decodeStmt(cmd, data)
+	case mysql.COM_STMT_FETCH:
+		res.Cmd = "stmt_fetch"
+		res.Packets = nil
+		res.decodeStmt(cmd, data)
+	case mysql.COM_STMT_CLOSE:
+		res.Cmd = "stmt_close"
+		res.Packets = sp.Packets
+		res.decodeStmt(cmd, data)
+	case mysql.COM_STMT_SEND_LONG_DATA:
+		res.Cmd = "stmt_send_long_data"
+		res.Packets = sp.Packets
+		res.decodeStmt(cmd, data)
+	case mysql.COM_STMT_RESET:
+		res.Cmd = "stmt_reset"
+		res.Packets = sp.Packets
+		res.decodeStmt(cmd, data)
+	case mysql.COM_SET_OPTION:
+		res.Cmd = "set_option"
+		res.Packets = sp.Packets
+	case mysql.COM_REGISTER_SLAVE:
+		res.Cmd = "register_slave"
+		res.Packets = sp.Packets
+	case mysql.COM_BINLOG_DUMP:
+		res.Cmd = "binlog_dump"
+		res.Packets = sp.Packets
+	case mysql.COM_BINLOG_DUMP_GTID:
+		res.Cmd = "binlog_dump"
+		res.Packets = sp.Packets
+	default:
+		res.Cmd = GetComName(cmd)
+		res.Packets = sp.Packets
+	}
+	return
+}
+
+func trim(dst []byte) ([]byte, error) {
+	if len(dst) < 4 {
+		return nil, fmt.Errorf("dst too small %v", dst)
+	}
+	return dst[4:], nil
+}
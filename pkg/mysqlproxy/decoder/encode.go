@@ -0,0 +1,35 @@
+package decoder
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+// EncodeJSON writes sp as one line of JSON in the Record schema. Queries
+// are not parsed: readers fill in what Analyze does.
+func EncodeJSON(w io.Writer, sp *sendpacket.SendPacket) error {
+	return json.NewEncoder(w).Encode(Decode(*sp))
+}
+
+// EncodeOCSF writes sp as one line of JSON in the OCSF Datastore Activity schema.
+func EncodeOCSF(w io.Writer, sp *sendpacket.SendPacket) error {
+	return json.NewEncoder(w).Encode(NewOCSF(Decode(*sp)))
+}
+
+// EncodeAnalyzedJSON is EncodeJSON with the digest, class and tables of
+// the query.
+func EncodeAnalyzedJSON(w io.Writer, sp *sendpacket.SendPacket) error {
+	rec := Decode(*sp)
+	rec.Analyze()
+	return json.NewEncoder(w).Encode(rec)
+}
+
+// EncodeAnalyzedOCSF is EncodeOCSF with the digest, class and tables of
+// the query.
+func EncodeAnalyzedOCSF(w io.Writer, sp *sendpacket.SendPacket) error {
+	rec := Decode(*sp)
+	rec.Analyze()
+	return json.NewEncoder(w).Encode(NewOCSF(rec))
+}
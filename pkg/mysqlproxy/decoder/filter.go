@@ -0,0 +1,106 @@
+package decoder
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Filter selects records. Zero fields match everything.
+type Filter struct {
+	From         time.Time // inclusive
+	To           time.Time // exclusive
+	User         string
+	Target       string // "host:port" or host
+	Addr         string // client address, "host:port" or host
+	ConnectionID uint32
+	State        string
+	Command      string // "COM_QUERY", "QUERY" or "query"
+	SQL          *regexp.Regexp
+	Digest       string // a digest or a prefix of it
+	Normalized   *regexp.Regexp
+	Class        string // "DML", "dml", ...
+	Table        string // "schema.table", or a table name in any schema
+	Access       string // access kind of Table, or of any table if Table is empty
+}
+
+// Match reports whether rec passes all conditions of the filter.
+func (f *Filter) Match(rec *Record) bool {
+	switch {
+	case !f.From.IsZero() && rec.Datetime.Before(f.From):
+		return false
+	case !f.To.IsZero() && !rec.Datetime.Before(f.To):
+		return false
+	case len(f.User) > 0 && rec.User != f.User:
+		return false
+	case len(f.Target) > 0 && !matchAddr(rec.Target, f.Target):
+		return false
+	case len(f.Addr) > 0 && !matchAddr(rec.Addr, f.Addr):
+		return false
+	case f.ConnectionID != 0 && rec.ConnectionID != f.ConnectionID:
+		return false
+	case len(f.State) > 0 && rec.State != f.State:
+		return false
+	case len(f.Command) > 0 && !matchCommand(rec.Command, f.Command):
+		return false
+	case f.SQL != nil && !f.SQL.MatchString(rec.Cmd):
+		return false
+	case len(f.Digest) > 0 && !rec.anyStatement(func(digest, _ string) bool { return matchDigest(digest, f.Digest) }):
+		return false
+	case f.Normalized != nil && !f.Normalized.MatchString(rec.Normalized):
+		return false
+	case len(f.Class) > 0 && !rec.anyStatement(func(_, class string) bool { return strings.EqualFold(class, f.Class) }):
+		return false
+	case (len(f.Table) > 0 || len(f.Access) > 0) && !f.matchTables(rec.Tables):
+		return false
+	}
+	return true
+}
+
+// anyStatement reports whether the digest and class of the record, or
+// those of one of its statements, match.
+func (r *Record) anyStatement(match func(digest, class string) bool) bool {
+	if match(r.Digest, r.Class) {
+		return true
+	}
+	for _, s := range r.Statements {
+		if match(s.Digest, s.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDigest(digest, want string) bool {
+	return len(digest) > 0 && strings.HasPrefix(digest, want)
+}
+
+func (f *Filter) matchTables(tables []TableAccess) bool {
+	for _, t := range tables {
+		if len(f.Access) > 0 && t.Access != f.Access {
+			continue
+		}
+		if len(f.Table) == 0 || t.Name == f.Table || !strings.Contains(f.Table, ".") && strings.HasSuffix(t.Name, "."+f.Table) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr matches addr with either the whole address or its host part.
+func matchAddr(addr, want string) bool {
+	if addr == want {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && host == want
+}
+
+func matchCommand(command, want string) bool {
+	want = strings.ToUpper(want)
+	if !strings.HasPrefix(want, "COM_") {
+		want = "COM_" + want
+	}
+	return command == want
+}
@@ -0,0 +1,77 @@
+package decoder
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	rec := Record{
+		Datetime:     time.Unix(1700000000, 0),
+		ConnectionID: 10001,
+		User:         "user1",
+		Addr:         "10.0.0.1:50000",
+		Target:       "db1:3306",
+		State:        "est",
+		Command:      "COM_QUERY",
+		Cmd:          "SELECT * FROM users",
+		Digest:       "4e1bbb1d2ba07a1a38ee7a4ef5ba7e7b1a9d6e1f1e2b5d1c63e3c9c5c7b4cc1e",
+		Normalized:   "select * from `users`",
+		Class:        ClassDQL,
+		Tables:       []TableAccess{{"app.users", AccessRead}},
+	}
+	testcase := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{name: "empty", filter: Filter{}, want: true},
+		{name: "in range", filter: Filter{From: time.Unix(1700000000, 0), To: time.Unix(1700000001, 0)}, want: true},
+		{name: "before", filter: Filter{From: time.Unix(1700000001, 0)}, want: false},
+		{name: "to is exclusive", filter: Filter{To: time.Unix(1700000000, 0)}, want: false},
+		{name: "user", filter: Filter{User: "user1"}, want: true},
+		{name: "other user", filter: Filter{User: "user2"}, want: false},
+		{name: "target host", filter: Filter{Target: "db1"}, want: true},
+		{name: "target port", filter: Filter{Target: "db1:3307"}, want: false},
+		{name: "client address", filter: Filter{Addr: "10.0.0.1:50000"}, want: true},
+		{name: "client host", filter: Filter{Addr: "10.0.0.2"}, want: false},
+		{name: "connection id", filter: Filter{ConnectionID: 10001}, want: true},
+		{name: "other connection id", filter: Filter{ConnectionID: 10002}, want: false},
+		{name: "state", filter: Filter{State: "connect"}, want: false},
+		{name: "command", filter: Filter{Command: "query"}, want: true},
+		{name: "full command name", filter: Filter{Command: "COM_QUERY"}, want: true},
+		{name: "other command", filter: Filter{Command: "ping"}, want: false},
+		{name: "sql", filter: Filter{SQL: regexp.MustCompile(`(?i)from\s+users`)}, want: true},
+		{name: "sql mismatch", filter: Filter{SQL: regexp.MustCompile(`orders`)}, want: false},
+		{name: "digest", filter: Filter{Digest: rec.Digest}, want: true},
+		{name: "digest prefix", filter: Filter{Digest: "4e1bbb1d"}, want: true},
+		{name: "other digest", filter: Filter{Digest: "5e1bbb1d"}, want: false},
+		{name: "normalized", filter: Filter{Normalized: regexp.MustCompile("^select .* from `users`$")}, want: true},
+		{name: "normalized mismatch", filter: Filter{Normalized: regexp.MustCompile("users where")}, want: false},
+		{name: "class", filter: Filter{Class: "dql"}, want: true},
+		{name: "other class", filter: Filter{Class: "DML"}, want: false},
+		{name: "table", filter: Filter{Table: "app.users"}, want: true},
+		{name: "table in any schema", filter: Filter{Table: "users"}, want: true},
+		{name: "table in other schema", filter: Filter{Table: "billing.users"}, want: false},
+		{name: "table name suffix", filter: Filter{Table: "ers"}, want: false},
+		{name: "table access", filter: Filter{Table: "users", Access: AccessRead}, want: true},
+		{name: "other table access", filter: Filter{Table: "users", Access: AccessWrite}, want: false},
+		{name: "access to any table", filter: Filter{Access: AccessWrite}, want: false},
+		{name: "all", filter: Filter{User: "user1", Command: "query", SQL: regexp.MustCompile(`users`)}, want: true},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.Match(&rec); got != tc.want {
+				t.Errorf("Match()=%v want:%v", got, tc.want)
+			}
+		})
+	}
+	// a statement after the first one matches too
+	rec.Statements = []Statement{{SQL: "SELECT * FROM users", Class: ClassDQL}, {SQL: "DROP TABLE users", Digest: "9f0c", Class: ClassDDL}}
+	for _, f := range []Filter{{Class: "ddl"}, {Digest: "9f0c"}} {
+		if !f.Match(&rec) {
+			t.Errorf("%+v does not match the second statement", f)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package decoder
+
+import (
+	"github.com/pingcap/tidb/parser"
+)
+
+// Fingerprint returns the digest and the normalized text of an SQL
+// statement. Literals are replaced with "?", lists of literals such as
+// IN (1, 2, 3) collapse into "( ... )", comments are removed and keywords
+// and whitespace are canonicalized, so statements that differ only in
+// their values share a digest.
+//
+// The rules for bindings also collapse IN (1), which the plain TiDB digest
+// keeps apart from longer lists.
+func Fingerprint(sql string) (digest, normalized string) {
+	normalized, d := parser.NormalizeDigestForBinding(sql)
+	return d.String(), normalized
+}
+
+// Analyze fills the digest, normalized text, class and tables of a
+// COM_QUERY record that has none, e.g. read from a JSON log written before
+// they were recorded, and those of each statement if it holds several.
+func (r *Record) Analyze() {
+	if r.Command != "COM_QUERY" {
+		return
+	}
+	if len(r.Digest) == 0 {
+		r.Digest, r.Normalized = Fingerprint(r.Cmd)
+	}
+	if len(r.Class) == 0 {
+		r.Class, r.Tables = Classify(r.Cmd, r.Db)
+	}
+	r.analyzeStatements()
+}
@@ -0,0 +1,65 @@
+package decoder
+
+import (
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	testcase := []struct {
+		name       string
+		sql        string
+		same       string // differs only in literals, comments or whitespace
+		normalized string
+	}{
+		{
+			name:       "literals",
+			sql:        "SELECT * FROM t WHERE id = 1 AND name = 'a'",
+			same:       "select *   from t\nwhere id=2 and name=\"b\"",
+			normalized: "select * from `t` where `id` = ? and `name` = ?",
+		},
+		{
+			name:       "in list",
+			sql:        "select * from t where id in (1, 2, 3)",
+			same:       "select * from t where id in (4)",
+			normalized: "select * from `t` where `id` in ( ... )",
+		},
+		{
+			name:       "comments",
+			sql:        "/* app:web */ update t set a = 1 -- why\n",
+			same:       "update t set a = 100",
+			normalized: "update `t` set `a` = ?",
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			digest, normalized := Fingerprint(tc.sql)
+			if normalized != tc.normalized {
+				t.Errorf("normalized=%q want:%q", normalized, tc.normalized)
+			}
+			if len(digest) != 64 {
+				t.Errorf("digest=%q want 64 hex digits", digest)
+			}
+			if same, _ := Fingerprint(tc.same); same != digest {
+				t.Errorf("digest of %q=%s want:%s", tc.same, same, digest)
+			}
+		})
+	}
+	if d1, _ := Fingerprint("select a from t"); d1 == "" {
+		t.Errorf("empty digest")
+	} else if d2, _ := Fingerprint("select b from t"); d1 == d2 {
+		t.Errorf("different queries share digest %s", d1)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	rec := Record{Command: "COM_QUERY", Cmd: "select 1"}
+	rec.Analyze()
+	if rec.Normalized != "select ?" || len(rec.Digest) == 0 {
+		t.Errorf("Analyze()=%q,%q", rec.Digest, rec.Normalized)
+	}
+	ping := Record{Command: "COM_PING", Cmd: "ping"}
+	ping.Analyze()
+	if len(ping.Digest) > 0 || len(ping.Normalized) > 0 {
+		t.Errorf("fingerprint of COM_PING: %q,%q", ping.Digest, ping.Normalized)
+	}
+}
@@ -0,0 +1,114 @@
+package decoder
+
+import (
+	"sort"
+)
+
+// Joiner merges the "result" record of each command into the record of the
+// command, so that a statement and its outcome are one Record. The result
+// of a command is logged after it, or sometimes just before it, since the
+// two are logged from different goroutines of the proxy.
+//
+// Logs written before the proxy tracked results have no seq and pass
+// through unchanged.
+type Joiner struct {
+	// command waiting for its result and the records logged after it, by connection
+	pending map[uint32][]Record
+	// result logged before its command, by connection
+	early map[uint32]Record
+	// cursors being fetched from, by connection and statement id
+	cursors map[uint32]map[uint32]*openCursor
+}
+
+func NewJoiner() *Joiner {
+	return &Joiner{pending: map[uint32][]Record{}, early: map[uint32]Record{}, cursors: map[uint32]map[uint32]*openCursor{}}
+}
+
+// Add takes the next record of the log and returns the records that are
+// complete. Records of a connection keep their order.
+func (j *Joiner) Add(rec Record) []Record {
+	out := j.add(rec)
+	for i := range out {
+		j.linkCursor(&out[i])
+	}
+	return out
+}
+
+func (j *Joiner) add(rec Record) []Record {
+	id := rec.ConnectionID
+	p := j.pending[id]
+	switch {
+	case rec.State == "result":
+		if len(p) > 0 && p[0].Seq == rec.Seq {
+			delete(j.pending, id)
+			merge(&p[0], rec)
+			return p
+		}
+		j.early[id] = rec
+		return nil
+	case rec.State == "est" && rec.Seq > 0 && (len(p) == 0 || p[0].Seq != rec.Seq):
+		// a new command
+		delete(j.pending, id)
+		if e, ok := j.early[id]; ok && e.Seq == rec.Seq {
+			delete(j.early, id)
+			merge(&rec, e)
+			return append(p, rec)
+		}
+		j.pending[id] = []Record{rec}
+		return p
+	case rec.State == "disconnect":
+		delete(j.pending, id)
+		delete(j.early, id)
+		return append(p, rec)
+	case len(p) > 0:
+		// e.g. the file sent for LOAD DATA LOCAL INFILE
+		j.pending[id] = append(p, rec)
+		return nil
+	}
+	return []Record{rec}
+}
+
+// Flush returns the commands still waiting for their results, in time order.
+func (j *Joiner) Flush() []Record {
+	ids := []uint32{}
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	sort.SliceStable(ids, func(a, b int) bool {
+		ta, tb := j.pending[ids[a]][0].Datetime, j.pending[ids[b]][0].Datetime
+		if ta.Equal(tb) {
+			return ids[a] < ids[b]
+		}
+		return ta.Before(tb)
+	})
+	out := []Record{}
+	for _, id := range ids {
+		out = append(out, j.pending[id]...)
+	}
+	for i := range out {
+		j.linkCursor(&out[i])
+	}
+	clear(j.pending)
+	clear(j.early)
+	clear(j.cursors)
+	return out
+}
+
+// HasResult reports whether a result was merged into the command record.
+func (r *Record) HasResult() bool {
+	return r.State == "est" && r.Duration > 0
+}
+
+func merge(cmd *Record, result Record) {
+	// a response takes some time, keep it non-zero for HasResult
+	cmd.Duration = max(result.Duration, 1)
+	cmd.Rows = result.Rows
+	cmd.Affected = result.Affected
+	cmd.Err = result.Err
+	cmd.Capture = result.Capture
+	cmd.Infile = result.Infile
+	cmd.Parts = result.Parts
+	cmd.Status = result.Status
+	cmd.tieParts()
+	cmd.mergeCursor()
+}
@@ -0,0 +1,243 @@
+package decoder
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+)
+
+// OCSF "Datastore Activity" (class 6005) of the Application Activity category.
+// https://schema.ocsf.io/1.1.0/classes/datastore_activity
+const (
+	ocsfVersion      = "1.1.0"
+	ocsfCategoryUID  = 6
+	ocsfCategoryName = "Application Activity"
+	ocsfClassUID     = 6005
+	ocsfClassName    = "Datastore Activity"
+
+	ocsfActivityConnect = 3
+	ocsfActivityQuery   = 4
+	ocsfActivityOther   = 99
+
+	ocsfStatusUnknown = 0
+	ocsfStatusSuccess = 1
+	ocsfStatusFailure = 2
+
+	ocsfSeverityInformational = 1
+)
+
+type OCSFProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+}
+
+type OCSFMetadata struct {
+	Version string      `json:"version"`
+	Product OCSFProduct `json:"product"`
+}
+
+type OCSFUser struct {
+	Name string `json:"name,omitempty"`
+}
+
+type OCSFActor struct {
+	User OCSFUser `json:"user"`
+}
+
+type OCSFEndpoint struct {
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// newOCSFEndpoint maps "ip:port" to ip and port. Other addresses such as
+// unix sockets or host names are kept as the name.
+func newOCSFEndpoint(addr string) OCSFEndpoint {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return OCSFEndpoint{Name: addr}
+	}
+	p, _ := strconv.Atoi(port)
+	return OCSFEndpoint{IP: host, Port: p}
+}
+
+func (e OCSFEndpoint) addr() string {
+	if len(e.IP) > 0 {
+		return net.JoinHostPort(e.IP, strconv.Itoa(e.Port))
+	}
+	return e.Name
+}
+
+type OCSFDatabase struct {
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"`
+}
+
+type OCSFQueryInfo struct {
+	QueryString string `json:"query_string,omitempty"`
+}
+
+type OCSFSession struct {
+	UID string `json:"uid"`
+}
+
+// OCSFUnmapped keeps the audit fields that have no OCSF attribute, so that
+// an OCSF log can be read back into Records.
+type OCSFUnmapped struct {
+	State      string            `json:"state,omitempty"`
+	Command    string            `json:"command,omitempty"`
+	Packets    []byte            `json:"packets,omitempty"`
+	Seq        uint32            `json:"seq,omitempty"`
+	Duration   int64             `json:"duration_us,omitempty"`
+	Rows       uint64            `json:"rows,omitempty"`
+	Affected   uint64            `json:"affected,omitempty"`
+	Digest     string            `json:"digest,omitempty"`
+	Normalized string            `json:"normalized,omitempty"`
+	Class      string            `json:"class,omitempty"`
+	Tables     []TableAccess     `json:"tables,omitempty"`
+	Capture    *protocol.Capture `json:"capture,omitempty"`
+	Infile     *protocol.Infile  `json:"infile,omitempty"`
+	Truncated  uint64            `json:"truncated,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Statements []Statement       `json:"statements,omitempty"`
+	Parts      []protocol.Part   `json:"parts,omitempty"`
+	Status     uint16            `json:"server_status,omitempty"`
+	StmtID     uint32            `json:"stmt_id,omitempty"`
+	Cursor     *Cursor           `json:"cursor,omitempty"`
+}
+
+type OCSF struct {
+	ActivityID   int            `json:"activity_id"`
+	ActivityName string         `json:"activity_name"`
+	CategoryUID  int            `json:"category_uid"`
+	CategoryName string         `json:"category_name"`
+	ClassUID     int            `json:"class_uid"`
+	ClassName    string         `json:"class_name"`
+	TypeUID      int            `json:"type_uid"`
+	TypeName     string         `json:"type_name"`
+	SeverityID   int            `json:"severity_id"`
+	Severity     string         `json:"severity"`
+	StatusID     int            `json:"status_id"`
+	Status       string         `json:"status,omitempty"`
+	StatusDetail string         `json:"status_detail,omitempty"`
+	Time         int64          `json:"time"` // unix milliseconds
+	Metadata     OCSFMetadata   `json:"metadata"`
+	Actor        OCSFActor      `json:"actor"`
+	SrcEndpoint  OCSFEndpoint   `json:"src_endpoint"`
+	DstEndpoint  *OCSFEndpoint  `json:"dst_endpoint,omitempty"`
+	Database     OCSFDatabase   `json:"database"`
+	QueryInfo    *OCSFQueryInfo `json:"query_info,omitempty"`
+	Session      OCSFSession    `json:"session"`
+	Unmapped     OCSFUnmapped   `json:"unmapped"`
+}
+
+// NewOCSF maps rec to an OCSF Datastore Activity event.
+func NewOCSF(rec Record) OCSF {
+	o := OCSF{
+		CategoryUID:  ocsfCategoryUID,
+		CategoryName: ocsfCategoryName,
+		ClassUID:     ocsfClassUID,
+		ClassName:    ocsfClassName,
+		SeverityID:   ocsfSeverityInformational,
+		Severity:     "Informational",
+		StatusID:     ocsfStatusUnknown,
+		Time:         rec.Datetime.UnixMilli(),
+		Metadata: OCSFMetadata{
+			Version: ocsfVersion,
+			Product: OCSFProduct{Name: "mysql8-audit-proxy", VendorName: "mysql8-audit-proxy"},
+		},
+		Actor:    OCSFActor{User: OCSFUser{Name: rec.User}},
+		Database: OCSFDatabase{Name: rec.Db, Type: "MySQL"},
+		Session:  OCSFSession{UID: strconv.FormatUint(uint64(rec.ConnectionID), 10)},
+		Unmapped: OCSFUnmapped{
+			State:      rec.State,
+			Command:    rec.Command,
+			Packets:    rec.Packets,
+			Seq:        rec.Seq,
+			Duration:   rec.Duration,
+			Rows:       rec.Rows,
+			Affected:   rec.Affected,
+			Digest:     rec.Digest,
+			Normalized: rec.Normalized,
+			Class:      rec.Class,
+			Tables:     rec.Tables,
+			Capture:    rec.Capture,
+			Infile:     rec.Infile,
+			Truncated:  rec.Truncated,
+			Attributes: rec.Attributes,
+			Statements: rec.Statements,
+			Parts:      rec.Parts,
+			Status:     rec.Status,
+			StmtID:     rec.StmtID,
+			Cursor:     rec.Cursor,
+		},
+	}
+	o.SrcEndpoint = newOCSFEndpoint(rec.Addr)
+	if len(rec.Target) > 0 {
+		dst := newOCSFEndpoint(rec.Target)
+		o.DstEndpoint = &dst
+	}
+	switch {
+	case rec.State == "connect":
+		o.ActivityID, o.ActivityName = ocsfActivityConnect, "Connect"
+	case rec.Command == "COM_QUERY":
+		o.ActivityID, o.ActivityName = ocsfActivityQuery, "Query"
+	case len(rec.State) > 0 && rec.State != "est":
+		o.ActivityID, o.ActivityName = ocsfActivityOther, rec.State
+	default:
+		o.ActivityID, o.ActivityName = ocsfActivityOther, rec.Command
+	}
+	o.TypeUID = ocsfClassUID*100 + o.ActivityID
+	o.TypeName = ocsfClassName + ": " + o.ActivityName
+	if len(rec.Cmd) > 0 {
+		o.QueryInfo = &OCSFQueryInfo{QueryString: rec.Cmd}
+	}
+	if len(rec.Err) > 0 {
+		o.StatusID, o.Status, o.StatusDetail = ocsfStatusFailure, "Failure", rec.Err
+	} else if o.ActivityID == ocsfActivityConnect {
+		o.StatusID, o.Status = ocsfStatusSuccess, "Success"
+	}
+	return o
+}
+
+// Record maps the event back to a Record.
+func (o OCSF) Record() Record {
+	id, _ := strconv.ParseUint(o.Session.UID, 10, 32)
+	rec := Record{
+		Datetime:     time.UnixMilli(o.Time),
+		ConnectionID: uint32(id),
+		User:         o.Actor.User.Name,
+		Db:           o.Database.Name,
+		Addr:         o.SrcEndpoint.addr(),
+		State:        o.Unmapped.State,
+		Err:          o.StatusDetail,
+		Packets:      o.Unmapped.Packets,
+		Command:      o.Unmapped.Command,
+		Seq:          o.Unmapped.Seq,
+		Duration:     o.Unmapped.Duration,
+		Rows:         o.Unmapped.Rows,
+		Affected:     o.Unmapped.Affected,
+		Digest:       o.Unmapped.Digest,
+		Normalized:   o.Unmapped.Normalized,
+		Class:        o.Unmapped.Class,
+		Tables:       o.Unmapped.Tables,
+		Capture:      o.Unmapped.Capture,
+		Infile:       o.Unmapped.Infile,
+		Truncated:    o.Unmapped.Truncated,
+		Attributes:   o.Unmapped.Attributes,
+		Statements:   o.Unmapped.Statements,
+		Parts:        o.Unmapped.Parts,
+		Status:       o.Unmapped.Status,
+		StmtID:       o.Unmapped.StmtID,
+		Cursor:       o.Unmapped.Cursor,
+	}
+	if o.DstEndpoint != nil {
+		rec.Target = o.DstEndpoint.addr()
+	}
+	if o.QueryInfo != nil {
+		rec.Cmd = o.QueryInfo.QueryString
+	}
+	return rec
+}
@@ -0,0 +1,137 @@
+package decoder
+
+import (
+	"strings"
+
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+)
+
+// Backends of a statement of a session that splits reads and writes
+const (
+	ToPrimary = iota // writes, and reads the replica cannot answer alike
+	ToReplica        // reads
+	ToBoth           // session settings, run on the primary and then on the replica
+	ToPin            // state only the primary has, e.g. a temporary table, so the session stays on it
+)
+
+// sessionFuncs are functions whose result depends on the connection, or
+// that take locks, and so differs on a replica.
+var sessionFuncs = map[string]bool{
+	"last_insert_id": true, "found_rows": true, "row_count": true, "connection_id": true,
+	"get_lock": true, "release_lock": true, "release_all_locks": true, "is_free_lock": true, "is_used_lock": true,
+	"nextval": true, "setval": true, "lastval": true,
+}
+
+// sessionVars are system variables that describe the previous statement
+// of the connection.
+var sessionVars = map[string]bool{
+	"last_insert_id": true, "identity": true, "warning_count": true, "error_count": true,
+}
+
+// ReadWrite returns where an SQL statement goes when reads and writes are
+// split. A query of several statements goes to the replica only if all of
+// them do. Statements the parser cannot read go to the primary, and those
+// that may set variables, e.g. SELECT ... INTO @a, keep the session there.
+func ReadWrite(sql string) int {
+	p := parserPool.Get().(*parser.Parser)
+	stmts, _, err := p.Parse(sql, "", "")
+	parserPool.Put(p)
+	if err != nil || len(stmts) == 0 {
+		switch firstKeyword(sql) {
+		case "SET", "USE", "SELECT", "WITH":
+			return ToPin
+		}
+		return ToPrimary
+	}
+	to := ToReplica
+	for _, stmt := range stmts {
+		switch s := stmtReadWrite(stmt); {
+		case s == ToPin:
+			return ToPin
+		case to == ToBoth && s == ToPrimary, to == ToPrimary && s == ToBoth:
+			// the replica would run the write too
+			return ToPin
+		case s != ToReplica:
+			to = s
+		}
+	}
+	return to
+}
+
+func stmtReadWrite(stmt ast.StmtNode) int {
+	v := &readWriteVisitor{}
+	switch s := stmt.(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		stmt.Accept(v)
+		switch {
+		case v.assigns:
+			return ToPin
+		case v.writes:
+			return ToPrimary
+		}
+		return ToReplica
+	case *ast.SetStmt:
+		stmt.Accept(v)
+		for _, a := range s.Variables {
+			if a.IsGlobal {
+				return ToPrimary
+			}
+		}
+		if v.writes || v.assigns {
+			// the replica would set something else
+			return ToPin
+		}
+		return ToBoth
+	case *ast.UseStmt:
+		return ToBoth
+	case *ast.CreateTableStmt:
+		if s.TemporaryKeyword != ast.TemporaryNone {
+			return ToPin
+		}
+	case *ast.LockTablesStmt, *ast.SetRoleStmt:
+		return ToPin
+	}
+	return ToPrimary
+}
+
+// readWriteVisitor looks for what keeps a SELECT or SET off a replica.
+type readWriteVisitor struct {
+	writes  bool // locks rows, writes a file, or depends on the connection
+	assigns bool // assigns user variables, which the replica would not have
+}
+
+func (v *readWriteVisitor) Enter(in ast.Node) (ast.Node, bool) {
+	switch n := in.(type) {
+	case *ast.SelectStmt:
+		if n.LockInfo != nil && n.LockInfo.LockType != ast.SelectLockNone {
+			v.writes = true
+		}
+		if n.SelectStmtOpts != nil && n.SelectStmtOpts.CalcFoundRows {
+			// FOUND_ROWS() is asked on the primary
+			v.writes = true
+		}
+		if n.SelectIntoOpt != nil {
+			if n.SelectIntoOpt.Tp == ast.SelectIntoVars {
+				v.assigns = true
+			}
+			v.writes = true
+		}
+	case *ast.FuncCallExpr:
+		if sessionFuncs[n.FnName.L] {
+			v.writes = true
+		}
+	case *ast.VariableExpr:
+		switch {
+		case n.IsSystem && sessionVars[strings.ToLower(n.Name)]:
+			v.writes = true
+		case !n.IsSystem && n.Value != nil:
+			v.assigns = true
+		}
+	}
+	return in, false
+}
+
+func (v *readWriteVisitor) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
@@ -0,0 +1,49 @@
+package decoder
+
+import "testing"
+
+func TestReadWrite(t *testing.T) {
+	testcase := []struct {
+		sql  string
+		want int
+	}{
+		{"select * from t where id = 1", ToReplica},
+		{"(select a from t) union (select a from u)", ToReplica},
+		{"with x as (select * from t) select * from x", ToReplica},
+		{"select @@session.sql_mode, @a, now()", ToReplica},
+		{"select 1; select 2", ToReplica},
+		{"select * from t for update", ToPrimary},
+		{"select * from t lock in share mode", ToPrimary},
+		{"select sql_calc_found_rows * from t limit 10", ToPrimary},
+		{"select found_rows()", ToPrimary},
+		{"select last_insert_id()", ToPrimary},
+		{"select @@warning_count", ToPrimary},
+		{"select get_lock('a', 10)", ToPrimary},
+		{"select * from t into outfile '/tmp/t.csv'", ToPrimary},
+		{"insert into t values (1)", ToPrimary},
+		{"update t set a = 1", ToPrimary},
+		{"begin", ToPrimary},
+		{"show tables", ToPrimary},
+		{"select 1; insert into t values (1)", ToPrimary},
+		{"set names utf8mb4", ToBoth},
+		{"set @a = 1, sql_mode = ''", ToBoth},
+		{"use db2", ToBoth},
+		{"set @a = 1; select @a", ToBoth},
+		{"set global max_connections = 10", ToPrimary},
+		{"set @id = last_insert_id()", ToPin},
+		{"select @a := max(id) from t", ToPin},
+		{"select max(id) into @a from t", ToPin}, // not read by the parser
+		{"set @a = 1; insert into t values (@a)", ToPin},
+		{"create temporary table tmp (id int)", ToPin},
+		{"create table t2 (id int)", ToPrimary},
+		{"lock tables t read", ToPin},
+		{"set role all", ToPin},
+		{"set @a = ^^^", ToPin},
+		{"selec 1", ToPrimary},
+	}
+	for _, tc := range testcase {
+		if got := ReadWrite(tc.sql); got != tc.want {
+			t.Errorf("ReadWrite(%q) = %d, want %d", tc.sql, got, tc.want)
+		}
+	}
+}
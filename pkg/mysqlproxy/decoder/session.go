@@ -0,0 +1,99 @@
+package decoder
+
+import (
+	"sort"
+	"time"
+)
+
+// Session is everything a client connection did, rebuilt from the log.
+type Session struct {
+	ConnectionID uint32    `json:"con_id"`
+	User         string    `json:"user,omitempty"`
+	Db           string    `json:"db,omitempty"`
+	Addr         string    `json:"addr,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	Start        time.Time `json:"start"`         // connect, or the first record if the log starts later
+	End          time.Time `json:"end,omitzero"`  // disconnect
+	Err          string    `json:"err,omitempty"` // why the session ended
+	Statements   []Record  `json:"statements"`    // commands with their results
+	Connected    bool      `json:"connected"`     // the connect record was seen
+	Disconnected bool      `json:"disconnected"`  // the disconnect record was seen
+	Duration     string    `json:"duration,omitempty"`
+}
+
+// Sessions groups records by connection.
+type Sessions struct {
+	joiner *Joiner
+	open   map[uint32]*Session
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{joiner: NewJoiner(), open: map[uint32]*Session{}}
+}
+
+// Add takes the next record of the log and returns the sessions it ended.
+func (s *Sessions) Add(rec Record) []*Session {
+	ended := []*Session{}
+	for _, r := range s.joiner.Add(rec) {
+		if sess := s.add(r); sess != nil {
+			ended = append(ended, sess)
+		}
+	}
+	return ended
+}
+
+func (s *Sessions) add(rec Record) *Session {
+	sess := s.open[rec.ConnectionID]
+	if sess == nil || rec.State == "connect" && sess.Connected {
+		// connection ids restart with the proxy
+		sess = &Session{ConnectionID: rec.ConnectionID, User: rec.User, Db: rec.Db, Addr: rec.Addr, Target: rec.Target, Start: rec.Datetime}
+		s.open[rec.ConnectionID] = sess
+	}
+	switch rec.State {
+	case "connect":
+		sess.Connected = true
+		sess.Start = rec.Datetime
+	case "disconnect":
+		sess.Disconnected = true
+		sess.End = rec.Datetime
+		sess.Err = rec.Err
+		sess.Duration = sess.End.Sub(sess.Start).String()
+		delete(s.open, rec.ConnectionID)
+		return sess
+	case "infile":
+		// content of a file, summed up in the infile of its statement
+	case "failover":
+		sess.Statements = append(sess.Statements, rec)
+		if len(rec.Target) == 0 {
+			// no backend took the session, the proxy refused it
+			sess.Connected, sess.Disconnected = true, true
+			sess.End = rec.Datetime
+			sess.Err = rec.Err
+			sess.Duration = sess.End.Sub(sess.Start).String()
+			delete(s.open, rec.ConnectionID)
+			return sess
+		}
+	default:
+		sess.Statements = append(sess.Statements, rec)
+	}
+	return nil
+}
+
+// Flush returns the sessions that have not ended, in order of start.
+func (s *Sessions) Flush() []*Session {
+	for _, r := range s.joiner.Flush() {
+		s.add(r)
+	}
+	res := []*Session{}
+	for id, sess := range s.open {
+		res = append(res, sess)
+		delete(s.open, id)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Start.Equal(res[j].Start) {
+			return res[i].ConnectionID < res[j].ConnectionID
+		}
+		return res[i].Start.Before(res[j].Start)
+	})
+	return res
+}
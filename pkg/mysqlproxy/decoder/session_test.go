@@ -0,0 +1,79 @@
+package decoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+)
+
+func TestSessions(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(1700000000+sec, 0) }
+	infile := &protocol.Infile{Name: "b.csv", Bytes: 3, SHA256: "17f8af97ad4a7f7639a4c9171d5185cbafb85462877a4746c21bdb0a4f940ca0"}
+	records := []Record{
+		{Datetime: at(0), ConnectionID: 1, User: "user1", State: "connect"},
+		{Datetime: at(0), ConnectionID: 2, User: "user2", State: "connect"},
+		{Datetime: at(1), ConnectionID: 1, State: "est", Seq: 1, Command: "COM_QUERY", Cmd: "select 1"},
+		{Datetime: at(1), ConnectionID: 1, State: "result", Seq: 1, Rows: 1, Duration: 300},
+		// the result is logged before its command
+		{Datetime: at(2), ConnectionID: 2, State: "result", Seq: 1, Err: "ERROR 1146 (42S02): Table 'db.t' doesn't exist", Duration: 100},
+		{Datetime: at(2), ConnectionID: 2, State: "est", Seq: 1, Command: "COM_QUERY", Cmd: "select * from t"},
+		// LOAD DATA LOCAL INFILE: the file is sent after the command, before the result
+		{Datetime: at(3), ConnectionID: 1, State: "est", Seq: 2, Command: "COM_QUERY", Cmd: "load data local infile 'a.csv' into table t"},
+		{Datetime: at(3), ConnectionID: 1, State: "est", Seq: 2, Command: "UNKNOWN:31", Cmd: "UNKNOWN:31"},
+		{Datetime: at(3), ConnectionID: 1, State: "result", Seq: 2, Affected: 10, Duration: 5000},
+		{Datetime: at(4), ConnectionID: 1, State: "est", Seq: 3, Command: "COM_QUIT", Cmd: "quit"},
+		{Datetime: at(4), ConnectionID: 1, State: "disconnect", Err: "EOF"},
+		{Datetime: at(5), ConnectionID: 2, State: "est", Seq: 2, Command: "COM_PING", Cmd: "ping"},
+		// the file is summed up in the result, its content is not a statement
+		{Datetime: at(6), ConnectionID: 2, State: "est", Seq: 3, Command: "COM_QUERY", Cmd: "load data local infile 'b.csv' into table t"},
+		{Datetime: at(6), ConnectionID: 2, State: "infile", Seq: 3, Packets: []byte{3, 0, 0, 2, '1', ',', '2'}},
+		{Datetime: at(6), ConnectionID: 2, State: "result", Seq: 3, Affected: 1, Duration: 800, Infile: infile},
+		// refused, no backend of the target available
+		{Datetime: at(7), ConnectionID: 3, User: "user3", State: "failover", Cmd: "sales", Err: "db1:3306: circuit open"},
+	}
+	s := NewSessions()
+	ended := []*Session{}
+	for _, rec := range records {
+		ended = append(ended, s.Add(rec)...)
+	}
+	ended = append(ended, s.Flush()...)
+	want := []*Session{
+		{
+			ConnectionID: 1, User: "user1", Start: at(0), End: at(4), Err: "EOF", Connected: true, Disconnected: true, Duration: "4s",
+			Statements: []Record{
+				{Datetime: at(1), ConnectionID: 1, State: "est", Seq: 1, Command: "COM_QUERY", Cmd: "select 1", Rows: 1, Duration: 300},
+				{Datetime: at(3), ConnectionID: 1, State: "est", Seq: 2, Command: "COM_QUERY", Cmd: "load data local infile 'a.csv' into table t", Affected: 10, Duration: 5000},
+				{Datetime: at(3), ConnectionID: 1, State: "est", Seq: 2, Command: "UNKNOWN:31", Cmd: "UNKNOWN:31"},
+				{Datetime: at(4), ConnectionID: 1, State: "est", Seq: 3, Command: "COM_QUIT", Cmd: "quit"},
+			},
+		},
+		{
+			ConnectionID: 3, User: "user3", Start: at(7), End: at(7), Err: "db1:3306: circuit open", Connected: true, Disconnected: true, Duration: "0s",
+			Statements: []Record{
+				{Datetime: at(7), ConnectionID: 3, User: "user3", State: "failover", Cmd: "sales", Err: "db1:3306: circuit open"},
+			},
+		},
+		{
+			ConnectionID: 2, User: "user2", Start: at(0), Connected: true,
+			Statements: []Record{
+				{Datetime: at(2), ConnectionID: 2, State: "est", Seq: 1, Command: "COM_QUERY", Cmd: "select * from t", Err: "ERROR 1146 (42S02): Table 'db.t' doesn't exist", Duration: 100},
+				{Datetime: at(5), ConnectionID: 2, State: "est", Seq: 2, Command: "COM_PING", Cmd: "ping"},
+				{Datetime: at(6), ConnectionID: 2, State: "est", Seq: 3, Command: "COM_QUERY", Cmd: "load data local infile 'b.csv' into table t", Affected: 1, Duration: 800, Infile: infile},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, ended); diff != "" {
+		t.Errorf("sessions mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestJoinerWithoutSeq(t *testing.T) {
+	// logs written before results were tracked pass through
+	j := NewJoiner()
+	rec := Record{Datetime: time.Unix(1700000000, 0), ConnectionID: 1, State: "est", Command: "COM_QUERY", Cmd: "select 1"}
+	if diff := cmp.Diff([]Record{rec}, j.Add(rec)); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+}
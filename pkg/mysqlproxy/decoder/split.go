@@ -0,0 +1,136 @@
+package decoder
+
+import (
+	"strings"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+	"github.com/pingcap/tidb/parser"
+)
+
+// Statement is one statement of a COM_QUERY that holds several, sent with
+// CLIENT_MULTI_STATEMENTS, with its own result.
+type Statement struct {
+	SQL        string        `json:"sql"`
+	Digest     string        `json:"digest,omitempty"`
+	Normalized string        `json:"normalized,omitempty"`
+	Class      string        `json:"class,omitempty"`
+	Tables     []TableAccess `json:"tables,omitempty"`
+	Rows       uint64        `json:"rows,omitempty"`
+	Affected   uint64        `json:"affected,omitempty"`
+	Err        string        `json:"err,omitempty"`
+	Duration   int64         `json:"duration_us,omitempty"`
+}
+
+// SplitStatements returns the statements of a query, or nil if it holds
+// fewer than two. The parser splits what it understands; anything else is
+// split at the semicolons outside of quotes and comments.
+func SplitStatements(sql string) []string {
+	if !strings.Contains(sql, ";") {
+		return nil
+	}
+	var texts []string
+	p := parserPool.Get().(*parser.Parser)
+	stmts, _, err := p.Parse(sql, "", "")
+	parserPool.Put(p)
+	if err == nil {
+		for _, stmt := range stmts {
+			texts = append(texts, stmt.Text())
+		}
+	} else {
+		texts = splitSemicolons(sql)
+	}
+	res := texts[:0]
+	for _, text := range texts {
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), ";"))
+		if len(text) > 0 {
+			res = append(res, text)
+		}
+	}
+	if len(res) < 2 {
+		return nil
+	}
+	return res
+}
+
+// splitSemicolons splits sql at the semicolons outside of quotes and comments.
+func splitSemicolons(sql string) []string {
+	var texts []string
+	start := 0
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			for i++; i < len(sql) && sql[i] != c; i++ {
+				if sql[i] == '\\' && c != '`' {
+					i++
+				}
+			}
+		case c == '#' || c == '-' && strings.HasPrefix(sql[i:], "-- "):
+			if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(sql)
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			if end := strings.Index(sql[i+2:], "*/"); end >= 0 {
+				i += 2 + end + 1
+			} else {
+				i = len(sql)
+			}
+		case c == ';':
+			texts = append(texts, sql[start:i])
+			start = i + 1
+		}
+	}
+	return append(texts, sql[start:])
+}
+
+// analyzeStatements fills the statements of a COM_QUERY that holds several.
+func (r *Record) analyzeStatements() {
+	if len(r.Statements) > 0 {
+		return
+	}
+	for _, text := range SplitStatements(r.Cmd) {
+		s := Statement{SQL: text}
+		s.Digest, s.Normalized = Fingerprint(text)
+		s.Class, s.Tables = Classify(text, r.Db)
+		r.Statements = append(r.Statements, s)
+	}
+}
+
+// tieParts gives each statement its result. A CALL takes the result sets
+// of the procedure and the OK that ends it, any other statement one
+// result. The statements after an error were not run and have none.
+func (r *Record) tieParts() {
+	if len(r.Statements) == 0 {
+		return
+	}
+	parts := r.Parts
+	if len(parts) == 0 {
+		// one result only, e.g. the first statement failed
+		parts = []protocol.Part{{Rows: r.Rows, Affected: r.Affected, Err: r.Err, Duration: r.Duration}}
+	}
+	for i := range r.Statements {
+		s := &r.Statements[i]
+		s.Rows, s.Affected, s.Err, s.Duration = 0, 0, "", 0
+		if len(parts) == 0 {
+			continue
+		}
+		call := firstKeyword(s.SQL) == "CALL"
+		for len(parts) > 0 {
+			p := parts[0]
+			parts = parts[1:]
+			s.Rows += p.Rows
+			s.Affected += p.Affected
+			s.Duration += p.Duration
+			s.Err = p.Err
+			if !call || !p.ResultSet || len(p.Err) > 0 {
+				break
+			}
+		}
+		// non-zero like that of the record, see HasResult
+		s.Duration = max(s.Duration, 1)
+		if len(s.Err) > 0 {
+			parts = nil
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package decoder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+)
+
+func TestSplitStatements(t *testing.T) {
+	testcase := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{name: "one", sql: "SELECT 1", want: nil},
+		{name: "trailing semicolon", sql: "SELECT 1;", want: nil},
+		{name: "two", sql: "UPDATE t SET a = 1 WHERE b = ';'; DROP TABLE t", want: []string{"UPDATE t SET a = 1 WHERE b = ';'", "DROP TABLE t"}},
+		{name: "comment", sql: "SELECT 1; /* c; */ SELECT 2;\n", want: []string{"SELECT 1", "/* c; */ SELECT 2"}},
+		{
+			name: "not parsed",
+			sql:  "SELEC 'a;b'; -- x;\nDROP TABLE `t;1`; SELECT \"it\\\";s\"",
+			want: []string{"SELEC 'a;b'", "-- x;\nDROP TABLE `t;1`", "SELECT \"it\\\";s\""},
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, SplitStatements(tc.sql)); diff != "" {
+				t.Errorf("statements mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTieParts(t *testing.T) {
+	errMsg := "ERROR 1051 (42S02): Unknown table 'db.x'"
+	testcase := []struct {
+		name   string
+		sql    string
+		result Record
+		want   []Statement
+	}{
+		{
+			name:   "result each",
+			sql:    "UPDATE t SET a = 1; SELECT * FROM t",
+			result: Record{Duration: 30, Rows: 2, Affected: 1, Parts: []protocol.Part{{Affected: 1, Duration: 10}, {ResultSet: true, Rows: 2, Duration: 20}}},
+			want:   []Statement{{Affected: 1, Duration: 10}, {Rows: 2, Duration: 20}},
+		},
+		{
+			name: "procedure",
+			sql:  "CALL p(); SELECT 1",
+			result: Record{Duration: 40, Rows: 4, Parts: []protocol.Part{
+				{ResultSet: true, Rows: 1, Duration: 10}, {ResultSet: true, Rows: 2, Duration: 10}, {Duration: 10}, {ResultSet: true, Rows: 1, Duration: 10},
+			}},
+			want: []Statement{{Rows: 3, Duration: 30}, {Rows: 1, Duration: 10}},
+		},
+		{
+			name:   "error stops",
+			sql:    "DELETE FROM t; DROP TABLE x; SELECT 1",
+			result: Record{Duration: 20, Affected: 3, Err: errMsg, Parts: []protocol.Part{{Affected: 3, Duration: 15}, {Err: errMsg, Duration: 5}}},
+			want:   []Statement{{Affected: 3, Duration: 15}, {Err: errMsg, Duration: 5}, {}},
+		},
+		{
+			name:   "first fails",
+			sql:    "DROP TABLE x; SELECT 1",
+			result: Record{Duration: 5, Err: errMsg},
+			want:   []Statement{{Err: errMsg, Duration: 5}, {}},
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := Record{State: "est", Command: "COM_QUERY", Cmd: tc.sql, Db: "db"}
+			rec.Analyze()
+			merge(&rec, tc.result)
+			got := []Statement{}
+			for _, s := range rec.Statements {
+				got = append(got, Statement{Rows: s.Rows, Affected: s.Affected, Err: s.Err, Duration: s.Duration})
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("results mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
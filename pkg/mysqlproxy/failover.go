@@ -0,0 +1,252 @@
+package mysqlproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/server"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/route"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+// errors told to the clients that cannot be proxied
+const (
+	erHostNotPrivileged = 1130 // ER_HOST_NOT_PRIVILEGED, no route for the client
+	crConnHostError     = 2003 // CR_CONN_HOST_ERROR, as told by MySQL Router when no backend is available
+)
+
+// errors of a target that is up but does not take sessions
+const (
+	erServerShutdown = 1053 // ER_SERVER_SHUTDOWN
+	erHostIsBlocked  = 1129 // ER_HOST_IS_BLOCKED
+)
+
+// connect connects sess to the first of the backends of target whose
+// circuit is closed. A backend that cannot be connected to counts as a
+// failure and the next one is tried; an error of a target that answers,
+// e.g. access denied, is returned as it is. If the first backend is not
+// the one connected to, the decision is logged.
+func (p *ProxySrv) connect(ctx context.Context, sess *ClientSess, target string, backends []string) error {
+	var failures []string
+	defer func() {
+		if len(failures) > 0 {
+			p.logFailover(ctx, sess, target, failures)
+		}
+	}()
+	for _, addr := range backends {
+		if !p.health.Allow(addr, time.Now()) {
+			failures = append(failures, addr+": circuit open")
+			continue
+		}
+		sess.TargetAddr = addr
+		err := sess.ConnectToMySQL(ctx)
+		if err == nil {
+			if p.health.Success(addr) {
+				log.Printf("backend:%s up", addr)
+			}
+			return nil
+		}
+		var myErr *mysql.MyError
+		if errors.As(err, &myErr) && !backendDown(myErr) {
+			if len(failures) > 0 {
+				failures = append(failures, fmt.Sprintf("%s: %v", addr, err))
+			}
+			sess.TargetAddr = ""
+			return myErr
+		}
+		if p.health.Failure(addr, time.Now()) {
+			log.Printf("backend:%s down, circuit open", addr)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", addr, err))
+	}
+	sess.TargetAddr = ""
+	return mysql.NewError(crConnHostError, fmt.Sprintf("Can't connect to MySQL server of target '%s': no backend available", target))
+}
+
+// backendDown reports whether the error of a target means that it does not
+// take sessions, so that the next backend is tried.
+func backendDown(err *mysql.MyError) bool {
+	switch err.Code {
+	case mysql.ER_CON_COUNT_ERROR, erServerShutdown, erHostIsBlocked:
+		return true
+	}
+	return false
+}
+
+// logFailover logs the backends that were skipped or failed before the one
+// connected to, if any, in a "failover" record.
+func (p *ProxySrv) logFailover(ctx context.Context, sess *ClientSess, target string, failures []string) {
+	log.Printf("failover target:%s to:%q (%s)", target, sess.TargetAddr, strings.Join(failures, "; "))
+	sp := p.AuditLogWriter.GetSendPacket()
+	*sp = sendpacket.SendPacket{Packets: sp.Packets[:0]}
+	sp.Datetime = time.Now().Unix()
+	sp.ConnectionID = sess.ClientMysql.ConnectionID()
+	sp.User = sess.TargetUser
+	sp.Db = sess.TargetDB
+	sp.Addr = sess.ClientMysql.RemoteAddr().String()
+	sp.Target = sess.TargetAddr
+	sp.State = "failover"
+	sp.Cmd = target
+	sp.Err = strings.Join(failures, "; ")
+	if err := p.AuditLogWriter.PushToLogChannel(ctx, sp); err != nil {
+		p.AuditLogWriter.PutSendPacket(sp)
+	}
+}
+
+// refuse tells a client that cannot be proxied why. The client was told it
+// is logged in before the proxy connected to the target, so err answers its
+// first command.
+func refuse(conn *server.Conn, err error, timeout time.Duration) {
+	var myErr *mysql.MyError
+	if !errors.As(err, &myErr) {
+		myErr = mysql.NewError(mysql.ER_UNKNOWN_ERROR, err.Error())
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	data, rerr := conn.ReadPacket()
+	if rerr != nil || len(data) == 0 || data[0] == mysql.COM_QUIT {
+		return
+	}
+	if werr := conn.WriteValue(myErr); werr != nil {
+		log.Printf("refuse client:%s err:%v", conn.RemoteAddr(), werr)
+	}
+}
+
+// healthCheck probes the backends of the routing table until ctx is done.
+func (p *ProxySrv) healthCheck(ctx context.Context) {
+	ticker := time.NewTicker(p.Config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.probeBackends(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeBackends logs in to each backend of the routing table, see
+// probeBackend. An error before the login, or one telling that the backend
+// does not take sessions, e.g. too many connections, is a failure.
+func (p *ProxySrv) probeBackends(ctx context.Context) {
+	table, _ := p.Routes.Table()
+	if table == nil {
+		return
+	}
+	wg := sync.WaitGroup{}
+	for _, addr := range table.Addresses() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := probeBackend(ctx, addr, p.Config.HealthCheckUser, p.Config.HealthCheckTimeout)
+			var myErr *mysql.MyError
+			if errors.As(err, &myErr) && !backendDown(myErr) {
+				// answered, e.g. access denied to a user that is not created
+				err = nil
+			}
+			if err != nil {
+				if ctx.Err() == nil && p.health.Failure(addr, time.Now()) {
+					log.Printf("backend:%s down, circuit open: %v", addr, err)
+				}
+				return
+			}
+			if p.health.Success(addr) {
+				log.Printf("backend:%s up", addr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// probeBackend logs in to addr as user, without a password, and quits, as
+// HAProxy's mysql-check does. A client that hangs up after the handshake
+// counts as a connection error of its host, and MySQL blocks the host
+// after max_connect_errors of them. It returns the handshake of addr; an
+// error of the login is a *mysql.MyError.
+func probeBackend(ctx context.Context, addr, user string, timeout time.Duration) (protocol.Handshake, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", route.AddPort(addr))
+	if err != nil {
+		return protocol.Handshake{}, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return protocol.Handshake{}, err
+	}
+	seq, payload, err := readPacket(conn)
+	if err != nil {
+		return protocol.Handshake{}, fmt.Errorf("read handshake: %w", err)
+	}
+	h, err := protocol.ParseHandshake(payload)
+	if err != nil {
+		return h, err
+	}
+	if err := writePacket(conn, seq+1, protocol.HandshakeResponse(h, user)); err != nil {
+		return h, err
+	}
+	for {
+		if seq, payload, err = readPacket(conn); err != nil {
+			return h, fmt.Errorf("login: %w", err)
+		}
+		switch {
+		case len(payload) == 0:
+			return h, errors.New("login: empty packet")
+		case payload[0] == mysql.OK_HEADER:
+			// COM_QUIT, to which the server does not answer
+			return h, writePacket(conn, 0, []byte{mysql.COM_QUIT})
+		case payload[0] == mysql.ERR_HEADER:
+			return h, loginError(payload)
+		case payload[0] == mysql.EOF_HEADER:
+			// switch to another auth plugin, whose response to no password is empty too
+			if err := writePacket(conn, seq+1, nil); err != nil {
+				return h, err
+			}
+		case payload[0] == 0x01 && len(payload) > 1 && payload[1] == 0x03:
+			// caching_sha2_password fast auth, OK follows
+		default:
+			return h, fmt.Errorf("login: unexpected packet 0x%02x, the user must have no password", payload[0])
+		}
+	}
+}
+
+// loginError returns the error of an ERR packet.
+func loginError(payload []byte) error {
+	if len(payload) < 3 {
+		return errors.New("login: short error packet")
+	}
+	msg := payload[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		msg = msg[6:] // sql state
+	}
+	return mysql.NewError(binary.LittleEndian.Uint16(payload[1:]), string(msg))
+}
+
+func readPacket(r io.Reader) (seq byte, payload []byte, err error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, int(uint32(header[0])|uint32(header[1])<<8|uint32(header[2])<<16))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+func writePacket(w io.Writer, seq byte, payload []byte) error {
+	pkt := append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}, payload...)
+	_, err := w.Write(pkt)
+	return err
+}
@@ -0,0 +1,122 @@
+package mysqlproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// greeting is the initial handshake of a MySQL 8.0 server.
+func greeting() []byte {
+	h := append([]byte{10}, "8.0.36\x00"...)
+	h = append(h, 0x2a, 0x00, 0x00, 0x00)
+	h = append(h, "abcdefgh\x00"...)
+	h = append(h, 0xff, 0xff, 0xff, 0x02, 0x00, 0xff, 0xdf, 0x15)
+	h = append(h, make([]byte, 10)...)
+	return append(h, "ijklmnopqrst\x00caching_sha2_password\x00"...)
+}
+
+func TestProbeBackend(t *testing.T) {
+	testcase := []struct {
+		name    string
+		replies [][]byte // to the handshake response, then to each packet of the client
+		packets int      // sent by the client after the handshake response
+		quit    bool
+		err     uint16
+	}{
+		{
+			name:    "ok",
+			replies: [][]byte{{mysql.OK_HEADER, 0, 0, 2, 0, 0, 0}},
+			quit:    true,
+		},
+		{
+			name:    "fast auth",
+			replies: [][]byte{{0x01, 0x03}, {mysql.OK_HEADER, 0, 0, 2, 0, 0, 0}},
+			quit:    true,
+		},
+		{
+			name:    "auth switch",
+			replies: [][]byte{append([]byte{mysql.EOF_HEADER}, "mysql_native_password\x00abcdefghijklmnopqrst\x00"...), {mysql.OK_HEADER, 0, 0, 2, 0, 0, 0}},
+			packets: 1,
+			quit:    true,
+		},
+		{
+			name:    "access denied",
+			replies: [][]byte{append([]byte{mysql.ERR_HEADER, 0x15, 0x04}, "#28000Access denied for user 'mysql8-audit-proxy'"...)},
+			err:     mysql.ER_ACCESS_DENIED_ERROR,
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			type server struct {
+				response []byte // handshake response
+				quit     bool
+				err      error
+			}
+			done := make(chan server, 1)
+			go func() {
+				s := server{}
+				defer func() { done <- s }()
+				conn, err := ln.Accept()
+				if err != nil {
+					s.err = err
+					return
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if s.err = writePacket(conn, 0, greeting()); s.err != nil {
+					return
+				}
+				var seq byte
+				if seq, s.response, s.err = readPacket(conn); s.err != nil {
+					return
+				}
+				for i, reply := range tc.replies {
+					seq++
+					if s.err = writePacket(conn, seq, reply); s.err != nil {
+						return
+					}
+					if i < tc.packets {
+						if seq, _, s.err = readPacket(conn); s.err != nil {
+							return
+						}
+					}
+				}
+				seq, payload, err := readPacket(conn)
+				s.quit = err == nil && seq == 0 && bytes.Equal(payload, []byte{mysql.COM_QUIT})
+			}()
+			h, err := probeBackend(context.Background(), ln.Addr().String(), "mysql8-audit-proxy", 5*time.Second)
+			var myErr *mysql.MyError
+			switch {
+			case tc.err == 0 && err != nil:
+				t.Fatal(err)
+			case tc.err != 0 && (!errors.As(err, &myErr) || myErr.Code != tc.err):
+				t.Fatalf("err:%v want code %d", err, tc.err)
+			}
+			if h.Version != "8.0.36" {
+				t.Errorf("version %q", h.Version)
+			}
+			s := <-done
+			if s.err != nil {
+				t.Fatal(s.err)
+			}
+			// capabilities, max packet size, collation, filler, then the user
+			if len(s.response) < 32 || !bytes.HasPrefix(s.response[32:], []byte("mysql8-audit-proxy\x00")) {
+				t.Errorf("handshake response %q", s.response)
+			}
+			if s.quit != tc.quit {
+				t.Errorf("COM_QUIT received:%v want:%v", s.quit, tc.quit)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"compress/gzip"
 	"context"
+	"crypto/rsa"
 	"fmt"
 	"io"
 	"os"
@@ -10,37 +11,66 @@ import (
 	"sync"
 	"time"
 
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
 	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
 )
 
 const (
-	maxPacketSize = 0xffffff + 4
+	maxPacketSize = 0xffffff + 4 // larger buffers are not kept for reuse
 )
 
 type auditLogWriter struct {
 	filePath   string
 	rotateTime time.Duration
-	encode     func(w io.Writer, bbp *sendpacket.SendPacket) error
+	encode     encodeFunc
+	format     string
+	header     string
 
 	dataPool    sync.Pool
+	bufs        bufPool
+	budget      *memBudget
 	dataChannel chan *sendpacket.SendPacket
 	file        *os.File
+	fileStart   int64     // size of the file when it was opened
+	fileTime    time.Time // period of the file
+	encryptKey  *rsa.PublicKey
+	encWriter   *encryptWriter // nil unless encrypted
 	gzipWriter  *gzip.Writer
 	ticker      *time.Ticker
+	flushTicker *time.Ticker
+	flushC      <-chan time.Time // nil unless periodic flush is enabled
+	dirty       bool             // written since the last flush
 	latestFile  string
+	closeHooks  []func(filePath string)
+	subscribers []Subscriber
 }
 
-func NewAuditLogWriter(queue chan *sendpacket.SendPacket, filePath string, rotateTime time.Duration, t time.Time) (*auditLogWriter, error) {
+// Subscriber receives every record written to the audit log, e.g. a
+// streaming sink. Publish is called on the writer goroutine: it must not
+// block and must not keep sp after it returns.
+type Subscriber interface {
+	Publish(sp *sendpacket.SendPacket)
+}
+
+func NewAuditLogWriter(queue chan *sendpacket.SendPacket, filePath, format string, rotateTime time.Duration, t time.Time) (*auditLogWriter, error) {
+	encode, header, err := encoderFor(format)
+	if err != nil {
+		return nil, err
+	}
 	// Initialize auditLogWriter
+	if format == "" {
+		format = FormatBinary
+	}
 	handler := &auditLogWriter{
-		encode: sendpacket.EncodePacket,
+		encode: encode,
+		format: format,
+		header: header,
 		dataPool: sync.Pool{
 			New: func() interface{} {
-				sp := &sendpacket.SendPacket{}
-				sp.Packets = make([]byte, maxPacketSize)
-				return sp
+				return &sendpacket.SendPacket{}
 			},
 		},
+		budget:      newMemBudget(0),
 		rotateTime:  rotateTime,
 		filePath:    filePath,
 		dataChannel: queue,
@@ -55,33 +85,139 @@ func NewAuditLogWriter(queue chan *sendpacket.SendPacket, filePath string, rotat
 }
 
 func (d *auditLogWriter) createFile(t time.Time) error {
-	d.latestFile = time2Path(d.filePath, t)
+	d.fileTime = t
+	// the last file of the period takes the records if it can, unless the
+	// close hooks may have been given it before a restart
+	n := 0
+	for ; ; n++ {
+		_, err := os.Stat(d.path(t, n))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if path := d.path(t, n-1); n > 0 && len(d.closeHooks) == 0 && d.appendable(path) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		d.file, d.latestFile, d.fileStart = f, path, st.Size()
+		return d.openWriters()
+	}
+	d.latestFile = d.path(t, n)
 	var err error
-	//d.file, err = os.OpenFile(d.latestFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	d.file, err = os.OpenFile(d.latestFile, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		d.gzipWriter = gzip.NewWriter(d.file)
-		d.gzipWriter.Write([]byte(fmtVersion)) // version
-		return nil
+	if err != nil {
+		return err
+	}
+	d.fileStart = 0
+	return d.openWriters()
+}
+
+// path returns the name of the n-th file of the period of t.
+func (d *auditLogWriter) path(t time.Time, n int) string {
+	if n == 0 {
+		return time2Path(d.filePath, t)
 	}
-	if err != nil && os.IsExist(err) {
-		d.file, err = os.OpenFile(d.latestFile, os.O_WRONLY|os.O_APPEND, 0644)
+	return suffixPath(d.filePath, t, n)
+}
+
+// appendable reports whether the records to come can be appended to the
+// existing file path: a file has a single format, and is encrypted for a
+// single key or not at all. The proxy cannot read the format of an
+// encrypted file without the private key, so it does not append to one.
+func (d *auditLogWriter) appendable(path string) bool {
+	st, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return false
+	case st.Size() == 0:
+		// nothing written yet
+		return true
+	case d.encryptKey != nil:
+		return false
+	}
+	fr, err := NewFileReader(path)
+	if err != nil {
+		// encrypted, among others
+		return false
+	}
+	defer fr.Close()
+	return fr.format == d.format && fr.header == d.header
+}
+
+// openWriters starts the gzip stream, and the encrypted container around
+// it, at the end of the file. A new file gets the header of the format.
+func (d *auditLogWriter) openWriters() error {
+	var w io.Writer = d.file
+	d.encWriter = nil
+	if d.encryptKey != nil {
+		enc, err := newEncryptWriter(d.file, d.encryptKey)
 		if err != nil {
 			return err
 		}
-		d.gzipWriter = gzip.NewWriter(d.file)
+		d.encWriter, w = enc, enc
 	}
-	return err
+	d.gzipWriter = gzip.NewWriter(w)
+	if d.fileStart == 0 {
+		d.gzipWriter.Write([]byte(d.header)) // version
+	}
+	return nil
+}
+
+// SetEncryptKey encrypts the log files for the holder of the private key
+// of pub, so that the proxy cannot read them back. It must be called
+// before the first record is written: the current file is started again,
+// or another one if it was there before and is not encrypted for pub.
+func (d *auditLogWriter) SetEncryptKey(pub *rsa.PublicKey) error {
+	d.encryptKey = pub
+	return d.restart()
 }
+
+// restart opens the file of the period again, before the first record is
+// written, for settings that change which file takes the records.
+func (d *auditLogWriter) restart() error {
+	// drop what the writers wrote so far, at most the headers
+	if err := d.file.Truncate(d.fileStart); err != nil {
+		return err
+	}
+	d.gzipWriter, d.encWriter = nil, nil
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	d.file = nil
+	if d.fileStart == 0 {
+		if err := os.Remove(d.latestFile); err != nil {
+			return err
+		}
+	}
+	return d.createFile(d.fileTime)
+}
+
 func dumpByte(b []byte) string {
 	return fmt.Sprintf("size:%d, %v", len(b), b)
 }
 func (d *auditLogWriter) writeDataToFile(data *sendpacket.SendPacket) error {
 	//log.Println(dumpByte(data.Packets))
-	if err := d.encode(d.gzipWriter, data); err != nil {
-		return err
+	err := d.encode(d.gzipWriter, data)
+	d.dirty = true
+	for _, s := range d.subscribers {
+		s.Publish(data)
 	}
-	return nil
+	return err
+}
+
+// Subscribe adds s to the subscribers of the record stream.
+// The log file stays the system of record; subscribers only get a copy.
+func (d *auditLogWriter) Subscribe(s Subscriber) {
+	d.subscribers = append(d.subscribers, s)
 }
 
 func (d *auditLogWriter) CloseChannel() {
@@ -94,15 +230,101 @@ func (d *auditLogWriter) closeFile() error {
 			return err
 		}
 		d.gzipWriter = nil
+		if d.encWriter != nil {
+			if err := d.encWriter.Close(); err != nil {
+				return err
+			}
+			d.encWriter = nil
+		}
+		d.dirty = false
 	}
 	if d.file != nil {
 		err := d.file.Close()
 		d.file = nil
+		if err != nil {
+			return err
+		}
+		for _, f := range d.closeHooks {
+			f(d.latestFile)
+		}
+	}
+	return nil
+}
+
+// SetAnalyze makes the JSON formats carry the digest, class and tables of
+// each query, which costs a parse per query on the writer goroutine.
+// Readers fill them in otherwise, as they do for the binary format.
+func (d *auditLogWriter) SetAnalyze(analyze bool) {
+	switch {
+	case d.format == FormatNDJSON && analyze:
+		d.encode = decoder.EncodeAnalyzedJSON
+	case d.format == FormatNDJSON:
+		d.encode = decoder.EncodeJSON
+	case d.format == FormatOCSF && analyze:
+		d.encode = decoder.EncodeAnalyzedOCSF
+	case d.format == FormatOCSF:
+		d.encode = decoder.EncodeOCSF
+	}
+}
+
+// SetFlushInterval makes the writer flush the gzip stream to the file at
+// every interval if records were written since the last flush, so that the
+// current file can be read while it grows. Zero disables it.
+func (d *auditLogWriter) SetFlushInterval(interval time.Duration) {
+	if d.flushTicker != nil {
+		d.flushTicker.Stop()
+		d.flushTicker, d.flushC = nil, nil
+	}
+	if interval > 0 {
+		d.flushTicker = time.NewTicker(interval)
+		d.flushC = d.flushTicker.C
+	}
+}
+
+func (d *auditLogWriter) flush() error {
+	if !d.dirty || d.gzipWriter == nil {
+		return nil
+	}
+	d.dirty = false
+	if err := d.gzipWriter.Flush(); err != nil {
 		return err
 	}
+	if d.encWriter != nil {
+		return d.encWriter.Flush()
+	}
 	return nil
 }
 
+// OnClose registers f to be called with the path of each log file after it
+// has been closed, either by rotation or at shutdown. Hooks run on the
+// writer goroutine, so they must not block. Like SetEncryptKey, it must be
+// called before the first record is written: records are not appended to a
+// file of an earlier run, which the hooks have had already, but go to the
+// next file of the period.
+func (d *auditLogWriter) OnClose(f func(filePath string)) error {
+	d.closeHooks = append(d.closeHooks, f)
+	if d.fileStart == 0 {
+		return nil
+	}
+	return d.restart()
+}
+
+// ClosedFiles returns the log files of earlier runs, in time order: all but
+// the current one. The proxy may have stopped before the close hooks ran.
+func (d *auditLogWriter) ClosedFiles() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(d.filePath))
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		if p := filepath.Join(filepath.Dir(d.filePath), e.Name()); !e.IsDir() && p != d.latestFile {
+			files = append(files, p)
+		}
+	}
+	return SelectFiles(files, d.filePath, time.Time{}, time.Time{}), nil
+}
+
 func (d *auditLogWriter) receiveAndWrite(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
@@ -116,11 +338,17 @@ func (d *auditLogWriter) receiveAndWrite(ctx context.Context) error {
 			return io.EOF
 		}
 		err := d.writeDataToFile(data)
+		d.budget.release(int64(cap(data.Packets)))
 		d.PutSendPacket(data)
 		if err != nil {
 			return err
 		}
 
+	case <-d.flushC:
+		if err := d.flush(); err != nil {
+			return err
+		}
+
 	case t := <-d.ticker.C:
 		if err := d.closeFile(); err != nil {
 			return err
@@ -154,9 +382,21 @@ func (d *auditLogWriter) LogWriteWorker(ctx context.Context) error {
 
 func (d *auditLogWriter) GetLatestFilename() string { return d.latestFile }
 
+// SetMemoryBudget limits the bytes of packets of the records waiting to be
+// written. PushToLogChannel blocks while the budget is used up, which slows
+// down the sessions instead of growing the memory. 0 is unlimited.
+func (d *auditLogWriter) SetMemoryBudget(bytes int64) {
+	d.budget.setLimit(bytes)
+}
+
 func (d *auditLogWriter) PushToLogChannel(ctx context.Context, sp *sendpacket.SendPacket) error {
+	size := int64(cap(sp.Packets))
+	if err := d.budget.acquire(ctx, size); err != nil {
+		return err
+	}
 	select {
 	case <-ctx.Done():
+		d.budget.release(size)
 		return ctx.Err()
 	case d.dataChannel <- sp:
 		//log.Printf("send channel size:%d", len(d.dataChannel))
@@ -164,10 +404,20 @@ func (d *auditLogWriter) PushToLogChannel(ctx context.Context, sp *sendpacket.Se
 	return nil
 }
 func (d *auditLogWriter) PutSendPacket(b *sendpacket.SendPacket) {
+	d.bufs.put(b.Packets)
+	b.Packets = nil
 	d.dataPool.Put(b)
 }
 func (d *auditLogWriter) GetSendPacket() *sendpacket.SendPacket {
-	return d.dataPool.Get().(*sendpacket.SendPacket)
+	sp := d.dataPool.Get().(*sendpacket.SendPacket)
+	sp.Packets = d.bufs.get(packetClasses[0])
+	return sp
+}
+
+// GrowPackets returns b with a length of size, moved to a larger pooled
+// buffer if needed.
+func (d *auditLogWriter) GrowPackets(b []byte, size int) []byte {
+	return d.bufs.grow(b, size)
 }
 
 func Mkdir(filePath string) error {
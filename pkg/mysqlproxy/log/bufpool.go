@@ -0,0 +1,106 @@
+package log
+
+import (
+	"context"
+	"sync"
+)
+
+// packetClasses are the sizes of the pooled packet buffers. Most commands
+// fit in the smallest one; the largest holds a whole packet with its header.
+var packetClasses = [...]int{512, 2 << 10, 8 << 10, 32 << 10, 128 << 10, 512 << 10, 2 << 20, 8 << 20, maxPacketSize}
+
+// bufPool keeps packet buffers by size class, so that a large packet does
+// not make every pooled buffer large.
+type bufPool struct {
+	classes [len(packetClasses)]sync.Pool
+}
+
+// get returns an empty buffer with a capacity of at least size.
+func (p *bufPool) get(size int) []byte {
+	for i, class := range packetClasses {
+		if size <= class {
+			if b, ok := p.classes[i].Get().(*[]byte); ok {
+				return (*b)[:0]
+			}
+			return make([]byte, 0, class)
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+// put keeps b for reuse in the largest class it can serve.
+func (p *bufPool) put(b []byte) {
+	if cap(b) > maxPacketSize {
+		return
+	}
+	for i := len(packetClasses) - 1; i >= 0; i-- {
+		if cap(b) >= packetClasses[i] {
+			p.classes[i].Put(&b)
+			return
+		}
+	}
+}
+
+// grow returns b with a length of size. When b is too small its content is
+// copied to a pooled buffer and b is pooled.
+func (p *bufPool) grow(b []byte, size int) []byte {
+	if cap(b) >= size {
+		return b[:size]
+	}
+	if size > maxPacketSize {
+		// a command of several packets, let append amortize the copies
+		return append(b, make([]byte, size-len(b))...)
+	}
+	nb := p.get(size)[:size]
+	copy(nb, b)
+	p.put(b)
+	return nb
+}
+
+// memBudget limits the bytes of packet buffers of the records waiting to
+// be written. A record is let through when nothing else waits, so that a
+// record larger than the budget does not block forever.
+type memBudget struct {
+	mu    sync.Mutex
+	limit int64 // 0 is unlimited
+	used  int64
+	freed chan struct{} // closed when memory is released
+}
+
+func newMemBudget(limit int64) *memBudget {
+	return &memBudget{limit: limit, freed: make(chan struct{})}
+}
+
+func (b *memBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.limit <= 0 || b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+func (b *memBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+func (b *memBudget) setLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
@@ -0,0 +1,300 @@
+package log
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// An encrypted log file is the gzip stream of a plain log file sealed in
+// chunks:
+//
+//	magic "MYAPENC1"
+//	key id      8 bytes, sha256 of the recipient public key (PKIX DER)
+//	key length  uint16, big endian
+//	wrapped key RSA-OAEP-SHA256 of the AES-256 data key
+//	nonce       12 bytes
+//	chunks      uint32 length, big endian, with the top bit set on the
+//	            last chunk, then AES-GCM of up to 64KiB of the stream
+//
+// Each file has its own data key. The nonce of a chunk is the nonce of the
+// header with its chunk number xored into the last 8 bytes, and the length
+// is the additional data, so chunks cannot be reordered and a file cut at a
+// chunk boundary is detected. A reader takes several containers in a row,
+// though the proxy writes one per file: it does not hold the private key,
+// so it cannot read back the format of an encrypted file to append to it.
+const (
+	encryptMagic     = "MYAPENC1"
+	encryptChunkSize = 64 * 1024
+	encryptLastChunk = 1 << 31
+	keyIDSize        = 8
+)
+
+// LoadPublicKey reads an RSA public key in PEM, "PUBLIC KEY" (PKIX) or
+// "RSA PUBLIC KEY" (PKCS #1).
+func LoadPublicKey(filename string) (*rsa.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", filename)
+	}
+	return pub, nil
+}
+
+// LoadPrivateKey reads an RSA private key in PEM, "PRIVATE KEY" (PKCS #8)
+// or "RSA PRIVATE KEY" (PKCS #1).
+func LoadPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA private key", filename)
+	}
+	return priv, nil
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", filename)
+	}
+	return block, nil
+}
+
+func keyID(pub *rsa.PublicKey) []byte {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return sum[:keyIDSize]
+}
+
+func chunkNonce(nonce []byte, n uint64) []byte {
+	res := bytes.Clone(nonce)
+	for i := 0; i < 8; i++ {
+		res[len(res)-1-i] ^= byte(n >> (8 * i))
+	}
+	return res
+}
+
+// encryptWriter seals what is written to it in chunks.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	out     []byte
+}
+
+// newEncryptWriter writes the header of a container with a new data key to w.
+func newEncryptWriter(w io.Writer, pub *rsa.PublicKey) (*encryptWriter, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptWriter{w: w, aead: aead, nonce: make([]byte, aead.NonceSize()), buf: make([]byte, 0, encryptChunkSize)}
+	if _, err := rand.Read(e.nonce); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptMagic), keyID(pub)...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, e.nonce...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		size := min(encryptChunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:size]...)
+		p = p[size:]
+		if len(e.buf) == encryptChunkSize {
+			if err := e.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush seals the buffered data, if any, so that it can be read.
+func (e *encryptWriter) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	return e.seal(false)
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	length := uint32(len(e.buf) + e.aead.Overhead())
+	if last {
+		length |= encryptLastChunk
+	}
+	e.out = binary.BigEndian.AppendUint32(e.out[:0], length)
+	e.out = e.aead.Seal(e.out, chunkNonce(e.nonce, e.counter), e.buf, e.out[:4])
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// decryptReader reads the plain stream of one or more containers.
+type decryptReader struct {
+	r       io.Reader
+	key     *rsa.PrivateKey
+	aead    cipher.AEAD // nil between containers
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	chunk   []byte
+}
+
+func newDecryptReader(r io.Reader, key *rsa.PrivateKey) *decryptReader {
+	return &decryptReader{r: r, key: key}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next opens the next chunk. It returns io.EOF only after the last chunk
+// of a container.
+func (d *decryptReader) next() error {
+	if d.aead == nil {
+		return d.readHeader()
+	}
+	var h [4]byte
+	if _, err := io.ReadFull(d.r, h[:]); err != nil {
+		return truncated(err)
+	}
+	length := binary.BigEndian.Uint32(h[:])
+	last := length&encryptLastChunk != 0
+	length &^= encryptLastChunk
+	if length > uint32(encryptChunkSize+d.aead.Overhead()) {
+		return fmt.Errorf("encrypted chunk too large: %d", length)
+	}
+	if cap(d.chunk) < int(length) {
+		d.chunk = make([]byte, length)
+	}
+	d.chunk = d.chunk[:length]
+	if _, err := io.ReadFull(d.r, d.chunk); err != nil {
+		return truncated(err)
+	}
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.nonce, d.counter), d.chunk, h[:])
+	if err != nil {
+		return fmt.Errorf("encrypted chunk %d: %w", d.counter, err)
+	}
+	d.counter++
+	d.buf = plain
+	if last {
+		d.aead = nil
+	}
+	return nil
+}
+
+func (d *decryptReader) readHeader() error {
+	h := make([]byte, len(encryptMagic)+keyIDSize+2)
+	if _, err := io.ReadFull(d.r, h); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return truncated(err)
+	}
+	if string(h[:len(encryptMagic)]) != encryptMagic {
+		return errors.New("not an encrypted log file")
+	}
+	id := h[len(encryptMagic) : len(encryptMagic)+keyIDSize]
+	if want := keyID(&d.key.PublicKey); !bytes.Equal(id, want) {
+		return fmt.Errorf("log file is encrypted for key %x, not %x", id, want)
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(h[len(h)-2:]))
+	if _, err := io.ReadFull(d.r, wrapped); err != nil {
+		return truncated(err)
+	}
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), nil, d.key, wrapped, nil)
+	if err != nil {
+		return fmt.Errorf("unwrap data key: %w", err)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return err
+	}
+	if d.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	d.nonce = make([]byte, d.aead.NonceSize())
+	if _, err := io.ReadFull(d.r, d.nonce); err != nil {
+		d.aead = nil
+		return truncated(err)
+	}
+	d.counter = 0
+	return nil
+}
+
+// truncated turns the end of the file inside a container into an error.
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
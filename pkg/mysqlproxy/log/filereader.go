@@ -1,50 +1,219 @@
 package log
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
 	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
 )
 
 type FileReader struct {
 	f       *os.File
 	gr      *gzip.Reader
+	br      *bufio.Reader
+	format  string
+	header  string // of a binary file
 	decoder *sendpacket.Decoder
+	sp      sendpacket.SendPacket
 	Decode  func(bbp *sendpacket.SendPacket) error
 }
 
-func NewFileReader(filename string) (*FileReader, error) {
-	fr := &FileReader{}
-	var err error
+// ReaderOption configures how a FileReader reads a log file.
+type ReaderOption func(*readerConfig)
+
+type readerConfig struct {
+	key *rsa.PrivateKey
+}
+
+// WithPrivateKey decrypts encrypted log files with key.
+func WithPrivateKey(key *rsa.PrivateKey) ReaderOption {
+	return func(c *readerConfig) { c.key = key }
+}
+
+func NewFileReader(filename string, opts ...ReaderOption) (*FileReader, error) {
 	// Open the generated file
-	fr.f, err = os.Open(filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	return newFileReader(f, f, opts)
+}
+
+// NewTailReader opens a log file that is still being written. At the end
+// of the file it waits for the writer to append more, polling every
+// interval, instead of returning io.EOF. Reads end once rotated reports
+// that the writer has moved on to the next file.
+func NewTailReader(filename string, interval time.Duration, rotated func() bool, opts ...ReaderOption) (*FileReader, error) {
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
+	return newFileReader(f, &tailReader{f: f, interval: interval, rotated: rotated}, opts)
+}
+
+type tailReader struct {
+	f        *os.File
+	interval time.Duration
+	rotated  func() bool
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if t.rotated() {
+			// the writer closes a file before it creates the next one,
+			// so this read sees the rest of the file
+			return t.f.Read(p)
+		}
+		time.Sleep(t.interval)
+	}
+}
+
+func newFileReader(f *os.File, r io.Reader, opts []ReaderOption) (*FileReader, error) {
+	fr := &FileReader{f: f}
+	c := readerConfig{}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	var err error
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(encryptMagic)); string(magic) == encryptMagic {
+		if c.key == nil {
+			f.Close()
+			return nil, errors.New("log file is encrypted, a private key is required")
+		}
+		r = newDecryptReader(br, c.key)
+	} else {
+		r = br
+	}
 	// Create a gzip reader
-	fr.gr, err = gzip.NewReader(fr.f)
+	fr.gr, err = gzip.NewReader(r)
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
 	}
-	version, err := checkFormat(fr.gr)
-	//version, err := checkVersion(fr.f)
+	fr.br = bufio.NewReaderSize(fr.gr, 64*1024)
+	fr.format, err = detectFormat(fr.br)
 	if err != nil {
+		fr.Close()
 		return nil, err
 	}
-	switch version {
-	case fmtVersion:
-		break
+	switch fr.format {
+	case FormatBinary:
+		version, err := checkFormat(fr.br)
+		if err != nil {
+			fr.Close()
+			return nil, err
+		}
+		layout, ok := fmtVersions[version]
+		if !ok {
+			fr.Close()
+			return nil, fmt.Errorf("version not match:%s", version)
+		}
+		fr.header = version
+		fr.decoder = sendpacket.NewDecoder(fr.br)
+		fr.decoder.SetVersion(layout)
+		fr.Decode = fr.decoder.DecodePacket
 	default:
-		return nil, fmt.Errorf("version not match:%s", version)
+		fr.Decode = func(bbp *sendpacket.SendPacket) error {
+			return fmt.Errorf("%s log has no binary packets, use ReadRecord", fr.format)
+		}
 	}
-
-	fr.decoder = sendpacket.NewDecoder(fr.gr)
-	fr.Decode = fr.decoder.DecodePacket
 	return fr, nil
 }
 
+// detectFormat tells the format from the beginning of the file.
+// JSON formats have no header; OCSF events carry a class_uid.
+func detectFormat(br *bufio.Reader) (string, error) {
+	head, err := br.Peek(len(fmtVersion))
+	if _, ok := fmtVersions[string(head)]; err == nil && ok {
+		return FormatBinary, nil
+	}
+	if len(head) == 0 {
+		// an empty file has no records of any format
+		return FormatNDJSON, nil
+	}
+	if head[0] != '{' {
+		return FormatBinary, nil
+	}
+	// look at the whole first line, which may arrive in pieces while tailing
+	line, _ := br.Peek(br.Buffered())
+	for bytes.IndexByte(line, '\n') < 0 && len(line) < br.Size() {
+		if line, err = br.Peek(len(line) + 1); err != nil {
+			break
+		}
+		line, _ = br.Peek(br.Buffered())
+	}
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if bytes.Contains(line, []byte(`"class_uid"`)) {
+		return FormatOCSF, nil
+	}
+	return FormatNDJSON, nil
+}
+
+// Format reports the format of the file: FormatBinary, FormatNDJSON or FormatOCSF.
+func (fr *FileReader) Format() string { return fr.format }
+
+// ReadRecord reads the next record of a file in any format.
+// The record does not share memory with the reader.
+func (fr *FileReader) ReadRecord(rec *decoder.Record) error {
+	switch fr.format {
+	case FormatBinary:
+		if err := fr.decoder.DecodePacket(&fr.sp); err != nil {
+			return err
+		}
+		*rec = decoder.Decode(fr.sp)
+		rec.Packets = bytes.Clone(rec.Packets)
+		rec.Analyze()
+		return nil
+	case FormatOCSF:
+		line, err := fr.readLine()
+		if err != nil {
+			return err
+		}
+		o := decoder.OCSF{}
+		if err := json.Unmarshal(line, &o); err != nil {
+			return err
+		}
+		*rec = o.Record()
+		rec.Analyze()
+		return nil
+	}
+	line, err := fr.readLine()
+	if err != nil {
+		return err
+	}
+	*rec = decoder.Record{}
+	if err := json.Unmarshal(line, rec); err != nil {
+		return err
+	}
+	rec.Analyze()
+	return nil
+}
+
+func (fr *FileReader) readLine() ([]byte, error) {
+	line, err := fr.br.ReadBytes('\n')
+	if len(line) > 0 && err != nil {
+		// the last line of a file that is still being written
+		return nil, fmt.Errorf("incomplete line: %w", err)
+	}
+	return line, err
+}
+
 func (fr *FileReader) Close() {
 	fr.gr.Close()
 	fr.f.Close()
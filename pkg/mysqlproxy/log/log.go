@@ -3,14 +3,56 @@ package log
 import (
 	"fmt"
 	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+const (
+	fmtVersion = `{"format":"mysqlproxy-v1.08"}\n`
 )
 
+// fmtVersions maps the file headers this package can read to the layouts of sendpacket.
+var fmtVersions = map[string]int{
+	`{"format":"mysqlproxy-v1.00"}\n`: sendpacket.Version100,
+	`{"format":"mysqlproxy-v1.01"}\n`: sendpacket.Version101,
+	`{"format":"mysqlproxy-v1.02"}\n`: sendpacket.Version102,
+	`{"format":"mysqlproxy-v1.03"}\n`: sendpacket.Version103,
+	`{"format":"mysqlproxy-v1.04"}\n`: sendpacket.Version104,
+	`{"format":"mysqlproxy-v1.05"}\n`: sendpacket.Version105,
+	`{"format":"mysqlproxy-v1.06"}\n`: sendpacket.Version106,
+	`{"format":"mysqlproxy-v1.07"}\n`: sendpacket.Version107,
+	fmtVersion:                        sendpacket.Version108,
+}
+
+// On-disk formats of the audit log. All of them are gzip compressed.
 const (
-	fmtVersion = `{"format":"mysqlproxy-v1.00"}\n`
+	FormatBinary = "binary" // sendpacket binary v1, read by mysql8-audit-log-decoder
+	FormatNDJSON = "ndjson" // one decoder.Record JSON per line
+	FormatOCSF   = "ocsf"   // one OCSF Datastore Activity JSON per line
 )
 
+type encodeFunc func(w io.Writer, bbp *sendpacket.SendPacket) error
+
+// encoderFor returns the encoder of format and the header written at the top of a new file.
+func encoderFor(format string) (encodeFunc, string, error) {
+	switch format {
+	case FormatBinary, "":
+		return sendpacket.EncodePacket, fmtVersion, nil
+	case FormatNDJSON:
+		return decoder.EncodeJSON, "", nil
+	case FormatOCSF:
+		return decoder.EncodeOCSF, "", nil
+	}
+	return nil, "", fmt.Errorf("unknown log format:%q", format)
+}
+
 func checkFormat(r io.Reader) (string, error) {
 	size := len(fmtVersion)
 	b := make([]byte, size)
@@ -35,3 +77,137 @@ func time2Path(p string, t time.Time) string {
 	p = strings.Replace(p, "%S", fmt.Sprintf("%02d", t.Second()), -1)
 	return p
 }
+
+// suffixPath returns the name of the n-th extra file of the period of t,
+// started when the existing one cannot take the records: "-n" follows the
+// time in the name, e.g. mysql-audit.2024010101-1.log.gz.
+func suffixPath(p string, t time.Time, n int) string {
+	i := afterVerbs(p)
+	return time2Path(p[:i]+"-"+strconv.Itoa(n)+p[i:], t)
+}
+
+// afterVerbs returns the index after the last time verb of pattern, or the
+// end of pattern if it has none.
+func afterVerbs(pattern string) int {
+	end := len(pattern)
+	for i := 0; i+1 < len(pattern); i++ {
+		if _, ok := timeVerbs[pattern[i+1]]; ok && pattern[i] == '%' {
+			i++
+			end = i + 1
+		}
+	}
+	return end
+}
+
+// timeVerbs are the verbs of time2Path, with the number of digits and the
+// period covered by one step of the verb.
+var timeVerbs = map[byte]struct {
+	digits int
+	period func(t time.Time) time.Time
+}{
+	'Y': {4, func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	'y': {2, func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	'm': {2, func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	'd': {2, func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	'H': {2, func(t time.Time) time.Time { return t.Add(time.Hour) }},
+	'M': {2, func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	'S': {2, func(t time.Time) time.Time { return t.Add(time.Second) }},
+}
+
+// timePattern parses the time of file names generated by time2Path.
+type timePattern struct {
+	re    *regexp.Regexp
+	verbs []byte
+	next  func(t time.Time) time.Time // end of the period of the finest verb
+}
+
+func newTimePattern(pattern string) timePattern {
+	tp := timePattern{next: func(t time.Time) time.Time { return t }}
+	expr := &strings.Builder{}
+	expr.WriteString("^")
+	order := "YymdHMS"
+	finest := -1
+	suffix := afterVerbs(pattern)
+	for i := 0; i < len(pattern); i++ {
+		if i == suffix {
+			expr.WriteString(`(?:-(\d+))?`)
+		}
+		if pattern[i] == '%' && i+1 < len(pattern) {
+			if v, ok := timeVerbs[pattern[i+1]]; ok {
+				i++
+				fmt.Fprintf(expr, "(\\d{%d})", v.digits)
+				tp.verbs = append(tp.verbs, pattern[i])
+				if n := strings.IndexByte(order, pattern[i]); n > finest {
+					finest = n
+					tp.next = v.period
+				}
+				continue
+			}
+		}
+		expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+	}
+	if suffix == len(pattern) {
+		expr.WriteString(`(?:-(\d+))?`)
+	}
+	expr.WriteString("$")
+	tp.re = regexp.MustCompile(expr.String())
+	return tp
+}
+
+// parse returns the time in the name of a log file, and the number of
+// the file among those of its period.
+func (tp timePattern) parse(name string) (time.Time, int, bool) {
+	m := tp.re.FindStringSubmatch(name)
+	if m == nil || len(tp.verbs) == 0 {
+		return time.Time{}, 0, false
+	}
+	v := map[byte]int{'Y': 1970, 'm': 1, 'd': 1}
+	for i, verb := range tp.verbs {
+		n, _ := strconv.Atoi(m[i+1])
+		if verb == 'y' {
+			verb, n = 'Y', 2000+n
+		}
+		v[verb] = n
+	}
+	n, _ := strconv.Atoi(m[len(m)-1])
+	return time.Date(v['Y'], time.Month(v['m']), v['d'], v['H'], v['M'], v['S'], 0, time.Local), n, true
+}
+
+// SelectFiles returns the log files among files whose names match the base
+// name of pattern (a LOG_FILE_NAME) and that may hold records between from
+// and to, in time order. A zero from or to leaves that end open.
+//
+// A file holds the records from the time in its name until the proxy
+// rotated to the next file, which happened within the period of the next
+// file name. The extra files of a period, see suffixPath, follow the first.
+func SelectFiles(files []string, pattern string, from, to time.Time) []string {
+	tp := newTimePattern(filepath.Base(pattern))
+	type logFile struct {
+		path string
+		t    time.Time
+		n    int
+	}
+	logFiles := []logFile{}
+	for _, f := range files {
+		if t, n, ok := tp.parse(filepath.Base(f)); ok {
+			logFiles = append(logFiles, logFile{f, t, n})
+		}
+	}
+	sort.SliceStable(logFiles, func(i, j int) bool {
+		if !logFiles[i].t.Equal(logFiles[j].t) {
+			return logFiles[i].t.Before(logFiles[j].t)
+		}
+		return logFiles[i].n < logFiles[j].n
+	})
+	res := []string{}
+	for i, f := range logFiles {
+		if !to.IsZero() && !f.t.Before(to) {
+			continue
+		}
+		if !from.IsZero() && i+1 < len(logFiles) && !tp.next(logFiles[i+1].t).After(from) {
+			continue
+		}
+		res = append(res, f.path)
+	}
+	return res
+}
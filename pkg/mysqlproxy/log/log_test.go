@@ -2,15 +2,30 @@ package log
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
 	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
 )
 
@@ -35,7 +50,7 @@ func TestSendAndReceiveData(t *testing.T) {
 	filePath := filepath.Join(tempDir, "test.%Y%m%d%H%M.log")
 	// Initialize DataHandler
 	q := make(chan *sendpacket.SendPacket, 1000)
-	handler, err := NewAuditLogWriter(q, filePath, 1*time.Minute, time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC))
+	handler, err := NewAuditLogWriter(q, filePath, FormatBinary, 1*time.Minute, time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -86,3 +101,597 @@ func TestSendAndReceiveData(t *testing.T) {
 		t.Fatalf("errR.Error() is not EOF: %v", err)
 	}
 }
+
+func TestOnClose(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "test.%Y%m%d%H%M.log")
+	q := make(chan *sendpacket.SendPacket, 10)
+	start := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	handler, err := NewAuditLogWriter(q, filePath, FormatBinary, 1*time.Minute, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := []string{}
+	if err := handler.OnClose(func(p string) { closed = append(closed, p) }); err != nil {
+		t.Fatal(err)
+	}
+
+	first := handler.GetLatestFilename()
+	if err := handler.closeFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.createFile(start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	second := handler.GetLatestFilename()
+	handler.CloseChannel()
+	if err := handler.receiveAndWrite(context.Background()); err != io.EOF {
+		t.Fatalf("receiveAndWrite err:%v", err)
+	}
+	// closing again must not report the file twice
+	if err := handler.closeFile(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{first, second}, closed); diff != "" {
+		t.Errorf("closed files mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	query := "select * from t where id = 1"
+	testData := []sendpacket.SendPacket{
+		{Datetime: 1700000000, ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "connect", Packets: []byte{}},
+		{Datetime: 1700000001, ConnectionID: 1, User: "user1", Db: "db1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "est",
+			Attributes: []byte(`{"traceparent":"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}`),
+			Packets:    append([]byte{byte(len(query) + 1), 0, 0, 0, 0x03}, query...)},
+		{Datetime: 1700000001, ConnectionID: 1, User: "user1", Db: "db1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "result", Seq: 1, Duration: 300, Rows: 1, Packets: []byte{},
+			Capture: []byte(`{"columns":[{"name":"id","type":"LONG"}],"rows":[["1"]]}`), Parts: []byte(`[{"affected":1},{"result_set":true,"rows":1}]`), Status: 2},
+		{Datetime: 1700000001, ConnectionID: 1, User: "user1", Db: "db1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "infile", Seq: 2,
+			Packets: append([]byte{8, 0, 0, 2}, "test\nabc"...)},
+		{Datetime: 1700000001, ConnectionID: 1, User: "user1", Db: "db1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "result", Seq: 2, Duration: 900, Affected: 2, Packets: []byte{},
+			Infile: []byte(`{"name":"/tmp/a.csv","bytes":8,"sha256":"83b14b242cae16ea4e017767a48ec8527201349bb6b883631f13571d85491f85"}`)},
+		{Datetime: 1700000001, ConnectionID: 1, User: "user1", Db: "db1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "est", Seq: 3, Truncated: 20000000,
+			Packets: append([]byte{byte(len(query) + 1), 0, 0, 0, 0x03}, query...)},
+		{Datetime: 1700000002, ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "est", Packets: []byte{1, 0, 0, 0, 0x0e}},
+		{Datetime: 1700000003, ConnectionID: 1, User: "user1", Addr: "/tmp/mysql.sock", Target: "[::1]:3306", State: "est", Packets: []byte{5, 0, 0, 0, 0x17, 1, 0, 0, 0}},
+		{Datetime: 1700000004, ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db.example.com:3306", State: "disconnect", Err: "EOF", Packets: []byte{}},
+	}
+	for _, name := range []string{FormatBinary, FormatNDJSON, FormatNDJSON + "+analyze", FormatOCSF, FormatOCSF + "+analyze"} {
+		t.Run(name, func(t *testing.T) {
+			format, analyze := strings.CutSuffix(name, "+analyze")
+			filePath := filepath.Join(t.TempDir(), "test.%Y%m%d%H.log.gz")
+			q := make(chan *sendpacket.SendPacket, 10)
+			handler, err := NewAuditLogWriter(q, filePath, format, time.Hour, time.Unix(1700000000, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler.SetAnalyze(analyze)
+			for i := range testData {
+				if err := handler.writeDataToFile(&testData[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := handler.closeFile(); err != nil {
+				t.Fatal(err)
+			}
+			fr, err := NewFileReader(handler.GetLatestFilename())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fr.Close()
+			if fr.Format() != format {
+				t.Errorf("detected format:%s want:%s", fr.Format(), format)
+			}
+			for _, td := range testData {
+				rec := decoder.Record{}
+				if err := fr.ReadRecord(&rec); err != nil {
+					t.Fatal(err)
+				}
+				// readers analyze what the writer did not
+				want := decoder.Decode(td)
+				want.Analyze()
+				if diff := cmp.Diff(want, rec, cmpopts.EquateEmpty()); diff != "" {
+					t.Errorf("record mismatch (-want +got):\n%s", diff)
+				}
+			}
+			if err := fr.ReadRecord(&decoder.Record{}); err != io.EOF {
+				t.Fatalf("err is not EOF: %v", err)
+			}
+		})
+	}
+	if _, err := NewAuditLogWriter(nil, "x", "xml", time.Hour, time.Now()); err == nil {
+		t.Error("unknown format is accepted")
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	files := []string{
+		"/log/mysql-audit.2024010103.log.gz",
+		"/log/mysql-audit.2024010101.log.gz",
+		"/log/mysql-audit.2024010102-1.log.gz",
+		"/log/mysql-audit.2024010102.log.gz.uploaded",
+		"/log/mysql-audit.2024010102.log.gz",
+		"/log/other.log",
+	}
+	at := func(hour, min int) time.Time { return time.Date(2024, 1, 1, hour, min, 0, 0, time.Local) }
+	testcase := []struct {
+		name     string
+		from, to time.Time
+		want     []string
+	}{
+		{
+			name: "all",
+			want: []string{"/log/mysql-audit.2024010101.log.gz", "/log/mysql-audit.2024010102.log.gz", "/log/mysql-audit.2024010102-1.log.gz", "/log/mysql-audit.2024010103.log.gz"},
+		},
+		{
+			// the 01 file may hold records until the rotation at 02:xx
+			name: "from",
+			from: at(2, 30),
+			want: []string{"/log/mysql-audit.2024010101.log.gz", "/log/mysql-audit.2024010102.log.gz", "/log/mysql-audit.2024010102-1.log.gz", "/log/mysql-audit.2024010103.log.gz"},
+		},
+		{
+			// the 02 file ended when the 02-1 file was started, at 02:xx
+			name: "from next period",
+			from: at(3, 0),
+			want: []string{"/log/mysql-audit.2024010102-1.log.gz", "/log/mysql-audit.2024010103.log.gz"},
+		},
+		{
+			name: "to",
+			to:   at(2, 0),
+			want: []string{"/log/mysql-audit.2024010101.log.gz"},
+		},
+		{
+			name: "after the last file",
+			from: at(5, 0),
+			want: []string{"/log/mysql-audit.2024010103.log.gz"},
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			got := SelectFiles(files, "/var/log/mysql-audit.%Y%m%d%H.log.gz", tc.from, tc.to)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("files mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTailReader(t *testing.T) {
+	for _, format := range []string{FormatBinary, FormatNDJSON} {
+		t.Run(format, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "test.%Y%m%d%H.log.gz")
+			handler, err := NewAuditLogWriter(nil, filePath, format, time.Hour, time.Unix(1700000000, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			write := func(cmd string) {
+				sp := &sendpacket.SendPacket{Datetime: 1700000000, ConnectionID: 1, State: "est",
+					Packets: append([]byte{byte(len(cmd) + 1), 0, 0, 0, 0x03}, cmd...)}
+				if err := handler.writeDataToFile(sp); err != nil {
+					t.Error(err)
+				}
+			}
+			write("q1")
+			if err := handler.flush(); err != nil {
+				t.Fatal(err)
+			}
+			var rotated atomic.Bool
+			fr, err := NewTailReader(handler.GetLatestFilename(), time.Millisecond, rotated.Load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fr.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				time.Sleep(50 * time.Millisecond)
+				write("q2")
+				handler.flush()
+				time.Sleep(50 * time.Millisecond)
+				write("q3")
+				handler.closeFile()
+				rotated.Store(true)
+			}()
+			for _, want := range []string{"q1", "q2", "q3"} {
+				rec := decoder.Record{}
+				if err := fr.ReadRecord(&rec); err != nil {
+					t.Fatal(err)
+				}
+				if rec.Cmd != want {
+					t.Errorf("cmd:%q want:%q", rec.Cmd, want)
+				}
+			}
+			if err := fr.ReadRecord(&decoder.Record{}); err != io.EOF {
+				t.Fatalf("err is not EOF: %v", err)
+			}
+			<-done
+		})
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile, keyFile := filepath.Join(dir, "audit.pub"), filepath.Join(dir, "audit.key")
+	os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	pub, err := LoadPublicKey(pubFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := LoadPrivateKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(dir, "test.%Y%m%d%H.log.gz.enc")
+	start := time.Unix(1700000000, 0)
+	handler, err := NewAuditLogWriter(nil, filePath, FormatBinary, time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.SetEncryptKey(pub); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{}
+	write := func(cmd string) {
+		sp := &sendpacket.SendPacket{Datetime: 1700000000, ConnectionID: 1, State: "est",
+			Packets: append([]byte{byte(len(cmd) + 1), byte((len(cmd) + 1) >> 8), byte((len(cmd) + 1) >> 16), 0, 0x03}, cmd...)}
+		if err := handler.writeDataToFile(sp); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, cmd)
+	}
+	write("select 1")
+	if err := handler.flush(); err != nil {
+		t.Fatal(err)
+	}
+	// spans several chunks even after compression
+	random := make([]byte, 3*encryptChunkSize)
+	rand.Read(random)
+	write(fmt.Sprintf("select '%x'", random))
+	if err := handler.closeFile(); err != nil {
+		t.Fatal(err)
+	}
+	filename := handler.GetLatestFilename()
+	// the format of an encrypted file cannot be read back to append to it
+	if err := handler.createFile(start); err != nil {
+		t.Fatal(err)
+	}
+	if next := handler.GetLatestFilename(); next == filename {
+		t.Errorf("appended to the encrypted file %s", next)
+	}
+	handler.closeFile()
+
+	read := func(filename string, opts ...ReaderOption) ([]string, error) {
+		fr, err := NewFileReader(filename, opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer fr.Close()
+		cmds := []string{}
+		for {
+			rec := decoder.Record{}
+			err := fr.ReadRecord(&rec)
+			if err == io.EOF {
+				return cmds, nil
+			}
+			if err != nil {
+				return cmds, err
+			}
+			cmds = append(cmds, rec.Cmd)
+		}
+	}
+	if _, err := read(filename); err == nil {
+		t.Error("read without a private key")
+	}
+	got, err := read(filename, WithPrivateKey(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("cmds mismatch (-want +got):\n%s", diff)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, damage := range map[string]func([]byte) []byte{
+		"truncated": func(b []byte) []byte { return b[:len(b)/2] },
+		"modified":  func(b []byte) []byte { b[len(b)/2] ^= 1; return b },
+	} {
+		damaged := filepath.Join(dir, name)
+		os.WriteFile(damaged, damage(bytes.Clone(b)), 0600)
+		if _, err := read(damaged, WithPrivateKey(priv)); err == nil {
+			t.Errorf("%s file: no error", name)
+		}
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(filename, WithPrivateKey(other)); err == nil || !strings.Contains(err.Error(), "encrypted for key") {
+		t.Errorf("read with another key: %v", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(dir, "test.%Y%m%d%H.log")
+	start := time.Date(2023, 11, 14, 22, 10, 0, 0, time.UTC)
+	// restarts of the proxy within a period
+	restarts := []struct {
+		format string
+		key    *rsa.PrivateKey
+		file   string
+	}{
+		{FormatBinary, nil, "test.2023111422.log"},
+		{FormatBinary, nil, "test.2023111422.log"},
+		{FormatNDJSON, nil, "test.2023111422-1.log"},
+		{FormatOCSF, nil, "test.2023111422-2.log"},
+		{FormatOCSF, nil, "test.2023111422-2.log"},
+		{FormatBinary, key, "test.2023111422-3.log"},
+		// the format of an encrypted file cannot be read back
+		{FormatBinary, key, "test.2023111422-4.log"},
+		{FormatBinary, other, "test.2023111422-5.log"},
+		{FormatBinary, nil, "test.2023111422-6.log"},
+	}
+	want := map[string][]string{}
+	for i, r := range restarts {
+		handler, err := NewAuditLogWriter(nil, filePath, r.format, time.Hour, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.key != nil {
+			if err := handler.SetEncryptKey(&r.key.PublicKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := filepath.Base(handler.GetLatestFilename()); got != r.file {
+			t.Errorf("restart %d: file %s, want %s", i, got, r.file)
+		}
+		cmd := fmt.Sprintf("select %d", i)
+		sp := &sendpacket.SendPacket{Datetime: 1700000000, ConnectionID: 1, State: "est",
+			Packets: append([]byte{byte(len(cmd) + 1), 0, 0, 0, 0x03}, cmd...)}
+		if err := handler.writeDataToFile(sp); err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.closeFile(); err != nil {
+			t.Fatal(err)
+		}
+		want[r.file] = append(want[r.file], cmd)
+	}
+	for _, r := range restarts {
+		fr, err := NewFileReader(filepath.Join(dir, r.file), WithPrivateKey(r.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for {
+			rec := decoder.Record{}
+			err := fr.ReadRecord(&rec)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", r.file, err)
+			}
+			got = append(got, rec.Cmd)
+		}
+		fr.Close()
+		if diff := cmp.Diff(want[r.file], got); diff != "" {
+			t.Errorf("%s: cmds mismatch (-want +got):\n%s", r.file, diff)
+		}
+	}
+
+	// the close hooks have had the files of earlier runs
+	handler, err := NewAuditLogWriter(nil, filePath, FormatBinary, time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.OnClose(func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if got := filepath.Base(handler.GetLatestFilename()); got != "test.2023111422-7.log" {
+		t.Errorf("with close hooks: file %s", got)
+	}
+	closed, err := handler.ClosedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.closeFile()
+	wantClosed := []string{"test.2023111422.log"}
+	for n := 1; n <= 6; n++ {
+		wantClosed = append(wantClosed, fmt.Sprintf("test.2023111422-%d.log", n))
+	}
+	for i := range closed {
+		closed[i] = filepath.Base(closed[i])
+	}
+	if diff := cmp.Diff(wantClosed, closed); diff != "" {
+		t.Errorf("closed files mismatch (-want +got):\n%s", diff)
+	}
+
+	// a file of an older binary layout
+	old := filepath.Join(dir, "test.2023111423.log")
+	f, err := os.Create(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(f)
+	gw.Write([]byte(`{"format":"mysqlproxy-v1.07"}\n`))
+	gw.Close()
+	f.Close()
+	handler, err = NewAuditLogWriter(nil, filePath, FormatBinary, time.Hour, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.closeFile()
+	if got := filepath.Base(handler.GetLatestFilename()); got != "test.2023111423-1.log" {
+		t.Errorf("after an older layout: file %s", got)
+	}
+}
+
+func TestBufPool(t *testing.T) {
+	p := &bufPool{}
+	for _, tc := range []struct{ size, cap int }{{0, 512}, {100, 512}, {513, 2 << 10}, {70000, 128 << 10}, {maxPacketSize, maxPacketSize}, {maxPacketSize + 1, maxPacketSize + 1}} {
+		if b := p.get(tc.size); len(b) != 0 || cap(b) != tc.cap {
+			t.Errorf("get(%d) len:%d cap:%d want cap:%d", tc.size, len(b), cap(b), tc.cap)
+		}
+	}
+	b := append(p.get(4), 1, 2, 3, 4)
+	b = p.grow(b, 5000)
+	if len(b) != 5000 || cap(b) != 8<<10 || !bytes.Equal(b[:4], []byte{1, 2, 3, 4}) {
+		t.Errorf("grow(5000) len:%d cap:%d head:%v", len(b), cap(b), b[:4])
+	}
+	b = p.grow(b, maxPacketSize+10)
+	if len(b) != maxPacketSize+10 || !bytes.Equal(b[:4], []byte{1, 2, 3, 4}) {
+		t.Errorf("grow(%d) len:%d head:%v", maxPacketSize+10, len(b), b[:4])
+	}
+}
+
+func TestMemBudget(t *testing.T) {
+	b := newMemBudget(1000)
+	ctx := context.Background()
+	// larger than the budget, but nothing else waits
+	if err := b.acquire(ctx, 2000); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error)
+	go func() { acquired <- b.acquire(ctx, 10) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired over the budget: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(2000)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := b.acquire(cctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("acquire over the budget err:%v want:%v", err, context.DeadlineExceeded)
+	}
+	b.setLimit(0)
+	if err := b.acquire(ctx, 1<<40); err != nil {
+		t.Errorf("acquire without limit err:%v", err)
+	}
+}
+
+// BenchmarkSessions runs the SendTasks of many sessions at once, each
+// logging the commands of its client, and reports the peak resident memory
+// of the process, e.g.
+//
+//	go test -run XXX -bench Sessions ./pkg/mysqlproxy/log/
+func BenchmarkSessions(b *testing.B) {
+	// most commands are small, some are large
+	sizes := []int{64, 200, 300, 500, 1000, 200, 8 << 10, 100, 200, 256 << 10}
+	commands := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		commands[i] = append([]byte{byte(size), byte(size >> 8), byte(size >> 16), 0, 0x03}, bytes.Repeat([]byte("x"), size-1)...)
+	}
+	for _, sessions := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("sessions=%d", sessions), func(b *testing.B) {
+			q := make(chan *sendpacket.SendPacket, 1000)
+			handler, err := NewAuditLogWriter(q, filepath.Join(b.TempDir(), "bench.%Y%m%d%H.log.gz"), FormatBinary, time.Hour, time.Now())
+			if err != nil {
+				b.Fatal(err)
+			}
+			handler.SetMemoryBudget(64 << 20)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				handler.LogWriteWorker(ctx)
+				close(done)
+			}()
+			cfg := &mysqlproxy.ProxyCfg{ConTimeout: time.Second, LogCommandLimit: 16 << 20}
+			clients := make([]net.Conn, sessions)
+			var workers sync.WaitGroup
+			for s := range clients {
+				client, proxy := net.Pipe()
+				clients[s] = client
+				st := &mysqlproxy.SendTask{Reader: proxy, Writer: io.Discard, User: "bench", Addr: "db:3306", ConnID: uint32(s), Config: cfg, LogWriter: handler}
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					st.Worker(ctx)
+					proxy.Close()
+				}()
+			}
+			// drop the buffers of the previous runs
+			runtime.GC()
+			runtime.GC()
+			peak := make(chan uint64)
+			stop := make(chan struct{})
+			go func() {
+				top := uint64(0)
+				for {
+					top = max(top, rss())
+					select {
+					case <-stop:
+						peak <- top
+						return
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
+			}()
+			var next atomic.Int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for s, client := range clients {
+				wg.Add(1)
+				go func(s int, client net.Conn) {
+					defer wg.Done()
+					for i := s; next.Add(1) <= int64(b.N); i++ {
+						if _, err := client.Write(commands[i%len(commands)]); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(s, client)
+			}
+			wg.Wait()
+			b.StopTimer()
+			close(stop)
+			b.ReportMetric(float64(<-peak)/(1<<20), "peak-rss-MiB")
+			for _, client := range clients {
+				client.Close()
+			}
+			workers.Wait()
+			handler.CloseChannel()
+			<-done
+		})
+	}
+}
+
+// rss returns the resident memory of the process, or where /proc is not
+// available, the memory the runtime holds from the OS.
+func rss() uint64 {
+	if b, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if f := strings.Fields(string(b)); len(f) > 1 {
+			if pages, err := strconv.ParseUint(f[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	s := []metrics.Sample{{Name: "/memory/classes/total:bytes"}, {Name: "/memory/classes/heap/released:bytes"}}
+	metrics.Read(s)
+	return s[0].Value.Uint64() - s[1].Value.Uint64()
+}
@@ -0,0 +1,126 @@
+package mask
+
+import (
+	"strings"
+)
+
+// literalSpans returns the spans of the string, numeric, hexadecimal and
+// bit literals of sql, skipping comments and quoted identifiers. The text
+// of /*! ... */ comments, which MySQL runs, is scanned like the rest.
+func literalSpans(sql string) [][2]int {
+	spans := [][2]int{}
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := quoted(sql, i)
+			start := i
+			if start > 0 && isIdent(sql[start-1]) && (start < 2 || !isIdent(sql[start-2])) {
+				switch sql[start-1] | 0x20 {
+				case 'x', 'b', 'n':
+					// X'01ff', B'0101', N'text'
+					start--
+				}
+			}
+			spans = append(spans, [2]int{start, end})
+			i = end
+		case c == '`':
+			i = quoted(sql, i)
+		case strings.HasPrefix(sql[i:], "/*!"):
+			// the version the text is run from, e.g. /*!50110 KEY_BLOCK_SIZE=1024 */
+			i += 3
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return spans
+			}
+			i += end + 4
+		case strings.HasPrefix(sql[i:], "-- ") || c == '#':
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				return spans
+			}
+			i += end + 1
+		case isDigit(c) || c == '.' && i+1 < len(sql) && isDigit(sql[i+1]):
+			if i > 0 && (isIdent(sql[i-1]) || sql[i-1] == '.' && c != '.') {
+				// part of an identifier such as t1, or db.1t
+				i = skipIdent(sql, i)
+				continue
+			}
+			end := number(sql, i)
+			if end < len(sql) && isIdent(sql[end]) {
+				// an identifier starting with digits, such as 1t
+				i = skipIdent(sql, end)
+				continue
+			}
+			spans = append(spans, [2]int{i, end})
+			i = end
+		case isIdent(c):
+			i = skipIdent(sql, i)
+		default:
+			i++
+		}
+	}
+	return spans
+}
+
+// quoted returns the end of the quoted string starting at i. A doubled
+// quote or a backslash escapes the quote.
+func quoted(s string, i int) int {
+	q := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch {
+		case s[j] == '\\' && q != '`':
+			j++
+		case s[j] == q:
+			if j+1 < len(s) && s[j+1] == q {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// number returns the end of the number starting at i: 12, 1.5, .5, 1e-3 or 0x1f.
+func number(s string, i int) int {
+	if strings.HasPrefix(s[i:], "0x") || strings.HasPrefix(s[i:], "0b") {
+		j := i + 2
+		for j < len(s) && isIdent(s[j]) {
+			j++
+		}
+		return j
+	}
+	j := i
+	for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+		j++
+	}
+	if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+		k := j + 1
+		if k < len(s) && (s[k] == '+' || s[k] == '-') {
+			k++
+		}
+		if k < len(s) && isDigit(s[k]) {
+			for j = k; j < len(s) && isDigit(s[j]); j++ {
+			}
+		}
+	}
+	return j
+}
+
+func skipIdent(s string, i int) int {
+	for i < len(s) && isIdent(s[i]) {
+		i++
+	}
+	return i
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func isIdent(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || isDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
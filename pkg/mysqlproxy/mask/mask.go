@@ -0,0 +1,294 @@
+// Package mask redacts sensitive values from SQL text before it is logged.
+package mask
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+)
+
+// Redacted replaces masked values. With a hash key it is followed by the
+// keyed hash of the value, e.g. '***:3f2a9c1e7b5d0a41'.
+const Redacted = "***"
+
+type Config struct {
+	Credentials bool     // passwords of CREATE USER, ALTER USER, SET PASSWORD, ...
+	Regex       []string // the match, or its first group, is redacted
+	Literals    []string // "schema" or "schema.table" patterns of path.Match whose queries have all literals redacted
+	HashKey     string   // key of the HMAC-SHA256 kept with redacted values, none if empty
+}
+
+// Masker redacts SQL text. It is safe for concurrent use.
+type Masker struct {
+	credentials bool
+	regex       []*regexp.Regexp
+	literals    []string
+	key         []byte
+}
+
+// New returns a Masker, or nil if the config masks nothing.
+func New(c Config) (*Masker, error) {
+	m := &Masker{credentials: c.Credentials, literals: c.Literals}
+	for _, r := range c.Regex {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("mask regex %q: %w", r, err)
+		}
+		m.regex = append(m.regex, re)
+	}
+	for _, l := range c.Literals {
+		if _, err := path.Match(l, ""); err != nil {
+			return nil, fmt.Errorf("mask literals %q: %w", l, err)
+		}
+	}
+	if len(c.HashKey) > 0 {
+		m.key = []byte(c.HashKey)
+	}
+	if !m.credentials && len(m.regex) == 0 && len(m.literals) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// credentialRules find the string literals holding secrets, as their
+// first group, and credentialParams the placeholders of prepared statements
+// bound to secrets.
+var (
+	credentialRules  = credentials(`('(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.|"")*")`)
+	credentialParams = credentials(`(\?)`)
+)
+
+func credentials(lit string) []*regexp.Regexp {
+	rules := []string{
+		// CREATE USER, ALTER USER, GRANT ... IDENTIFIED [WITH plugin] BY|AS 'secret'
+		`\bIDENTIFIED(?:\s+WITH\s+\S+)?\s+(?:BY|AS)\s+`,
+		// SET PASSWORD [FOR user] = 'secret' | PASSWORD('secret')
+		`\bSET\s+PASSWORD(?:\s+FOR\s+\S+)?\s*=\s*(?:PASSWORD\s*\(\s*)?`,
+		// ALTER USER ... REPLACE 'current'
+		`\bREPLACE\s+`,
+		// PASSWORD('secret'), START REPLICA ... PASSWORD = 'secret', CREATE SERVER ... OPTIONS (PASSWORD 'secret')
+		`\bPASSWORD\s*[(=]?\s*`,
+		// CHANGE MASTER TO MASTER_PASSWORD = 'secret', CHANGE REPLICATION SOURCE TO SOURCE_PASSWORD = 'secret'
+		`\b(?:MASTER|SOURCE)_PASSWORD\s*=\s*`,
+	}
+	res := make([]*regexp.Regexp, len(rules))
+	for i, r := range rules {
+		res[i] = regexp.MustCompile(`(?i)` + r + lit)
+	}
+	return res
+}
+
+// Mask returns the SQL text with sensitive values redacted, and whether
+// anything was redacted. db is the current database of the session.
+func (m *Masker) Mask(sql, db string) (string, bool) {
+	masked := false
+	if len(m.literals) > 0 && m.touches(sql, db) {
+		sql = replaceSpans(sql, literalSpans(sql), m.literal)
+		masked = true
+	} else if m.credentials {
+		// rules overlap, e.g. SET PASSWORD = PASSWORD('secret')
+		spans := [][2]int{}
+		for _, re := range credentialRules {
+			spans = append(spans, groupSpans(re, sql)...)
+		}
+		if spans = disjoint(spans); len(spans) > 0 {
+			sql = replaceSpans(sql, spans, m.literal)
+			masked = true
+		}
+	}
+	for _, re := range m.regex {
+		if spans := groupSpans(re, sql); len(spans) > 0 {
+			sql = replaceSpans(sql, spans, m.redact)
+			masked = true
+		}
+	}
+	return sql, masked
+}
+
+// MaskPacket redacts the SQL text of a COM_QUERY or COM_STMT_PREPARE
+// command with its 4 byte header. The payload is the rest of packet, which
+// may be longer than one packet when the command was reassembled. Other
+// packets are returned as they are. The result may share memory with packet.
+func (m *Masker) MaskPacket(packet []byte, db string) []byte {
+	if len(packet) < 5 || packet[3] != 0 {
+		// not a command
+		return packet
+	}
+	switch packet[4] {
+	case mysql.COM_QUERY, mysql.COM_STMT_PREPARE:
+	default:
+		return packet
+	}
+	sql, masked := m.Mask(string(packet[5:]), db)
+	if !masked {
+		return packet
+	}
+	length := min(1+len(sql), mysql.MaxPayloadLen)
+	res := make([]byte, 0, 5+len(sql))
+	res = append(res, byte(length), byte(length>>8), byte(length>>16), 0, packet[4])
+	return append(res, sql...)
+}
+
+// Sensitive reports whether the parameters of the prepared statement sql
+// are masked: it touches a table whose literals are masked, or binds a
+// credential. db is the current database of the session.
+func (m *Masker) Sensitive(sql, db string) bool {
+	if len(m.literals) > 0 && m.touches(sql, db) {
+		return true
+	}
+	if m.credentials {
+		for _, re := range credentialParams {
+			if re.MatchString(sql) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MaskParams redacts the values of a COM_STMT_EXECUTE or the data of a
+// COM_STMT_SEND_LONG_DATA command with its 4 byte header, for a statement
+// that is Sensitive. What follows the statement id, and the flags and
+// iteration count of an execution, is replaced with one redacted value.
+// Other packets are returned as they are.
+func (m *Masker) MaskParams(packet []byte) []byte {
+	if len(packet) < 5 || packet[3] != 0 {
+		// not a command
+		return packet
+	}
+	keep := 0
+	switch packet[4] {
+	case mysql.COM_STMT_EXECUTE:
+		keep = 4 + 1 + 4 + 1 + 4
+	case mysql.COM_STMT_SEND_LONG_DATA:
+		keep = 4 + 1 + 4 + 2
+	default:
+		return packet
+	}
+	if len(packet) <= keep {
+		return packet
+	}
+	redacted := m.redact(string(packet[keep:]))
+	length := keep - 4 + len(redacted)
+	res := make([]byte, 0, keep+len(redacted))
+	res = append(res, byte(length), byte(length>>8), byte(length>>16), 0)
+	res = append(res, packet[4:keep]...)
+	return append(res, redacted...)
+}
+
+// MaskCapture redacts the values of a captured result set of the query sql.
+// All values are redacted if the query touches a table whose literals are
+// masked, or if sql is empty, e.g. for prepared statements, and literals of
+// some tables are masked. Otherwise the regular expressions apply to each
+// value.
+func (m *Masker) MaskCapture(c *protocol.Capture, sql, db string) {
+	all := len(m.literals) > 0 && (len(sql) == 0 || m.touches(sql, db))
+	for _, row := range c.Rows {
+		for i, v := range row {
+			if v == nil {
+				continue
+			}
+			s := *v
+			if all {
+				s = m.redact(s)
+			} else {
+				for _, re := range m.regex {
+					s = replaceSpans(s, groupSpans(re, s), m.redact)
+				}
+			}
+			row[i] = &s
+		}
+	}
+}
+
+// touches reports whether the query touches a table whose literals are
+// masked. A query the parser cannot read, e.g. one cut at
+// ProxyCfg.LogCommandLimit, may touch any table.
+func (m *Masker) touches(sql, db string) bool {
+	tables, err := decoder.Tables(sql, db)
+	if err != nil {
+		return true
+	}
+	for _, t := range tables {
+		schema, _, _ := strings.Cut(t.Name, ".")
+		for _, pattern := range m.literals {
+			if ok, _ := path.Match(pattern, t.Name); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, schema); ok && !strings.Contains(pattern, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// literal redacts a whole literal and keeps it a string literal.
+func (m *Masker) literal(lit string) string {
+	if len(lit) >= 2 && (lit[0] == '\'' || lit[0] == '"') {
+		lit = lit[1 : len(lit)-1]
+	}
+	return "'" + m.redact(lit) + "'"
+}
+
+func (m *Masker) redact(value string) string {
+	if m.key == nil {
+		return Redacted
+	}
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(value))
+	return Redacted + ":" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// groupSpans returns the spans of the first group of each match, or of
+// the whole match if the regular expression has no group.
+func groupSpans(re *regexp.Regexp, s string) [][2]int {
+	spans := [][2]int{}
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		if len(m) >= 4 && m[2] >= 0 {
+			spans = append(spans, [2]int{m[2], m[3]})
+		} else {
+			spans = append(spans, [2]int{m[0], m[1]})
+		}
+	}
+	return spans
+}
+
+// disjoint sorts spans and drops those overlapping an earlier one.
+func disjoint(spans [][2]int) [][2]int {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	res := spans[:0]
+	end := 0
+	for _, sp := range spans {
+		if sp[0] >= end {
+			res = append(res, sp)
+			end = sp[1]
+		}
+	}
+	return res
+}
+
+// replaceSpans replaces the ordered, non-overlapping spans of s.
+func replaceSpans(s string, spans [][2]int, replace func(string) string) string {
+	if len(spans) == 0 {
+		return s
+	}
+	b := strings.Builder{}
+	last := 0
+	for _, sp := range spans {
+		b.WriteString(s[last:sp[0]])
+		b.WriteString(replace(s[sp[0]:sp[1]]))
+		last = sp[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
@@ -0,0 +1,204 @@
+package mask
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/google/go-cmp/cmp"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+)
+
+func TestMask(t *testing.T) {
+	credentials := Config{Credentials: true}
+	testcase := []struct {
+		name   string
+		config Config
+		sql    string
+		db     string
+		want   string
+		masked bool
+	}{
+		{
+			name:   "create user",
+			config: credentials,
+			sql:    "CREATE USER 'app'@'%' IDENTIFIED BY 'S3cr''et'",
+			want:   "CREATE USER 'app'@'%' IDENTIFIED BY '***'",
+			masked: true,
+		},
+		{
+			name:   "alter user with plugin and replace",
+			config: credentials,
+			sql:    `alter user app identified with caching_sha2_password by "new" replace 'old'`,
+			want:   "alter user app identified with caching_sha2_password by '***' replace '***'",
+			masked: true,
+		},
+		{
+			name:   "set password",
+			config: credentials,
+			sql:    "SET PASSWORD FOR 'app'@'%' = PASSWORD('x')",
+			want:   "SET PASSWORD FOR 'app'@'%' = PASSWORD('***')",
+			masked: true,
+		},
+		{
+			name:   "replication source",
+			config: credentials,
+			sql:    "CHANGE REPLICATION SOURCE TO SOURCE_USER='repl', SOURCE_PASSWORD='x'",
+			want:   "CHANGE REPLICATION SOURCE TO SOURCE_USER='repl', SOURCE_PASSWORD='***'",
+			masked: true,
+		},
+		{
+			name:   "no credentials",
+			config: credentials,
+			sql:    "select 'password' from t",
+			want:   "select 'password' from t",
+		},
+		{
+			name:   "keyed hash",
+			config: Config{Credentials: true, HashKey: "k"},
+			sql:    "create user u identified by 'x'",
+			want:   "create user u identified by '***:" + hash("k", "x") + "'",
+			masked: true,
+		},
+		{
+			name:   "regex",
+			config: Config{Regex: []string{`\b\d{4}-\d{4}-\d{4}-\d{4}\b`, `email\s*=\s*'([^']*)'`}},
+			sql:    "update t set card='4111-1111-1111-1111' where email = 'a@example.com'",
+			want:   "update t set card='***' where email = '***'",
+			masked: true,
+		},
+		{
+			name:   "literals of a schema",
+			config: Config{Literals: []string{"hr"}},
+			sql:    "insert into employees (id, name, salary, note) values (1, 'Ann', 1.5e3, X'0f') /* 2 */",
+			db:     "hr",
+			want:   "insert into employees (id, name, salary, note) values ('***', '***', '***', '***') /* 2 */",
+			masked: true,
+		},
+		{
+			name:   "literals of a table",
+			config: Config{Literals: []string{"billing.card*"}},
+			sql:    "select * from billing.cards c1 where c1.no = \"4111\" and `col 1` = 1",
+			want:   "select * from billing.cards c1 where c1.no = '***' and `col 1` = '***'",
+			masked: true,
+		},
+		{
+			name:   "literals of a version comment",
+			config: Config{Literals: []string{"hr"}},
+			sql:    "select /*!40001 SQL_NO_CACHE */ * from employees where ssn = '123-45-6789' /*!50000 and name = 'Ann' */",
+			db:     "hr",
+			want:   "select /*!40001 SQL_NO_CACHE */ * from employees where ssn = '***' /*!50000 and name = '***' */",
+			masked: true,
+		},
+		{
+			name:   "literals of sql the parser cannot read",
+			config: Config{Literals: []string{"hr"}},
+			sql:    "insert into employees values ('123-45-6789', 12",
+			db:     "other",
+			want:   "insert into employees values ('***', '***'",
+			masked: true,
+		},
+		{
+			name:   "literals of other tables",
+			config: Config{Literals: []string{"billing.card*"}},
+			sql:    "select * from billing.invoices where id = 1",
+			want:   "select * from billing.invoices where id = 1",
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := New(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, masked := m.Mask(tc.sql, tc.db)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Mask() mismatch (-want +got):\n%s", diff)
+			}
+			if masked != tc.masked {
+				t.Errorf("masked=%v want:%v", masked, tc.masked)
+			}
+		})
+	}
+}
+
+func TestMaskPacket(t *testing.T) {
+	m, err := New(Config{Credentials: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := func(seq byte, payload string) []byte {
+		n := len(payload)
+		return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...)
+	}
+	query := packet(0, "\x03create user u identified by 'secret'")
+	if diff := cmp.Diff(packet(0, "\x03create user u identified by '***'"), m.MaskPacket(query, "")); diff != "" {
+		t.Errorf("MaskPacket() mismatch (-want +got):\n%s", diff)
+	}
+	// reassembled from several packets, the header holds the length of one
+	long := strings.Repeat("x", mysql.MaxPayloadLen)
+	query = packet(0, "\x03create user u identified by 'secret' comment '"+long+"'")
+	query[0], query[1], query[2] = 0xff, 0xff, 0xff
+	want := packet(0, "\x03create user u identified by '***' comment '"+long+"'")
+	want[0], want[1], want[2] = 0xff, 0xff, 0xff
+	if got := m.MaskPacket(query, ""); !bytes.Equal(want, got) {
+		t.Errorf("MaskPacket() of a reassembled command = %q...", got[:min(len(got), 60)])
+	}
+	// not a command
+	data := packet(1, "\x03create user u identified by 'secret'")
+	if diff := cmp.Diff(data, m.MaskPacket(data, "")); diff != "" {
+		t.Errorf("MaskPacket() mismatch (-want +got):\n%s", diff)
+	}
+	if m, _ := New(Config{}); m != nil {
+		t.Errorf("New(Config{})=%v want nil", m)
+	}
+}
+
+func hash(key, value string) string {
+	m := &Masker{key: []byte(key)}
+	return m.redact(value)[len(Redacted)+1:]
+}
+
+func TestMaskCapture(t *testing.T) {
+	m, err := New(Config{Regex: []string{`\d{4}-\d{4}-\d{4}-\d{4}`}, Literals: []string{"hr"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *string { return &s }
+	capture := func() *protocol.Capture {
+		return &protocol.Capture{
+			Columns: []protocol.Column{{Name: "name", Type: "VAR_STRING"}, {Name: "card", Type: "VAR_STRING"}},
+			Rows:    [][]*string{{str("alice"), str("card 1234-5678-9012-3456")}, {str("bob"), nil}},
+		}
+	}
+	testcase := []struct {
+		name string
+		sql  string
+		want [][]*string
+	}{
+		{
+			name: "regex",
+			sql:  "select name, card from shop.customer",
+			want: [][]*string{{str("alice"), str("card ***")}, {str("bob"), nil}},
+		},
+		{
+			name: "literals",
+			sql:  "select name, card from hr.employee",
+			want: [][]*string{{str("***"), str("***")}, {str("***"), nil}},
+		},
+		{
+			name: "unknown query",
+			want: [][]*string{{str("***"), str("***")}, {str("***"), nil}},
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			c := capture()
+			m.MaskCapture(c, tc.sql, "")
+			if diff := cmp.Diff(tc.want, c.Rows); diff != "" {
+				t.Errorf("MaskCapture() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
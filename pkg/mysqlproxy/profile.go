@@ -0,0 +1,111 @@
+package mysqlproxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/route"
+)
+
+const (
+	// defaultServerVersion is told to clients when no target is probed.
+	defaultServerVersion = "8.0.12_mysql-audit-proxy"
+	// probeRetry is the least time between two probes of a target that failed.
+	probeRetry   = 10 * time.Second
+	probeTimeout = 5 * time.Second
+)
+
+// negotiatedCaps change the packets that follow the handshake, which the
+// proxy forwards as they are. A session uses them only if the client, the
+// proxy and the target all do.
+const negotiatedCaps = mysql.CLIENT_FOUND_ROWS | mysql.CLIENT_IGNORE_SPACE | mysql.CLIENT_LOCAL_FILES |
+	mysql.CLIENT_MULTI_STATEMENTS | mysql.CLIENT_MULTI_RESULTS | mysql.CLIENT_PS_MULTI_RESULTS |
+	mysql.CLIENT_SESSION_TRACK | mysql.CLIENT_DEPRECATE_EOF | mysql.CLIENT_OPTIONAL_RESULTSET_METADATA |
+	mysql.CLIENT_QUERY_ATTRIBUTES
+
+// serverProfile is what the proxy tells clients in its handshake. The
+// handshake comes before the client names its user, and so its target, so
+// that of ProxyCfg.ProbeTarget is told to every client.
+type serverProfile struct {
+	mu        sync.Mutex
+	handshake *protocol.Handshake // of the probed target, nil until known
+	probed    time.Time           // of the last probe
+	probing   bool                // a probe is in flight
+}
+
+// serverProfile returns the version, collation and capabilities to tell
+// clients. ok is false if no target is known, in which case the proxy tells
+// its own. It does not wait for the target: while the target is probed,
+// clients get the proxy's profile.
+func (p *ProxySrv) serverProfile(ctx context.Context) (version string, collation uint8, capability uint32, ok bool) {
+	version, collation = defaultServerVersion, mysql.DEFAULT_COLLATION_ID
+	if len(p.Config.ProbeTarget) > 0 {
+		p.profile.mu.Lock()
+		h := p.profile.handshake
+		p.profile.mu.Unlock()
+		if h == nil && p.startProbe() {
+			go p.probe(ctx)
+		}
+		if h != nil {
+			version, collation, capability, ok = h.Version, h.Collation, h.Capability, true
+		}
+	}
+	if len(p.Config.ServerVersion) > 0 {
+		version = p.Config.ServerVersion
+	}
+	return version, collation, capability, ok
+}
+
+// startProbe reports whether the caller is to probe the target: none is
+// known, none is being probed, and the last probe is probeRetry old.
+func (p *ProxySrv) startProbe() bool {
+	p.profile.mu.Lock()
+	defer p.profile.mu.Unlock()
+	if p.profile.handshake != nil || p.profile.probing || time.Since(p.profile.probed) < probeRetry {
+		return false
+	}
+	p.profile.probing, p.profile.probed = true, time.Now()
+	return true
+}
+
+// probe reads the profile of ProxyCfg.ProbeTarget, after startProbe. It
+// logs in as ProxyCfg.HealthCheckUser, see probeBackend.
+func (p *ProxySrv) probe(ctx context.Context) {
+	probed, err := probeBackend(ctx, p.Config.ProbeTarget, p.Config.HealthCheckUser, probeTimeout)
+	var myErr *mysql.MyError
+	if errors.As(err, &myErr) {
+		// the handshake was read, the login failed
+		log.Printf("probe target:%s login as %s err:%v", p.Config.ProbeTarget, p.Config.HealthCheckUser, err)
+		err = nil
+	}
+	p.profile.mu.Lock()
+	defer p.profile.mu.Unlock()
+	p.profile.probing = false
+	if err != nil {
+		log.Printf("probe target:%s err:%v", p.Config.ProbeTarget, err)
+		return
+	}
+	p.profile.handshake = &probed
+	log.Printf("probe target:%s version:%s", p.Config.ProbeTarget, probed.Version)
+}
+
+// learnProfile keeps what a session found out about the probed target, so
+// that an upgrade of the target shows without a restart.
+func (p *ProxySrv) learnProfile(addr, version string, capability uint32) {
+	if addr != route.AddPort(p.Config.ProbeTarget) {
+		return
+	}
+	p.profile.mu.Lock()
+	defer p.profile.mu.Unlock()
+	if h := p.profile.handshake; h != nil && (h.Version != version || h.Capability != capability) {
+		updated := *h
+		updated.Version, updated.Capability = version, capability
+		p.profile.handshake = &updated
+		log.Printf("target:%s changed to version:%s", addr, version)
+	}
+}
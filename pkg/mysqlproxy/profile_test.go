@@ -0,0 +1,50 @@
+package mysqlproxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerProfileProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// a target that accepts but does not answer
+	var conns atomic.Int32
+	release := make(chan struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				<-release
+				conn.Close()
+			}()
+		}
+	}()
+	p := &ProxySrv{Config: &ProxyCfg{ProbeTarget: ln.Addr().String()}}
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		version, _, _, ok := p.serverProfile(ctx)
+		if ok || version != defaultServerVersion {
+			t.Fatalf("profile of the target while probing: %s", version)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("handshakes waited %v for the probe", d)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d probes in flight, want 1", n)
+	}
+	close(release)
+}
@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// parameterCountAvailable is the flag of COM_STMT_EXECUTE telling that
+// parameter_count is sent.
+const parameterCountAvailable = 0x08
+
+var errShort = errors.New("query attributes: payload too short")
+
+// Param is the type of a parameter bound by COM_QUERY or COM_STMT_EXECUTE
+// of a session with CLIENT_QUERY_ATTRIBUTES. Query attributes are named
+// parameters; the parameters of a prepared statement have no name and come
+// first.
+type Param struct {
+	Type     byte
+	Unsigned bool
+	Name     string
+}
+
+// ParseQuery reads a COM_QUERY payload sent with CLIENT_QUERY_ATTRIBUTES.
+// It returns the attributes as text, NULL ones left out, and the payload
+// without them, as sent without CLIENT_QUERY_ATTRIBUTES.
+func ParseQuery(payload []byte) (attrs map[string]string, plain []byte, err error) {
+	if len(payload) < 1 {
+		return nil, nil, errShort
+	}
+	b := payload[1:]
+	count, n := lenencInt(b)
+	if n == 0 {
+		return nil, nil, errShort
+	}
+	b = b[n:]
+	if _, n = lenencInt(b); n == 0 { // parameter_set_count, always 1
+		return nil, nil, errShort
+	}
+	b = b[n:]
+	if count > 0 {
+		params, values, rest, err := readParams(b, count, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		attrs = attributes(params.types, values)
+		b = rest
+	}
+	plain = append([]byte{payload[0]}, b...)
+	return attrs, plain, nil
+}
+
+// ParseExecute reads a COM_STMT_EXECUTE payload sent with
+// CLIENT_QUERY_ATTRIBUTES. types are the parameters bound by the previous
+// execution of the statement, used when the payload does not bind them
+// again, and long are the parameters sent by COM_STMT_SEND_LONG_DATA, whose
+// values the payload leaves out. It returns the attributes, the payload as
+// sent without CLIENT_QUERY_ATTRIBUTES, and the parameters bound.
+func ParseExecute(payload []byte, types []Param, long map[uint16]bool) (attrs map[string]string, plain []byte, bound []Param, err error) {
+	const head = 1 + 4 + 1 + 4 // command, statement id, flags, iteration count
+	if len(payload) < head {
+		return nil, nil, nil, errShort
+	}
+	plain = append([]byte{}, payload[:head]...)
+	plain[5] &^= parameterCountAvailable
+	b := payload[head:]
+	if len(b) == 0 {
+		// no parameters and no attributes
+		return nil, plain, types, nil
+	}
+	count, n := lenencInt(b)
+	if n == 0 {
+		return nil, nil, nil, errShort
+	}
+	if count == 0 {
+		return nil, plain, types, nil
+	}
+	params, values, _, err := readParams(b[n:], count, types, long)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// the parameters of the statement are the ones without a name
+	k := 0
+	for k < len(params.types) && len(params.types[k].Name) == 0 {
+		k++
+	}
+	if k > 0 {
+		bitmap := make([]byte, (k+7)/8)
+		for i := 0; i < k; i++ {
+			if values[i] == nil {
+				bitmap[i/8] |= 1 << (i % 8)
+			}
+		}
+		plain = append(plain, bitmap...)
+		plain = append(plain, params.bind)
+		if params.bind == 1 {
+			for _, p := range params.types[:k] {
+				flags := byte(0)
+				if p.Unsigned {
+					flags = 0x80
+				}
+				plain = append(plain, p.Type, flags)
+			}
+		}
+		for _, v := range params.raw[:k] {
+			plain = append(plain, v...)
+		}
+	}
+	return attributes(params.types, values), plain, params.types, nil
+}
+
+type boundParams struct {
+	types []Param
+	bind  byte
+	raw   [][]byte // values as sent, nil if NULL
+}
+
+// readParams reads the null bitmap, the types and names if bound, and the
+// values of count parameters but those of long. It returns the values as
+// text and the rest of b.
+func readParams(b []byte, count uint64, types []Param, long map[uint16]bool) (params boundParams, values []*string, rest []byte, err error) {
+	if count > 8*uint64(len(b)) {
+		// more than the null bitmap could hold
+		return params, nil, nil, errShort
+	}
+	nulls := int(count+7) / 8
+	if len(b) < nulls+1 {
+		return params, nil, nil, errShort
+	}
+	bitmap := b[:nulls]
+	params.bind = b[nulls]
+	b = b[nulls+1:]
+	if params.bind == 1 {
+		types = nil
+		for i := uint64(0); i < count; i++ {
+			if len(b) < 2 {
+				return params, nil, nil, errShort
+			}
+			p := Param{Type: b[0], Unsigned: b[1]&0x80 != 0}
+			name, n := lenencString(b[2:])
+			if n == 0 {
+				return params, nil, nil, errShort
+			}
+			p.Name = string(name)
+			types = append(types, p)
+			b = b[2+n:]
+		}
+	}
+	if uint64(len(types)) != count {
+		return params, nil, nil, errors.New("query attributes: types of the parameters unknown")
+	}
+	params.types = types
+	for i, p := range types {
+		if bitmap[i/8]&(1<<(i%8)) != 0 || p.Type == mysql.MYSQL_TYPE_NULL {
+			values = append(values, nil)
+			params.raw = append(params.raw, nil)
+			continue
+		}
+		if long[uint16(i)] {
+			values = append(values, new(string))
+			params.raw = append(params.raw, []byte{})
+			continue
+		}
+		t := columnType{typ: p.Type}
+		if p.Unsigned {
+			t.flags = mysql.UNSIGNED_FLAG
+		}
+		v, n := binaryValue(b, t)
+		if n == 0 {
+			return params, nil, nil, errShort
+		}
+		s := text(v)
+		values = append(values, &s)
+		params.raw = append(params.raw, b[:n])
+		b = b[n:]
+	}
+	return params, values, b, nil
+}
+
+// attributes returns the named parameters that are not NULL, nil if none.
+func attributes(types []Param, values []*string) map[string]string {
+	var attrs map[string]string
+	for i, p := range types {
+		if len(p.Name) == 0 || values[i] == nil {
+			continue
+		}
+		if attrs == nil {
+			attrs = map[string]string{}
+		}
+		attrs[p.Name] = *values[i]
+	}
+	return attrs
+}
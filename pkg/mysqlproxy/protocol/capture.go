@@ -0,0 +1,310 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// Capture is the beginning of the first result set of a command: its
+// columns and its first rows, as text. Binary values are hex with a 0x
+// prefix and NULL is nil.
+type Capture struct {
+	Columns   []Column    `json:"columns"`
+	Rows      [][]*string `json:"rows,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"` // rows, values or result sets were left out
+}
+
+// Column is the definition of a column of a result set.
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // e.g. "VARCHAR", "LONGLONG"
+}
+
+// columnType is what the binary protocol needs to read a value.
+type columnType struct {
+	typ   byte
+	flags uint16
+}
+
+var typeNames = map[byte]string{
+	mysql.MYSQL_TYPE_DECIMAL: "DECIMAL", mysql.MYSQL_TYPE_TINY: "TINY", mysql.MYSQL_TYPE_SHORT: "SHORT",
+	mysql.MYSQL_TYPE_LONG: "LONG", mysql.MYSQL_TYPE_FLOAT: "FLOAT", mysql.MYSQL_TYPE_DOUBLE: "DOUBLE",
+	mysql.MYSQL_TYPE_NULL: "NULL", mysql.MYSQL_TYPE_TIMESTAMP: "TIMESTAMP", mysql.MYSQL_TYPE_LONGLONG: "LONGLONG",
+	mysql.MYSQL_TYPE_INT24: "INT24", mysql.MYSQL_TYPE_DATE: "DATE", mysql.MYSQL_TYPE_TIME: "TIME",
+	mysql.MYSQL_TYPE_DATETIME: "DATETIME", mysql.MYSQL_TYPE_YEAR: "YEAR", mysql.MYSQL_TYPE_NEWDATE: "NEWDATE",
+	mysql.MYSQL_TYPE_VARCHAR: "VARCHAR", mysql.MYSQL_TYPE_BIT: "BIT", mysql.MYSQL_TYPE_JSON: "JSON",
+	mysql.MYSQL_TYPE_NEWDECIMAL: "NEWDECIMAL", mysql.MYSQL_TYPE_ENUM: "ENUM", mysql.MYSQL_TYPE_SET: "SET",
+	mysql.MYSQL_TYPE_TINY_BLOB: "TINY_BLOB", mysql.MYSQL_TYPE_MEDIUM_BLOB: "MEDIUM_BLOB",
+	mysql.MYSQL_TYPE_LONG_BLOB: "LONG_BLOB", mysql.MYSQL_TYPE_BLOB: "BLOB", mysql.MYSQL_TYPE_VAR_STRING: "VAR_STRING",
+	mysql.MYSQL_TYPE_STRING: "STRING", mysql.MYSQL_TYPE_GEOMETRY: "GEOMETRY",
+}
+
+// SetCapture makes the tracker capture the columns and up to rows rows of
+// the first result set of each COM_QUERY and COM_STMT_EXECUTE, with at
+// most bytes bytes of values. Zero rows or bytes capture the columns only.
+// It must be called before the first Write.
+func (t *Tracker) SetCapture(rows, bytes int) {
+	t.captures = true
+	t.captureRows, t.captureBytes = rows, bytes
+	// rows longer than maxInspect would be cut short
+	t.scanner.limit = maxInspect + bytes
+}
+
+// startCapture is called at the column count of a result set.
+func (t *Tracker) startCapture(columns uint64) {
+	t.capturing = false
+	switch {
+	case !t.captures:
+		return
+	case t.cur.code != mysql.COM_QUERY && t.cur.code != mysql.COM_STMT_EXECUTE:
+		return
+	case t.capture != nil:
+		t.capture.Truncated = true
+		return
+	}
+	t.capture = &Capture{Columns: make([]Column, 0, min(columns, 4096))}
+	t.captureTypes = t.captureTypes[:0]
+	t.captureLeft = t.captureBytes
+	t.capturing = true
+}
+
+func (t *Tracker) captureColumn(head []byte) {
+	c, typ := parseColumn(head)
+	t.capture.Columns = append(t.capture.Columns, c)
+	t.captureTypes = append(t.captureTypes, typ)
+}
+
+func (t *Tracker) captureRow(pkt *Packet) {
+	c := t.capture
+	if len(c.Rows) >= t.captureRows || t.captureLeft <= 0 {
+		c.Truncated = true
+		return
+	}
+	var row [][]byte
+	var complete bool
+	if t.cur.code == mysql.COM_STMT_EXECUTE {
+		row, complete = binaryRow(pkt.Head, t.captureTypes)
+	} else {
+		row, complete = textRow(pkt.Head, len(c.Columns))
+	}
+	if !complete || len(pkt.Head) < pkt.Length {
+		c.Truncated = true
+	}
+	values := make([]*string, 0, len(row))
+	for _, v := range row {
+		if v == nil {
+			values = append(values, nil)
+			continue
+		}
+		if len(v) > t.captureLeft {
+			valid := utf8.Valid(v)
+			v = v[:t.captureLeft]
+			for valid && !utf8.Valid(v) {
+				// do not cut a character in two
+				v = v[:len(v)-1]
+			}
+			t.captureLeft = 0
+			c.Truncated = true
+		} else {
+			t.captureLeft -= len(v)
+		}
+		s := text(v)
+		values = append(values, &s)
+		if t.captureLeft <= 0 {
+			break
+		}
+	}
+	if len(values) < len(row) {
+		c.Truncated = true
+	}
+	c.Rows = append(c.Rows, values)
+}
+
+// text returns v as is if it is UTF-8, or as hex.
+func text(v []byte) string {
+	if utf8.Valid(v) {
+		return string(v)
+	}
+	return "0x" + hex.EncodeToString(v)
+}
+
+// parseColumn reads a Protocol::ColumnDefinition41 packet.
+func parseColumn(b []byte) (c Column, typ columnType) {
+	var name []byte
+	for i := 0; i < 6; i++ { // catalog, schema, table, org_table, name, org_name
+		s, n := lenencString(b)
+		if n == 0 {
+			return c, typ
+		}
+		if i == 4 {
+			name = s
+		}
+		b = b[n:]
+	}
+	c.Name = string(name)
+	// length of the fixed fields, character set, column length
+	if len(b) < 1+2+4+1+2 {
+		return c, typ
+	}
+	typ = columnType{typ: b[7], flags: binary.LittleEndian.Uint16(b[8:])}
+	if c.Type = typeNames[typ.typ]; len(c.Type) == 0 {
+		c.Type = fmt.Sprintf("TYPE_%d", typ.typ)
+	}
+	return c, typ
+}
+
+// lenencString decodes a length-encoded string. n is 0 if b is too short.
+func lenencString(b []byte) (s []byte, n int) {
+	l, k := lenencInt(b)
+	if k == 0 || uint64(len(b)-k) < l {
+		return nil, 0
+	}
+	return b[k : k+int(l)], k + int(l)
+}
+
+// textRow reads the values of a row of the text protocol. A value cut
+// short by the end of b is returned with complete false.
+func textRow(b []byte, columns int) (row [][]byte, complete bool) {
+	for i := 0; i < columns; i++ {
+		if len(b) == 0 {
+			return row, false
+		}
+		if b[0] == 0xfb {
+			row = append(row, nil)
+			b = b[1:]
+			continue
+		}
+		l, k := lenencInt(b)
+		if k == 0 {
+			return row, false
+		}
+		if uint64(len(b)-k) < l {
+			return append(row, b[k:]), false
+		}
+		row = append(row, b[k:k+int(l)])
+		b = b[k+int(l):]
+	}
+	return row, true
+}
+
+// binaryRow reads the values of a row of the binary protocol as text.
+func binaryRow(b []byte, columns []columnType) (row [][]byte, complete bool) {
+	bitmap := (len(columns) + 7 + 2) / 8
+	if len(b) < 1+bitmap {
+		return nil, false
+	}
+	nulls := b[1 : 1+bitmap]
+	b = b[1+bitmap:]
+	for i, c := range columns {
+		if nulls[(i+2)/8]&(1<<((i+2)%8)) != 0 {
+			row = append(row, nil)
+			continue
+		}
+		v, n := binaryValue(b, c)
+		if n == 0 {
+			return row, false
+		}
+		row = append(row, v)
+		b = b[n:]
+	}
+	return row, true
+}
+
+// binaryValue formats a value of the binary protocol. n is 0 if b is too short.
+func binaryValue(b []byte, c columnType) (v []byte, n int) {
+	unsigned := c.flags&mysql.UNSIGNED_FLAG != 0
+	integer := func(size int) ([]byte, int) {
+		if len(b) < size {
+			return nil, 0
+		}
+		var u uint64
+		for i := size - 1; i >= 0; i-- {
+			u = u<<8 | uint64(b[i])
+		}
+		if unsigned {
+			return strconv.AppendUint(nil, u, 10), size
+		}
+		shift := 64 - 8*size
+		return strconv.AppendInt(nil, int64(u<<shift)>>shift, 10), size
+	}
+	switch c.typ {
+	case mysql.MYSQL_TYPE_TINY:
+		return integer(1)
+	case mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_YEAR:
+		return integer(2)
+	case mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG:
+		return integer(4)
+	case mysql.MYSQL_TYPE_LONGLONG:
+		return integer(8)
+	case mysql.MYSQL_TYPE_FLOAT:
+		if len(b) < 4 {
+			return nil, 0
+		}
+		return strconv.AppendFloat(nil, float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 'g', -1, 32), 4
+	case mysql.MYSQL_TYPE_DOUBLE:
+		if len(b) < 8 {
+			return nil, 0
+		}
+		return strconv.AppendFloat(nil, math.Float64frombits(binary.LittleEndian.Uint64(b)), 'g', -1, 64), 8
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_TIMESTAMP:
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return nil, 0
+		}
+		return []byte(formatDatetime(b[1:1+b[0]], c.typ == mysql.MYSQL_TYPE_DATE)), 1 + int(b[0])
+	case mysql.MYSQL_TYPE_TIME:
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return nil, 0
+		}
+		return []byte(formatTime(b[1 : 1+b[0]])), 1 + int(b[0])
+	}
+	// strings, decimals, blobs, JSON, BIT, ...
+	return lenencString(b)
+}
+
+func formatDatetime(b []byte, date bool) string {
+	var year, month, day, hour, minute, second, micro int
+	if len(b) >= 4 {
+		year, month, day = int(binary.LittleEndian.Uint16(b)), int(b[2]), int(b[3])
+	}
+	if len(b) >= 7 {
+		hour, minute, second = int(b[4]), int(b[5]), int(b[6])
+	}
+	if len(b) >= 11 {
+		micro = int(binary.LittleEndian.Uint32(b[7:]))
+	}
+	s := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if date {
+		return s
+	}
+	s += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	if micro > 0 {
+		s += fmt.Sprintf(".%06d", micro)
+	}
+	return s
+}
+
+func formatTime(b []byte) string {
+	sign := ""
+	var days, hour, minute, second, micro int
+	if len(b) >= 8 {
+		if b[0] == 1 {
+			sign = "-"
+		}
+		days = int(binary.LittleEndian.Uint32(b[1:]))
+		hour, minute, second = int(b[5]), int(b[6]), int(b[7])
+	}
+	if len(b) >= 12 {
+		micro = int(binary.LittleEndian.Uint32(b[8:]))
+	}
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, days*24+hour, minute, second)
+	if micro > 0 {
+		s += fmt.Sprintf(".%06d", micro)
+	}
+	return s
+}
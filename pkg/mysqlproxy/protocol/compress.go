@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithms of the compressed protocol.
+const (
+	CompressNone = iota
+	CompressZlib
+	CompressZstd
+)
+
+const (
+	frameHeaderSize = 7  // compressed length, sequence id, uncompressed length
+	minCompressSize = 50 // smaller payloads are sent as they are, like mysql does
+	maxFrameSize    = 1<<24 - 1
+)
+
+// Compression returns the algorithm of a session that negotiated
+// capability. CLIENT_COMPRESS takes precedence, like in the server.
+func Compression(capability uint32) int {
+	switch {
+	case capability&mysql.CLIENT_COMPRESS != 0:
+		return CompressZlib
+	case capability&mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM != 0:
+		return CompressZstd
+	}
+	return CompressNone
+}
+
+// CompressionName returns the name of algorithm, e.g. "zlib".
+func CompressionName(algorithm int) string {
+	switch algorithm {
+	case CompressZlib:
+		return "zlib"
+	case CompressZstd:
+		return "zstd"
+	}
+	return "none"
+}
+
+// zstd coders for DecodeAll and EncodeAll, each used by one session at a
+// time, so that sessions do not wait for each other.
+var (
+	zstdDecoders = sync.Pool{New: func() any {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(2*maxFrameSize))
+		return d
+	}}
+	zstdEncoders = sync.Pool{New: func() any {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return e
+	}}
+)
+
+// Compressed is one side of a session that uses the compressed protocol.
+// Frames are numbered apart from the packets they carry: the client starts
+// each command at 0 and both sides number their frames in turn, so the
+// frames read and written on a side share the sequence id.
+type Compressed struct {
+	algorithm int
+	seq       atomic.Uint32 // of the next frame
+}
+
+func NewCompressed(algorithm int) *Compressed {
+	return &Compressed{algorithm: algorithm}
+}
+
+// Reset restarts the numbering when the proxy sends a command.
+func (c *Compressed) Reset() { c.seq.Store(0) }
+
+// NewDecompressor returns a writer that takes the frames of the side and
+// writes the packets they carry to w. A malformed frame is an error, so
+// that no packet reaches w unread.
+func (c *Compressed) NewDecompressor(w io.Writer) io.Writer {
+	return &decompressor{c: c, w: w}
+}
+
+// NewCompressor returns a writer that sends what is written to it to w in
+// frames of the side, one or more per Write.
+func (c *Compressed) NewCompressor(w io.Writer) io.Writer {
+	return &compressor{c: c, w: w}
+}
+
+type decompressor struct {
+	c   *Compressed
+	w   io.Writer
+	in  []byte // frame read in part
+	out []byte
+}
+
+func (d *decompressor) Write(p []byte) (int, error) {
+	d.in = append(d.in, p...)
+	for len(d.in) >= frameHeaderSize {
+		size := int(uint32(d.in[0]) | uint32(d.in[1])<<8 | uint32(d.in[2])<<16)
+		if len(d.in) < frameHeaderSize+size {
+			break
+		}
+		seq := d.in[3]
+		plain := int(uint32(d.in[4]) | uint32(d.in[5])<<8 | uint32(d.in[6])<<16)
+		payload := d.in[frameHeaderSize : frameHeaderSize+size]
+		d.c.seq.Store(uint32(seq) + 1)
+		if plain == 0 {
+			// sent as it is
+			if _, err := d.w.Write(payload); err != nil {
+				return 0, err
+			}
+		} else {
+			var err error
+			if d.out, err = d.c.decompress(d.out[:0], payload, plain); err != nil {
+				return 0, fmt.Errorf("compressed frame %d: %w", seq, err)
+			}
+			if _, err := d.w.Write(d.out); err != nil {
+				return 0, err
+			}
+		}
+		d.in = d.in[frameHeaderSize+size:]
+	}
+	if len(d.in) == 0 {
+		d.in = d.in[:0:0] // do not keep a large frame
+	}
+	return len(p), nil
+}
+
+func (c *Compressed) decompress(dst, payload []byte, plain int) ([]byte, error) {
+	switch c.algorithm {
+	case CompressZlib:
+		r, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return dst, err
+		}
+		buf := bytes.NewBuffer(dst)
+		if _, err := io.Copy(buf, io.LimitReader(r, int64(plain)+1)); err != nil {
+			return dst, err
+		}
+		dst = buf.Bytes()
+	case CompressZstd:
+		d := zstdDecoders.Get().(*zstd.Decoder)
+		var err error
+		dst, err = d.DecodeAll(payload, dst)
+		zstdDecoders.Put(d)
+		if err != nil {
+			return dst, err
+		}
+	default:
+		return dst, fmt.Errorf("unknown compression %d", c.algorithm)
+	}
+	if len(dst) != plain {
+		return dst, fmt.Errorf("decompressed %d bytes, want %d", len(dst), plain)
+	}
+	return dst, nil
+}
+
+type compressor struct {
+	c   *Compressed
+	w   io.Writer
+	buf bytes.Buffer
+	zw  *zlib.Writer
+	out []byte
+}
+
+func (e *compressor) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+maxFrameSize)]
+		if err := e.frame(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (e *compressor) frame(p []byte) error {
+	payload, plain := p, 0
+	if len(p) >= minCompressSize {
+		compressed, err := e.compress(p)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(p) {
+			payload, plain = compressed, len(p)
+		}
+	}
+	seq := e.c.seq.Add(1) - 1
+	h := [frameHeaderSize]byte{
+		byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16),
+		byte(seq),
+		byte(plain), byte(plain >> 8), byte(plain >> 16),
+	}
+	e.out = append(append(e.out[:0], h[:]...), payload...)
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+func (e *compressor) compress(p []byte) ([]byte, error) {
+	switch e.c.algorithm {
+	case CompressZlib:
+		e.buf.Reset()
+		if e.zw == nil {
+			e.zw = zlib.NewWriter(&e.buf)
+		} else {
+			e.zw.Reset(&e.buf)
+		}
+		if _, err := e.zw.Write(p); err != nil {
+			return nil, err
+		}
+		if err := e.zw.Close(); err != nil {
+			return nil, err
+		}
+		return e.buf.Bytes(), nil
+	case CompressZstd:
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		defer zstdEncoders.Put(enc)
+		return enc.EncodeAll(p, e.buf.Bytes()[:0]), nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", e.c.algorithm)
+}
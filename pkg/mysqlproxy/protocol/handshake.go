@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// Handshake is what a server tells in its initial handshake packet.
+type Handshake struct {
+	Version      string // e.g. "8.0.36"
+	ConnectionID uint32
+	Capability   uint32
+	Collation    uint8
+	Status       uint16
+	AuthPlugin   string
+}
+
+// ParseHandshake reads the payload of an initial handshake packet of
+// protocol version 10. An error packet, e.g. of a blocked host, is an error
+// with its message.
+func ParseHandshake(payload []byte) (Handshake, error) {
+	var h Handshake
+	if len(payload) == 0 {
+		return h, errors.New("handshake: empty packet")
+	}
+	switch payload[0] {
+	case 10:
+	case 0xff:
+		if len(payload) < 3 {
+			return h, errors.New("handshake: short error packet")
+		}
+		return h, fmt.Errorf("handshake: ERROR %d: %s", binary.LittleEndian.Uint16(payload[1:]), payload[3:])
+	default:
+		return h, fmt.Errorf("handshake: protocol version %d", payload[0])
+	}
+	b := payload[1:]
+	end := bytes.IndexByte(b, 0)
+	if end < 0 {
+		return h, errShortHandshake
+	}
+	h.Version = string(b[:end])
+	b = b[end+1:]
+	// connection id, auth-plugin-data-part-1, filler, capability_flags_1
+	if len(b) < 4+8+1+2 {
+		return h, errShortHandshake
+	}
+	h.ConnectionID = binary.LittleEndian.Uint32(b)
+	h.Capability = uint32(binary.LittleEndian.Uint16(b[13:]))
+	b = b[15:]
+	if len(b) == 0 {
+		return h, nil
+	}
+	// character_set, status_flags, capability_flags_2, auth_plugin_data_len, reserved
+	if len(b) < 1+2+2+1+10 {
+		return h, errShortHandshake
+	}
+	h.Collation = b[0]
+	h.Status = binary.LittleEndian.Uint16(b[1:])
+	h.Capability |= uint32(binary.LittleEndian.Uint16(b[3:])) << 16
+	authLen := int(b[5])
+	b = b[16:]
+	if n := max(13, authLen-8); len(b) >= n {
+		// auth-plugin-data-part-2, then the plugin name
+		h.AuthPlugin = string(bytes.TrimRight(b[n:], "\x00"))
+	}
+	return h, nil
+}
+
+var errShortHandshake = errors.New("handshake: packet too short")
+
+// HandshakeResponse returns the payload of the response to the handshake h
+// of a client logging in as user without a password.
+func HandshakeResponse(h Handshake, user string) []byte {
+	capability := uint32(mysql.CLIENT_PROTOCOL_41|mysql.CLIENT_SECURE_CONNECTION|mysql.CLIENT_LONG_PASSWORD|mysql.CLIENT_PLUGIN_AUTH) & h.Capability
+	collation := h.Collation
+	if collation == 0 {
+		collation = mysql.DEFAULT_COLLATION_ID
+	}
+	b := binary.LittleEndian.AppendUint32(nil, capability)
+	b = binary.LittleEndian.AppendUint32(b, 0) // max packet size, the server's
+	b = append(b, collation)
+	b = append(b, make([]byte, 23)...)
+	b = append(append(b, user...), 0)
+	b = append(b, 0) // empty auth response
+	if capability&mysql.CLIENT_PLUGIN_AUTH != 0 {
+		b = append(append(b, h.AuthPlugin...), 0)
+	}
+	return b
+}
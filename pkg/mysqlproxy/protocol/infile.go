@@ -0,0 +1,8 @@
+package protocol
+
+// Infile is the file a client sent for LOAD DATA LOCAL INFILE.
+type Infile struct {
+	Name   string `json:"name"` // as requested by the server
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"` // hex, of the content
+}
@@ -0,0 +1,570 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// stream builds wire packets with consecutive sequence ids.
+func stream(payloads ...[]byte) []byte {
+	b := []byte{}
+	for i, p := range payloads {
+		b = append(b, byte(len(p)), byte(len(p)>>8), byte(len(p)>>16), byte(i+1))
+		b = append(b, p...)
+	}
+	return b
+}
+
+var (
+	okPacket       = []byte{0x00, 0x02, 0x00, 0x02, 0x00, 0x00, 0x00}
+	okMorePacket   = []byte{0x00, 0x01, 0x00, 0x0a, 0x00, 0x00, 0x00}
+	eofPacket      = []byte{0xfe, 0x00, 0x00, 0x02, 0x00}
+	eofMorePacket  = []byte{0xfe, 0x00, 0x00, 0x0a, 0x00}
+	okEOFPacket    = []byte{0xfe, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+	eofCursor      = []byte{0xfe, 0x00, 0x00, 0x42, 0x00}             // SERVER_STATUS_CURSOR_EXISTS
+	okEOFCursor    = []byte{0xfe, 0x00, 0x00, 0x42, 0x00, 0x00, 0x00} // SERVER_STATUS_CURSOR_EXISTS
+	eofLastRow     = []byte{0xfe, 0x00, 0x00, 0xc2, 0x00}             // and SERVER_STATUS_LAST_ROW_SENT
+	errPacket      = append([]byte{0xff, 0x7a, 0x04, '#', '4', '2', 'S', '0', '2'}, "Table 'db.t' doesn't exist"...)
+	columnCount    = []byte{0x02}
+	columnDef      = append([]byte{0x03}, "def"...)
+	row            = []byte{0x01, '1', 0x01, 'a'}
+	fetchedRow     = []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 'a'}
+	prepareOK      = []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+	localInfile    = append([]byte{0xfb}, "/tmp/data.csv"...)
+	statistics     = []byte("Uptime: 100  Threads: 1")
+	columnCountBig = []byte{0xfc, 0x01, 0x01} // 257
+)
+
+func TestTracker(t *testing.T) {
+	testcase := []struct {
+		name         string
+		deprecateEOF bool
+		code         byte
+		response     []byte
+		want         Result
+	}{
+		{
+			name:     "ok",
+			code:     0x03,
+			response: stream(okPacket),
+			want:     Result{Affected: 2, Status: 2},
+		},
+		{
+			name:     "error",
+			code:     0x03,
+			response: stream(errPacket),
+			want:     Result{Err: "ERROR 1146 (42S02): Table 'db.t' doesn't exist"},
+		},
+		{
+			name:     "result set",
+			code:     0x03,
+			response: stream(columnCount, columnDef, columnDef, eofPacket, row, row, row, eofPacket),
+			want:     Result{Rows: 3, Status: 2},
+		},
+		{
+			name:         "result set without EOF",
+			deprecateEOF: true,
+			code:         0x03,
+			response:     stream(columnCount, columnDef, columnDef, row, row, okEOFPacket),
+			want:         Result{Rows: 2, Status: 2},
+		},
+		{
+			name:     "error in rows",
+			code:     0x03,
+			response: stream(columnCount, columnDef, columnDef, eofPacket, row, errPacket),
+			want:     Result{Rows: 1, Err: "ERROR 1146 (42S02): Table 'db.t' doesn't exist"},
+		},
+		{
+			name:     "multiple results",
+			code:     0x03,
+			response: stream(okMorePacket, columnCount, columnDef, columnDef, eofPacket, row, eofMorePacket, okPacket),
+			want: Result{Rows: 1, Affected: 3, Parts: []Part{
+				{Affected: 1, Duration: 1000}, {ResultSet: true, Rows: 1}, {Affected: 2},
+			}, Status: 2},
+		},
+		{
+			name:     "error in multiple results",
+			code:     0x03,
+			response: stream(okMorePacket, errPacket),
+			want: Result{Affected: 1, Err: "ERROR 1146 (42S02): Table 'db.t' doesn't exist", Parts: []Part{
+				{Affected: 1, Duration: 1000}, {Err: "ERROR 1146 (42S02): Table 'db.t' doesn't exist"},
+			}},
+		},
+		{
+			name:     "cursor",
+			code:     0x17,
+			response: stream(columnCount, columnDef, columnDef, eofCursor),
+			want:     Result{Status: 0x42},
+		},
+		{
+			name:         "cursor without EOF",
+			deprecateEOF: true,
+			code:         0x17,
+			response:     stream(columnCount, columnDef, columnDef, okEOFCursor),
+			want:         Result{Status: 0x42},
+		},
+		{
+			name:     "fetch",
+			code:     0x1c,
+			response: stream(fetchedRow, fetchedRow, eofCursor),
+			want:     Result{Rows: 2, Status: 0x42},
+		},
+		{
+			name:     "fetch last row",
+			code:     0x1c,
+			response: stream(fetchedRow, eofLastRow),
+			want:     Result{Rows: 1, Status: 0xc2},
+		},
+		{
+			name:     "fetch error",
+			code:     0x1c,
+			response: stream(errPacket),
+			want:     Result{Err: "ERROR 1146 (42S02): Table 'db.t' doesn't exist"},
+		},
+		{
+			name:     "load data local infile",
+			code:     0x03,
+			response: append(stream(localInfile), stream(okPacket)...),
+			want:     Result{Affected: 2, Infile: "/tmp/data.csv", Status: 2},
+		},
+		{
+			name:     "prepare",
+			code:     0x16,
+			response: stream(prepareOK, columnDef, eofPacket, columnDef, columnDef, eofPacket),
+			want:     Result{Statement: 1},
+		},
+		{
+			name:         "prepare without EOF",
+			deprecateEOF: true,
+			code:         0x16,
+			response:     stream(prepareOK, columnDef, columnDef, columnDef),
+			want:         Result{Statement: 1},
+		},
+		{
+			name:     "field list",
+			code:     0x04,
+			response: stream(columnDef, columnDef, eofPacket),
+			want:     Result{Rows: 2},
+		},
+		{
+			name:     "statistics",
+			code:     0x09,
+			response: stream(statistics),
+		},
+		{
+			name:     "ping",
+			code:     0x0e,
+			response: stream(okPacket),
+			want:     Result{Affected: 2},
+		},
+		{
+			name:     "many columns",
+			code:     0x03,
+			response: stream(append([][]byte{columnCountBig}, append(bytes.Split(bytes.Repeat([]byte("x"), 256), []byte{}), []byte("x"), eofPacket, row, eofPacket)...)...),
+			want:     Result{Rows: 1, Status: 2},
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			results := []Result{}
+			tr := NewTracker(tc.deprecateEOF, func(r Result) { results = append(results, r) })
+			now := time.Unix(1700000000, 0)
+			tr.now = func() time.Time { return now }
+			tr.Expect(7, tc.code)
+			now = now.Add(time.Millisecond)
+			// write byte by byte to exercise the scanner
+			for i := range tc.response {
+				tr.Write(tc.response[i : i+1])
+			}
+			tc.want.Seq = 7
+			tc.want.Command = tc.code
+			tc.want.Duration = time.Millisecond
+			if diff := cmp.Diff([]Result{tc.want}, results); diff != "" {
+				t.Errorf("results mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTrackerSequence(t *testing.T) {
+	results := []Result{}
+	tr := NewTracker(false, func(r Result) { results = append(results, r) })
+	tr.Expect(1, 0x19) // COM_STMT_CLOSE has no response
+	tr.Expect(2, 0x03)
+	tr.Expect(3, 0x0e)
+	tr.Write(append(stream(errPacket), stream(okPacket)...))
+	tr.Write(stream(okPacket)) // no command pending
+	got := []uint32{}
+	for _, r := range results {
+		got = append(got, r.Seq)
+	}
+	if diff := cmp.Diff([]uint32{2, 3}, got); diff != "" {
+		t.Errorf("seq mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTrackerPipelined(t *testing.T) {
+	results := []Result{}
+	tr := NewTracker(false, func(r Result) { results = append(results, r) })
+	want := []uint32{}
+	for seq := uint32(1); seq <= 100; seq++ {
+		tr.Expect(seq, 0x0e)
+		want = append(want, seq)
+	}
+	for range want {
+		tr.Write(stream(okPacket))
+	}
+	got := []uint32{}
+	for _, r := range results {
+		got = append(got, r.Seq)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("seq mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestScanner(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 5000)
+	data := stream([]byte{}, []byte("abc"), big)
+	s := &Scanner{}
+	got := []Packet{}
+	for len(data) > 0 {
+		n := min(len(data), 7)
+		s.Scan(data[:n], func(pkt *Packet) {
+			got = append(got, Packet{Seq: pkt.Seq, Length: pkt.Length, Head: bytes.Clone(pkt.Head)})
+		})
+		data = data[n:]
+	}
+	want := []Packet{
+		{Seq: 1, Length: 0, Head: []byte{}},
+		{Seq: 2, Length: 3, Head: []byte("abc")},
+		{Seq: 3, Length: 5000, Head: big[:maxInspect]},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("packets mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// colDef builds a column definition of a column of table t.
+func colDef(name string, typ byte, flags uint16) []byte {
+	b := []byte{}
+	for _, s := range []string{"def", "db", "t", "t", name, name} {
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return append(b, 0x0c, 0x21, 0x00, 0xff, 0x00, 0x00, 0x00, typ, byte(flags), byte(flags>>8), 0x00, 0x00, 0x00)
+}
+
+func TestCapture(t *testing.T) {
+	str := func(s string) *string { return &s }
+	idDef := colDef("id", 0x03, 0)        // LONG
+	nameDef := colDef("name", 0xfd, 0)    // VAR_STRING
+	bigDef := colDef("n", 0x08, 32)       // LONGLONG UNSIGNED
+	dateDef := colDef("created", 0x0c, 0) // DATETIME
+	textRow := func(values ...string) []byte {
+		b := []byte{}
+		for _, v := range values {
+			if v == "NULL" {
+				b = append(b, 0xfb)
+				continue
+			}
+			b = append(b, byte(len(v)))
+			b = append(b, v...)
+		}
+		return b
+	}
+	testcase := []struct {
+		name     string
+		code     byte
+		rows     int
+		bytes    int
+		response []byte
+		want     *Capture
+	}{
+		{
+			name:     "text rows",
+			code:     0x03,
+			rows:     10,
+			bytes:    100,
+			response: stream([]byte{0x02}, idDef, nameDef, eofPacket, textRow("1", "alice"), textRow("2", "NULL"), eofPacket),
+			want: &Capture{
+				Columns: []Column{{Name: "id", Type: "LONG"}, {Name: "name", Type: "VAR_STRING"}},
+				Rows:    [][]*string{{str("1"), str("alice")}, {str("2"), nil}},
+			},
+		},
+		{
+			name:     "row limit",
+			code:     0x03,
+			rows:     1,
+			bytes:    100,
+			response: stream([]byte{0x02}, idDef, nameDef, eofPacket, textRow("1", "alice"), textRow("2", "bob"), eofPacket),
+			want: &Capture{
+				Columns:   []Column{{Name: "id", Type: "LONG"}, {Name: "name", Type: "VAR_STRING"}},
+				Rows:      [][]*string{{str("1"), str("alice")}},
+				Truncated: true,
+			},
+		},
+		{
+			name:     "byte limit",
+			code:     0x03,
+			rows:     10,
+			bytes:    4,
+			response: stream([]byte{0x02}, idDef, nameDef, eofPacket, textRow("1", "alice"), textRow("2", "bob"), eofPacket),
+			want: &Capture{
+				Columns:   []Column{{Name: "id", Type: "LONG"}, {Name: "name", Type: "VAR_STRING"}},
+				Rows:      [][]*string{{str("1"), str("ali")}},
+				Truncated: true,
+			},
+		},
+		{
+			name:  "binary rows",
+			code:  0x17,
+			rows:  10,
+			bytes: 100,
+			response: stream([]byte{0x04}, idDef, nameDef, bigDef, dateDef, eofPacket,
+				// id=-2, name=NULL, n=2^64-1, created=2024-01-02 03:04:05
+				append([]byte{0x00, 0x08, 0xfe, 0xff, 0xff, 0xff}, append(bytes.Repeat([]byte{0xff}, 8), 7, 0xe8, 0x07, 1, 2, 3, 4, 5)...),
+				eofPacket),
+			want: &Capture{
+				Columns: []Column{{Name: "id", Type: "LONG"}, {Name: "name", Type: "VAR_STRING"}, {Name: "n", Type: "LONGLONG"}, {Name: "created", Type: "DATETIME"}},
+				Rows:    [][]*string{{str("-2"), nil, str("18446744073709551615"), str("2024-01-02 03:04:05")}},
+			},
+		},
+		{
+			name:     "columns only",
+			code:     0x03,
+			response: stream([]byte{0x01}, idDef, eofPacket, textRow("1"), eofPacket),
+			want: &Capture{
+				Columns:   []Column{{Name: "id", Type: "LONG"}},
+				Truncated: true,
+			},
+		},
+		{
+			name:     "no result set",
+			code:     0x03,
+			rows:     10,
+			bytes:    100,
+			response: stream(okPacket),
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			results := []Result{}
+			tr := NewTracker(false, func(r Result) { results = append(results, r) })
+			tr.SetCapture(tc.rows, tc.bytes)
+			tr.Expect(1, tc.code)
+			tr.Write(tc.response)
+			if len(results) != 1 {
+				t.Fatalf("results:%d want 1", len(results))
+			}
+			if diff := cmp.Diff(tc.want, results[0].Capture); diff != "" {
+				t.Errorf("capture mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	query := append([]byte{0x03}, bytes.Repeat([]byte("select * from t where id = 1 union all "), 3000)...)
+	data := append(stream([]byte{0x0e}), stream(query, okPacket)...)
+	for _, algorithm := range []int{CompressZlib, CompressZstd} {
+		t.Run(CompressionName(algorithm), func(t *testing.T) {
+			sender, receiver := NewCompressed(algorithm), NewCompressed(algorithm)
+			frames := &bytes.Buffer{}
+			w := sender.NewCompressor(frames)
+			for _, p := range [][]byte{data[:5], data[5:]} {
+				if _, err := w.Write(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if frames.Len() >= len(data) {
+				t.Errorf("frames of %d bytes for %d bytes", frames.Len(), len(data))
+			}
+			got := &bytes.Buffer{}
+			r := receiver.NewDecompressor(got)
+			for b := frames.Bytes(); len(b) > 0; b = b[min(len(b), 1000):] {
+				// frames are read in pieces
+				if _, err := r.Write(b[:min(len(b), 1000)]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(data, got.Bytes()) {
+				t.Errorf("decompressed %d bytes, want %d", got.Len(), len(data))
+			}
+			// the small packet is sent as it is, then the rest in one frame
+			if s, r := sender.seq.Load(), receiver.seq.Load(); s != 2 || r != 2 {
+				t.Errorf("next sequence ids %d and %d, want 2", s, r)
+			}
+			receiver.Reset()
+			if s := receiver.seq.Load(); s != 0 {
+				t.Errorf("sequence id after reset %d", s)
+			}
+		})
+	}
+	t.Run("malformed", func(t *testing.T) {
+		frame := []byte{4, 0, 0, 0, 100, 0, 0, 1, 2, 3, 4}
+		got := &bytes.Buffer{}
+		if _, err := NewCompressed(CompressZlib).NewDecompressor(got).Write(frame); err == nil {
+			t.Error("no error for a malformed frame")
+		}
+		if got.Len() > 0 {
+			t.Errorf("%d bytes written for a malformed frame", got.Len())
+		}
+	})
+}
+
+func TestQueryAttributes(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	attr := func(name string) []byte { // VAR_STRING named name
+		return append([]byte{0xfd, 0x00, byte(len(name))}, name...)
+	}
+	value := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	query := []byte("SELECT 1")
+	execHead := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x00}
+	plainHead := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	id := []byte{0x03, 0x00} // LONG
+	testcase := []struct {
+		name    string
+		execute bool
+		types   []Param
+		long    map[uint16]bool
+		payload []byte
+		want    map[string]string
+		plain   []byte
+		bound   []Param
+	}{
+		{
+			name:    "query without attributes",
+			payload: cat([]byte{0x03, 0x00, 0x01}, query),
+			plain:   cat([]byte{0x03}, query),
+		},
+		{
+			name:    "query",
+			payload: cat([]byte{0x03, 0x02, 0x01, 0x02, 0x01}, attr("traceparent"), attr("empty"), value(traceparent), query),
+			want:    map[string]string{"traceparent": traceparent},
+			plain:   cat([]byte{0x03}, query),
+		},
+		{
+			name:    "query unsigned",
+			payload: cat([]byte{0x03, 0x01, 0x01, 0x00, 0x01, 0x08, 0x80, 0x03}, []byte("tid"), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, query),
+			want:    map[string]string{"tid": "18446744073709551615"},
+			plain:   cat([]byte{0x03}, query),
+		},
+		{
+			name:    "execute",
+			execute: true,
+			payload: cat(execHead, []byte{0x02, 0x00, 0x01}, id, []byte{0x00}, attr("traceparent"), []byte{0x2a, 0x00, 0x00, 0x00}, value(traceparent)),
+			want:    map[string]string{"traceparent": traceparent},
+			plain:   cat(plainHead, []byte{0x00, 0x01, 0x03, 0x00, 0x2a, 0x00, 0x00, 0x00}),
+			bound:   []Param{{Type: 0x03}, {Type: 0xfd, Name: "traceparent"}},
+		},
+		{
+			name:    "execute bound before",
+			execute: true,
+			types:   []Param{{Type: 0x03}, {Type: 0xfd, Name: "traceparent"}},
+			payload: cat(execHead, []byte{0x02, 0x01, 0x00}, value(traceparent)),
+			want:    map[string]string{"traceparent": traceparent},
+			plain:   cat(plainHead, []byte{0x01, 0x00}),
+			bound:   []Param{{Type: 0x03}, {Type: 0xfd, Name: "traceparent"}},
+		},
+		{
+			name:    "execute long data",
+			execute: true,
+			long:    map[uint16]bool{0: true},
+			payload: cat(execHead, []byte{0x02, 0x00, 0x01}, []byte{0xfc, 0x00, 0x00}, attr("traceparent"), value(traceparent)),
+			want:    map[string]string{"traceparent": traceparent},
+			plain:   cat(plainHead, []byte{0x00, 0x01, 0xfc, 0x00}),
+			bound:   []Param{{Type: 0xfc}, {Type: 0xfd, Name: "traceparent"}},
+		},
+		{
+			name:    "execute without parameters",
+			execute: true,
+			payload: execHead,
+			plain:   plainHead,
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			var attrs map[string]string
+			var plain []byte
+			var bound []Param
+			var err error
+			if tc.execute {
+				attrs, plain, bound, err = ParseExecute(tc.payload, tc.types, tc.long)
+			} else {
+				attrs, plain, err = ParseQuery(tc.payload)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, attrs); diff != "" {
+				t.Errorf("attributes mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.plain, plain); diff != "" {
+				t.Errorf("plain mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.bound, bound); diff != "" {
+				t.Errorf("bound mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+	if _, _, _, err := ParseExecute(cat(execHead, []byte{0x01, 0x00, 0x00}), nil, nil); err == nil {
+		t.Error("execute without types: no error")
+	}
+	if _, _, err := ParseQuery([]byte{0x03, 0x01, 0x01, 0x00, 0x01, 0xfd, 0x00}); err == nil {
+		t.Error("short query: no error")
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	handshake := append([]byte{10}, "8.0.36\x00"...)
+	handshake = append(handshake, 0x2a, 0x00, 0x00, 0x00) // connection id
+	handshake = append(handshake, "abcdefgh\x00"...)      // auth-plugin-data-part-1, filler
+	handshake = append(handshake, 0xff, 0xff, 0xff, 0x02, 0x00, 0xff, 0xdf, 0x15)
+	handshake = append(handshake, make([]byte, 10)...)
+	handshake = append(handshake, "ijklmnopqrst\x00caching_sha2_password\x00"...)
+	testcase := []struct {
+		name    string
+		payload []byte
+		want    Handshake
+		err     string
+	}{
+		{
+			name:    "mysql 8.0",
+			payload: handshake,
+			want:    Handshake{Version: "8.0.36", ConnectionID: 42, Capability: 0xdfffffff, Collation: 0xff, Status: 2, AuthPlugin: "caching_sha2_password"},
+		},
+		{
+			name:    "error",
+			payload: append([]byte{0xff, 0x69, 0x04}, "Host '10.0.0.1' is blocked"...),
+			err:     "handshake: ERROR 1129: Host '10.0.0.1' is blocked",
+		},
+		{
+			name:    "short",
+			payload: handshake[:12],
+			err:     "handshake: packet too short",
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := ParseHandshake(tc.payload)
+			if len(tc.err) > 0 {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("err:%v want:%s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, h); diff != "" {
+				t.Errorf("handshake mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
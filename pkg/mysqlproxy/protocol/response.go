@@ -0,0 +1,395 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// Result summarizes the response of the target to one command.
+type Result struct {
+	Seq      uint32 // sequence number of the command in the session
+	Command  byte
+	Duration time.Duration // from sending the command to the end of the response
+	Rows     uint64        // rows returned
+	Affected uint64        // rows affected
+	Err      string        // "ERROR 1146 (42S02): Table 'db.t' doesn't exist"
+	Capture  *Capture      // nil unless captured, see SetCapture
+	Infile   string        // file requested for LOAD DATA LOCAL INFILE, if any
+	Status   uint16        // server status flags of the packet that ends the response
+	// id of the statement prepared by a COM_STMT_PREPARE
+	Statement uint32
+	// results in order if the response holds more than one, e.g. of a
+	// multi-statement query or a stored procedure
+	Parts []Part
+}
+
+// Part is one result of a response that holds several: a result set or
+// the OK or ERR that ends a statement.
+type Part struct {
+	ResultSet bool   `json:"result_set,omitempty"`
+	Rows      uint64 `json:"rows,omitempty"`
+	Affected  uint64 `json:"affected,omitempty"`
+	Err       string `json:"err,omitempty"`
+	Duration  int64  `json:"duration_us,omitempty"` // microseconds since the previous result
+}
+
+type command struct {
+	seq   uint32
+	code  byte
+	start time.Time
+}
+
+// states of the response of a command
+const (
+	stFirst      = iota // OK, ERR, LOCAL INFILE request or the column count
+	stColumns           // column definitions of a result set
+	stColumnsEOF        // EOF after the column definitions
+	stRows              // rows until EOF
+	stPrepare           // COM_STMT_PREPARE OK
+	stDefs              // parameter and column definitions of a prepared statement
+	stFieldList         // column definitions until EOF
+	stSingle            // any one packet, e.g. COM_STATISTICS
+	stOK                // OK, ERR or EOF
+	stFetch             // rows of a cursor until EOF
+	stStream            // replication stream, never ends
+)
+
+// Tracker follows the responses of the target on the target to client
+// stream and reports a Result for each command announced with Expect.
+//
+// Expect and Write may be called from different goroutines, but each of
+// them from one goroutine only.
+type Tracker struct {
+	deprecateEOF bool
+	onResult     func(Result)
+	now          func() time.Time
+	scanner      Scanner
+
+	mu      sync.Mutex
+	pending []command // announced by Expect, in order, never dropped
+
+	cur       *command
+	state     int
+	left      uint64 // column or definition packets left
+	rows      uint64
+	affected  uint64
+	infile    string
+	endStatus uint16 // server status flags of the end of the response
+	statement uint32 // prepared by the current command
+	parts     []Part
+	part      Part      // counts of the current result
+	partEnd   time.Time // of the previous result
+
+	captures     bool // see SetCapture
+	captureRows  int
+	captureBytes int
+	capture      *Capture // of the current command
+	captureTypes []columnType
+	capturing    bool // in the captured result set
+	captureLeft  int  // bytes of values left
+}
+
+// NewTracker returns a Tracker for a session that negotiated
+// CLIENT_DEPRECATE_EOF or not. onResult is called from Write.
+func NewTracker(deprecateEOF bool, onResult func(Result)) *Tracker {
+	return &Tracker{
+		deprecateEOF: deprecateEOF,
+		onResult:     onResult,
+		now:          time.Now,
+	}
+}
+
+// ExpectsResponse reports whether the server answers the command.
+func ExpectsResponse(code byte) bool {
+	switch code {
+	case mysql.COM_QUIT, mysql.COM_STMT_CLOSE, mysql.COM_STMT_SEND_LONG_DATA:
+		return false
+	}
+	return true
+}
+
+// Expect announces a command sent to the target. It must be called before
+// the command is written to the target, so that the response cannot be
+// seen first.
+func (t *Tracker) Expect(seq uint32, code byte) {
+	if !ExpectsResponse(code) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// a client that does not wait for responses queues several
+	t.pending = append(t.pending, command{seq: seq, code: code, start: t.now()})
+}
+
+// next takes the oldest command waiting for its response.
+func (t *Tracker) next() (command, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return command{}, false
+	}
+	c := t.pending[0]
+	// shift rather than reslice to reuse the array; rarely more than one is pending
+	n := copy(t.pending, t.pending[1:])
+	t.pending = t.pending[:n]
+	return c, true
+}
+
+// Write inspects the bytes sent by the target. It never fails.
+func (t *Tracker) Write(p []byte) (int, error) {
+	t.scanner.Scan(p, t.packet)
+	return len(p), nil
+}
+
+func (t *Tracker) packet(pkt *Packet) {
+	if t.cur == nil {
+		c, ok := t.next()
+		if !ok {
+			return // not a response to a known command
+		}
+		t.start(c)
+	}
+	head := pkt.Head
+	if len(head) == 0 {
+		return
+	}
+	switch t.state {
+	case stFirst:
+		switch head[0] {
+		case mysql.OK_HEADER:
+			t.ok(head)
+		case mysql.ERR_HEADER:
+			t.finish(parseErr(head))
+		case mysql.LocalInFile_HEADER:
+			// the client sends the file, then the server answers OK or ERR
+			t.infile = string(head[1:])
+		default:
+			if t.left, _ = lenencInt(head); t.left == 0 {
+				t.finish("ERROR: malformed response")
+				return
+			}
+			t.part.ResultSet = true
+			t.startCapture(t.left)
+			t.state = stColumns
+		}
+	case stColumns:
+		if t.capturing {
+			t.captureColumn(head)
+		}
+		if t.left--; t.left > 0 {
+			return
+		}
+		t.state = stRows
+		if !t.deprecateEOF {
+			t.state = stColumnsEOF
+		}
+	case stColumnsEOF:
+		if head[0] == mysql.ERR_HEADER {
+			t.finish(parseErr(head))
+			return
+		}
+		t.state = stRows
+		if status := t.status(head); status&mysql.SERVER_STATUS_CURSOR_EXISTS != 0 {
+			// rows are read by COM_STMT_FETCH
+			t.endStatus = status
+			t.finish("")
+		}
+	case stRows:
+		switch {
+		case head[0] == mysql.ERR_HEADER:
+			t.finish(parseErr(head))
+		case t.isEOF(pkt):
+			t.endOfResultSet(t.status(head))
+		default:
+			t.rows++
+			t.part.Rows++
+			if t.capturing {
+				t.captureRow(pkt)
+			}
+		}
+	case stPrepare:
+		if head[0] != mysql.OK_HEADER || len(head) < 9 {
+			t.finish(parseErr(head))
+			return
+		}
+		t.statement = binary.LittleEndian.Uint32(head[1:])
+		columns := uint64(binary.LittleEndian.Uint16(head[5:]))
+		params := uint64(binary.LittleEndian.Uint16(head[7:]))
+		t.left = columns + params
+		if !t.deprecateEOF {
+			t.left += min(columns, 1) + min(params, 1)
+		}
+		t.state = stDefs
+		if t.left == 0 {
+			t.finish("")
+		}
+	case stDefs:
+		if t.left--; t.left == 0 {
+			t.finish("")
+		}
+	case stFieldList:
+		switch {
+		case head[0] == mysql.ERR_HEADER:
+			t.finish(parseErr(head))
+		case t.isEOF(pkt):
+			t.finish("")
+		default:
+			t.rows++
+		}
+	case stFetch:
+		switch {
+		case head[0] == mysql.ERR_HEADER:
+			t.finish(parseErr(head))
+		case t.isEOF(pkt):
+			// SERVER_STATUS_LAST_ROW_SENT once the cursor is read to the end
+			t.endStatus = t.status(head)
+			t.finish("")
+		default:
+			t.rows++
+		}
+	case stSingle:
+		t.finish("")
+	case stOK:
+		switch {
+		case head[0] == mysql.OK_HEADER:
+			t.affected, _ = lenencInt(head[1:])
+			t.finish("")
+		case head[0] == mysql.ERR_HEADER:
+			t.finish(parseErr(head))
+		case head[0] == mysql.EOF_HEADER && pkt.Length < 9:
+			t.finish("")
+		}
+	}
+}
+
+func (t *Tracker) start(c command) {
+	t.cur = &c
+	t.rows, t.affected = 0, 0
+	t.infile, t.endStatus, t.statement = "", 0, 0
+	t.parts, t.part, t.partEnd = nil, Part{}, c.start
+	t.capture, t.capturing = nil, false
+	switch c.code {
+	case mysql.COM_QUERY, mysql.COM_STMT_EXECUTE:
+		t.state = stFirst
+	case mysql.COM_STMT_PREPARE:
+		t.state = stPrepare
+	case mysql.COM_FIELD_LIST:
+		t.state = stFieldList
+	case mysql.COM_STMT_FETCH:
+		t.state = stFetch
+	case mysql.COM_STATISTICS:
+		t.state = stSingle
+	case mysql.COM_BINLOG_DUMP, mysql.COM_BINLOG_DUMP_GTID:
+		t.state = stStream
+	default:
+		t.state = stOK
+	}
+}
+
+// ok handles an OK packet in place of a result set.
+func (t *Tracker) ok(head []byte) {
+	affected, n := lenencInt(head[1:])
+	t.affected += affected
+	t.part.Affected = affected
+	_, m := lenencInt(head[1+n:]) // last insert id
+	status := uint16(0)
+	if b := head[1+n+m:]; n > 0 && m > 0 && len(b) >= 2 {
+		status = binary.LittleEndian.Uint16(b)
+	}
+	t.endOfResultSet(status)
+}
+
+func (t *Tracker) endOfResultSet(status uint16) {
+	t.capturing = false
+	if status&mysql.SERVER_MORE_RESULTS_EXISTS != 0 {
+		t.endPart("")
+		t.state = stFirst
+		return
+	}
+	t.endStatus = status
+	t.finish("")
+}
+
+// isEOF reports whether pkt ends a list of rows or definitions: an EOF
+// packet, or an OK packet with the EOF header if CLIENT_DEPRECATE_EOF.
+func (t *Tracker) isEOF(pkt *Packet) bool {
+	if pkt.Head[0] != mysql.EOF_HEADER {
+		return false
+	}
+	if t.deprecateEOF {
+		return pkt.Length < 0xffffff
+	}
+	return pkt.Length < 9
+}
+
+// status returns the status flags of an EOF packet, or of an OK packet
+// with the EOF header.
+func (t *Tracker) status(head []byte) uint16 {
+	if len(head) == 0 || head[0] != mysql.EOF_HEADER {
+		return 0
+	}
+	if !t.deprecateEOF {
+		if len(head) < 5 {
+			return 0
+		}
+		return binary.LittleEndian.Uint16(head[3:])
+	}
+	_, n := lenencInt(head[1:])
+	_, m := lenencInt(head[1+n:])
+	if b := head[1+n+m:]; n > 0 && m > 0 && len(b) >= 2 {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (t *Tracker) finish(errMsg string) {
+	c := t.cur
+	t.cur = nil
+	if len(t.parts) > 0 {
+		t.endPart(errMsg)
+	}
+	capture := t.capture
+	t.capture, t.capturing = nil, false
+	if t.onResult == nil {
+		return
+	}
+	t.onResult(Result{
+		Seq:       c.seq,
+		Command:   c.code,
+		Duration:  t.now().Sub(c.start),
+		Rows:      t.rows,
+		Affected:  t.affected,
+		Err:       errMsg,
+		Capture:   capture,
+		Infile:    t.infile,
+		Status:    t.endStatus,
+		Parts:     t.parts,
+		Statement: t.statement,
+	})
+}
+
+// endPart ends a result of a response that may hold more.
+func (t *Tracker) endPart(errMsg string) {
+	now := t.now()
+	t.part.Err = errMsg
+	t.part.Duration = now.Sub(t.partEnd).Microseconds()
+	t.parts = append(t.parts, t.part)
+	t.part, t.partEnd = Part{}, now
+}
+
+// parseErr formats an ERR packet like the mysql client does.
+func parseErr(head []byte) string {
+	if len(head) < 3 || head[0] != mysql.ERR_HEADER {
+		return "ERROR: malformed response"
+	}
+	code := binary.LittleEndian.Uint16(head[1:])
+	msg := head[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		return fmt.Sprintf("ERROR %d (%s): %s", code, msg[1:6], msg[6:])
+	}
+	return fmt.Sprintf("ERROR %d: %s", code, msg)
+}
@@ -0,0 +1,90 @@
+// Package protocol follows the MySQL client/server protocol on a proxied
+// byte stream without terminating it.
+package protocol
+
+// maxInspect is the number of payload bytes of each packet kept for
+// inspection by default. The rest of a packet is skipped without buffering.
+const maxInspect = 1024
+
+// Packet is a packet seen by a Scanner. Head holds the first bytes of the
+// payload and is only valid during the callback.
+type Packet struct {
+	Seq    byte
+	Length int // payload length
+	Head   []byte
+}
+
+// Scanner splits a stream written in arbitrary chunks into packets.
+type Scanner struct {
+	header  [4]byte
+	nheader int
+	remain  int
+	pkt     Packet
+	limit   int // bytes of Head, maxInspect if 0
+}
+
+// Scan feeds p to the scanner and calls f for every packet completed by p.
+func (s *Scanner) Scan(p []byte, f func(pkt *Packet)) {
+	for len(p) > 0 {
+		if s.nheader < len(s.header) {
+			n := copy(s.header[s.nheader:], p)
+			s.nheader += n
+			p = p[n:]
+			if s.nheader < len(s.header) {
+				return
+			}
+			s.pkt.Length = int(uint32(s.header[0]) | uint32(s.header[1])<<8 | uint32(s.header[2])<<16)
+			s.pkt.Seq = s.header[3]
+			s.pkt.Head = s.pkt.Head[:0]
+			s.remain = s.pkt.Length
+			if s.remain == 0 {
+				s.nheader = 0
+				f(&s.pkt)
+				continue
+			}
+		}
+		n := min(s.remain, len(p))
+		limit := s.limit
+		if limit == 0 {
+			limit = maxInspect
+		}
+		if keep := min(n, limit-len(s.pkt.Head)); keep > 0 {
+			s.pkt.Head = append(s.pkt.Head, p[:keep]...)
+		}
+		s.remain -= n
+		p = p[n:]
+		if s.remain == 0 {
+			s.nheader = 0
+			f(&s.pkt)
+		}
+	}
+}
+
+// lenencInt decodes a length-encoded integer. n is 0 if b is too short.
+func lenencInt(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	size := 1
+	switch b[0] {
+	case 0xfc:
+		size = 3
+	case 0xfd:
+		size = 4
+	case 0xfe:
+		size = 9
+	}
+	if len(b) < size {
+		return 0, 0
+	}
+	if size == 1 {
+		if b[0] == 0xfb { // NULL
+			return 0, 1
+		}
+		return uint64(b[0]), 1
+	}
+	for i := size - 1; i > 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, size
+}
@@ -5,13 +5,51 @@ import (
 )
 
 type ProxyCfg struct {
-	ProxyListenAddr string        `default:":3307"` // "localhost:3307"
-	ProxyListentNet string        `default:"tcp"`   // tcp or unix
-	ConTimeout      time.Duration `default:"300s"`
-	LogFileName     string        `default:"mysql-audit.%Y%m%d%H.log.gz"`
-	RotateTime      time.Duration `default:"1h"`
-	AdminUser       string        `default:"admin"`
-	Debug           bool          `default:"false"`
+	ProxyListenAddr     string        `default:":3307"` // "localhost:3307"
+	ProxyListentNet     string        `default:"tcp"`   // tcp or unix
+	ConTimeout          time.Duration `default:"300s"`
+	LogFileName         string        `default:"mysql-audit.%Y%m%d%H.log.gz"`
+	LogFormat           string        `default:"binary"` // binary, ndjson or ocsf
+	LogAnalyze          bool          `default:"false"`  // parse queries for the digest, class and tables of ndjson, ocsf and sink records
+	RotateTime          time.Duration `default:"1h"`
+	LogFlush            time.Duration `default:"1s"`        // 0 flushes only on rotation
+	LogCommandLimit     int           `default:"16777216"`  // bytes of the payload of a command kept in the audit log, 0 keeps all
+	LogMemory           int64         `default:"268435456"` // bytes of packets waiting to be logged before sessions are slowed down, 0 is unlimited
+	LogEncryptKey       string        `default:""`          // PEM file of the RSA public key the log files are encrypted for
+	AdminUser           string        `default:"admin"`
+	Debug               bool          `default:"false"`
+	RotateCommand       string        `default:""` // run with the closed log file path as argument
+	UploadURL           string        `default:""` // file:///path/to/archive or s3://bucket/prefix
+	UploadRetry         int           `default:"5"`
+	S3Endpoint          string        `default:""` // "https://s3.<region>.amazonaws.com" if empty
+	S3Region            string        `default:"us-east-1"`
+	S3AccessKey         string        `default:""`
+	S3SecretKey         string        `default:""`
+	Sinks               string        `default:""` // space separated: syslog+udp://host:514 kafka://host1:9092,host2:9092/topic ...
+	SinkQueueSize       int           `default:"10000"`
+	SinkBatchSize       int           `default:"100"`
+	SinkFlush           time.Duration `default:"1s"`
+	SinkRetry           int           `default:"3"`
+	SinkCAFile          string        `default:""`
+	MaskCredentials     bool          `default:"true"`
+	MaskRegex           string        `default:""` // space separated regular expressions
+	MaskLiterals        string        `default:""` // space separated schema or schema.table patterns
+	MaskHashKey         string        `default:""`
+	CaptureUsers        string        `default:""` // space separated target user patterns whose results are captured
+	CaptureRows         int           `default:"10"`
+	CaptureBytes        int           `default:"4096"`
+	InfileDenyUsers     string        `default:""`                   // space separated target user patterns that cannot use LOAD DATA LOCAL INFILE
+	InfileContent       bool          `default:"false"`              // log the content of LOAD DATA LOCAL INFILE files
+	TargetCompression   string        `default:"client"`             // compression asked of the target: client, none, zlib or zstd
+	ProbeTarget         string        `default:""`                   // target whose version, collation and capabilities are told to clients
+	ServerVersion       string        `default:""`                   // version told to clients, that of ProbeTarget if empty
+	RouteFile           string        `default:""`                   // JSON routing table of logical targets, see route.Table
+	HealthCheckInterval time.Duration `default:"5s"`                 // between probes of the backends of RouteFile, 0 disables them
+	HealthCheckTimeout  time.Duration `default:"2s"`                 // of a probe
+	HealthCheckUser     string        `default:"mysql8-audit-proxy"` // logged in as by the probes, without a password
+	BreakerFailures     int           `default:"3"`                  // failures in a row that open the circuit of a backend, 0 never opens it
+	BreakerCooldown     time.Duration `default:"30s"`                // a backend with an open circuit is skipped for
+	SplitUsers          string        `default:""`                   // space separated target user patterns whose reads go to the replicas of their route
 }
 
 type ProxyUser struct {
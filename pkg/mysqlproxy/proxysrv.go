@@ -7,12 +7,16 @@ import (
 	"log"
 	"net"
 	"os"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/server"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/masahide/mysql8-audit-proxy/pkg/generatepem"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/mask"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/route"
 	"github.com/masahide/mysql8-audit-proxy/pkg/serverconfig"
 )
 
@@ -25,12 +29,25 @@ type ProxySrv struct {
 	AuditLogWriter LogWriter
 	SvConfMng      *serverconfig.Manager
 	Config         *ProxyCfg
+	Masker         *mask.Masker // redacts queries before they are logged, may be nil
+	Routes         *route.File  // logical targets, may be nil
+
+	profile serverProfile
+	health  *route.Health // of the backends, circuit breaking
 }
 
 func (p *ProxySrv) Start(ctx context.Context) error {
 	if err := p.createListener(); err != nil {
 		return err
 	}
+	if len(p.Config.ProbeTarget) > 0 && p.startProbe() {
+		// told to the first clients already
+		p.probe(ctx)
+	}
+	p.health = route.NewHealth(p.Config.BreakerFailures, p.Config.BreakerCooldown)
+	if p.Routes != nil && p.Config.HealthCheckInterval > 0 {
+		go p.healthCheck(ctx)
+	}
 	p.acceptClntConn(ctx)
 	return nil
 }
@@ -88,11 +105,17 @@ func (p *ProxySrv) acceptClntConn(ctx context.Context) {
 func (p *ProxySrv) sessionWorker(ctx context.Context, netConn net.Conn) {
 	chandler := serverconfig.NewConfigHandler(p.SvConfMng)
 	defer netConn.Close()
+	version, collation, capability, profiled := p.serverProfile(ctx)
 	svr := server.NewServer(
-		"8.0.12_mysql-audit-proxy",
-		mysql.DEFAULT_COLLATION_ID,
+		version,
+		collation,
 		mysql.AUTH_CACHING_SHA2_PASSWORD,
 		[]byte(p.serverPems.Public), p.tlsConf)
+	if profiled {
+		// offer what the target does, so that the client and the target agree
+		svr.SetCapability(capability & negotiatedCaps)
+		svr.UnsetCapability(negotiatedCaps &^ capability)
+	}
 	remoteProvider := NewConfigProvider(p.SvConfMng)
 	mysqlConn, err := svr.NewCustomizedConn(netConn, remoteProvider, chandler)
 	if err != nil {
@@ -111,39 +134,98 @@ func (p *ProxySrv) sessionWorker(ctx context.Context, netConn net.Conn) {
 		p.admin(mysqlConn)
 		return
 	}
-	targetUser, targetAddr, targetPasswrd := getTargetInfo(user)
+	targetUser, target, targetPasswrd := getTargetInfo(user)
 	if len(targetPasswrd) == 0 {
 		targetPasswrd, _, _ = remoteProvider.GetCredential(user)
 	}
-	targetAddr = addPort(targetAddr)
 	sess := &ClientSess{
 		ClientMysql:    mysqlConn,
 		TargetNet:      "tcp",
-		TargetAddr:     targetAddr,
 		TargetUser:     targetUser,
 		TargetPassword: targetPasswrd,
 		TargetDB:       chandler.GetDB(),
 		ProxySrv:       p,
 	}
-	err = sess.ConnectToMySQL(ctx)
+	backends, replicas, err := p.route(route.Session{Target: target, Client: netConn.RemoteAddr(), DB: chandler.GetDB(), Time: time.Now()})
+	if err == nil {
+		err = p.connect(ctx, sess, target, backends)
+	}
 	if err != nil {
-		log.Printf("error: connect to mysql target:%s err: %v", targetAddr, err)
+		log.Printf("error: target:%s err: %v", target, err)
+		refuse(mysqlConn, err, p.Config.ConTimeout)
 		return
 	}
+	if len(replicas) > 0 && p.splits(targetUser) {
+		p.connectReplica(ctx, sess, replicas)
+	}
 	sess.Proxy(ctx)
 
 }
 
-// addPort - Add the "3306" port if the hostname does not indicate a port number. However, if the host name is empty, it will be localhost
-func addPort(s string) string {
-	if len(s) == 0 {
-		s = "localhost:3306"
+// captures reports whether the results of the target user are captured.
+func (p *ProxySrv) captures(user string) bool {
+	return matchUser(p.Config.CaptureUsers, user)
+}
+
+// deniesInfile reports whether the target user cannot use LOAD DATA LOCAL INFILE.
+func (p *ProxySrv) deniesInfile(user string) bool {
+	return matchUser(p.Config.InfileDenyUsers, user)
+}
+
+// splits reports whether the reads of the target user go to replicas.
+func (p *ProxySrv) splits(user string) bool {
+	return matchUser(p.Config.SplitUsers, user)
+}
+
+// matchUser reports whether user matches one of the space separated patterns.
+func matchUser(patterns, user string) bool {
+	for _, pattern := range strings.Fields(patterns) {
+		if ok, _ := path.Match(pattern, user); ok {
+			return true
+		}
 	}
-	ss := strings.Split(s, ":")
-	if len(ss) == 1 {
-		return s + ":3306"
+	return false
+}
+
+// route returns the addresses of the backends and of the replicas of a
+// target, each to be tried in order. A target that is not a name of the
+// routing table is an address, without replicas.
+func (p *ProxySrv) route(s route.Session) (backends, replicas []string, err error) {
+	backends = []string{s.Target}
+	if p.Routes != nil {
+		table, err := p.Routes.Table()
+		if err != nil {
+			// keep routing with the table read before
+			log.Printf("route table err: %v", err)
+		}
+		if table != nil {
+			if r, named := table.Lookup(s); named {
+				if r == nil {
+					return nil, nil, mysql.NewError(erHostNotPrivileged, fmt.Sprintf("Host '%s' is not allowed to connect to target '%s'", host(s.Client), s.Target))
+				}
+				log.Printf("route target:%s backends:%s replicas:%s", s.Target, strings.Join(r.Backends, ","), strings.Join(r.Replicas, ","))
+				backends, replicas = r.Backends, r.Replicas
+			}
+		}
+	}
+	return addPorts(backends), addPorts(replicas), nil
+}
+
+func addPorts(addrs []string) []string {
+	withPorts := make([]string, len(addrs))
+	for i, a := range addrs {
+		withPorts[i] = route.AddPort(a)
+	}
+	return withPorts
+}
+
+// host returns the host of a client address.
+func host(addr net.Addr) string {
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
 	}
-	return s
+	return h
 }
 
 func (p *ProxySrv) admin(mysqlConn *server.Conn) {
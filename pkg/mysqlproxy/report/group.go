@@ -0,0 +1,95 @@
+package report
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+)
+
+// GroupKeys are the keys accepted by SetGroupBy.
+var GroupKeys = map[string]func(rec *decoder.Record) string{
+	"user":       func(rec *decoder.Record) string { return rec.User },
+	"db":         func(rec *decoder.Record) string { return rec.Db },
+	"addr":       func(rec *decoder.Record) string { return host(rec.Addr) },
+	"target":     func(rec *decoder.Record) string { return rec.Target },
+	"command":    func(rec *decoder.Record) string { return rec.Command },
+	"type":       func(rec *decoder.Record) string { return decoder.StatementType(*rec) },
+	"class":      func(rec *decoder.Record) string { return rec.Class },
+	"digest":     func(rec *decoder.Record) string { return rec.Digest },
+	"normalized": func(rec *decoder.Record) string { return rec.Normalized },
+}
+
+// GroupStat counts the statements of one combination of group keys.
+type GroupStat struct {
+	Keys   []string `json:"keys"`
+	Count  int      `json:"count"`
+	Errors int      `json:"errors"`
+	Total  int64    `json:"total_us"`
+}
+
+// Groups counts statements by the keys given to SetGroupBy.
+type Groups struct {
+	By     []string    `json:"by"`
+	Groups []GroupStat `json:"groups"`
+}
+
+// SetGroupBy makes the report count statements by the combination of the
+// keys, e.g. []string{"user", "digest"}.
+func (b *Builder) SetGroupBy(keys []string) error {
+	for _, k := range keys {
+		if GroupKeys[k] == nil {
+			return fmt.Errorf("unknown group-by key:%q", k)
+		}
+	}
+	b.groupBy = keys
+	return nil
+}
+
+func (b *Builder) addGroup(rec *decoder.Record, failed int) {
+	if len(b.groupBy) == 0 {
+		return
+	}
+	keys := make([]string, len(b.groupBy))
+	for i, k := range b.groupBy {
+		keys[i] = GroupKeys[k](rec)
+	}
+	id := strings.Join(keys, "\x00")
+	g := b.groups[id]
+	if g == nil {
+		g = &GroupStat{Keys: keys}
+		b.groups[id] = g
+	}
+	g.Count++
+	g.Errors += failed
+	g.Total += rec.Duration
+}
+
+func (b *Builder) groupReport() *Groups {
+	if len(b.groupBy) == 0 {
+		return nil
+	}
+	res := &Groups{By: b.groupBy, Groups: []GroupStat{}}
+	for _, g := range b.groups {
+		res.Groups = append(res.Groups, *g)
+	}
+	sort.Slice(res.Groups, func(i, j int) bool {
+		a, b := res.Groups[i], res.Groups[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return strings.Join(a.Keys, "\x00") < strings.Join(b.Keys, "\x00")
+	})
+	return res
+}
+
+// host returns the host part of "host:port", or addr itself.
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
+}
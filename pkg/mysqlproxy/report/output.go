@@ -0,0 +1,158 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Table is one section of a report in rows and columns.
+type Table struct {
+	Name   string
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+const tableTime = "2006-01-02 15:04:05"
+
+// Tables returns the sections of the report in the order they are printed.
+func (r *Report) Tables() []Table {
+	sessions := Table{Name: "sessions", Title: "Sessions per user and target",
+		Header: []string{"USER", "TARGET", "SESSIONS", "STATEMENTS", "ERRORS"}}
+	for _, s := range r.Sessions {
+		sessions.Rows = append(sessions.Rows, []string{s.User, s.Target, itoa(s.Sessions), itoa(s.Statements), itoa(s.Errors)})
+	}
+	statements := Table{Name: "statements", Title: "Statements by type",
+		Header: []string{"TYPE", "COUNT", "ERRORS", "TOTAL_MS"}}
+	for _, t := range r.Statements {
+		statements.Rows = append(statements.Rows, []string{t.Type, itoa(t.Count), itoa(t.Errors), ms(t.Total)})
+	}
+	queries := func(name, title string, stats []QueryStat) Table {
+		t := Table{Name: name, Title: title,
+			Header: []string{"DIGEST", "COUNT", "ERRORS", "TOTAL_MS", "AVG_MS", "MAX_MS", "QUERY"}}
+		for _, q := range stats {
+			t.Rows = append(t.Rows, []string{shortDigest(q.Digest), itoa(q.Count), itoa(q.Errors), ms(q.Total), ms(q.Total / int64(q.Count)), ms(q.Max), q.Query})
+		}
+		return t
+	}
+	errors := Table{Name: "errors", Title: "Error rates per user",
+		Header: []string{"USER", "STATEMENTS", "ERRORS", "RATE"}}
+	for _, e := range r.Errors {
+		errors.Rows = append(errors.Rows, []string{e.User, itoa(e.Statements), itoa(e.Errors), fmt.Sprintf("%.2f%%", e.Rate*100)})
+	}
+	ddl := Table{Name: "ddl", Title: "DDL and DCL events",
+		Header: []string{"TIME", "CON_ID", "USER", "ADDR", "TARGET", "ERR", "SQL"}}
+	for _, d := range r.DDL {
+		ddl.Rows = append(ddl.Rows, []string{d.Time.Format(tableTime), strconv.FormatUint(uint64(d.ConnectionID), 10), d.User, d.Addr, d.Target, d.Err, d.SQL})
+	}
+	clients := Table{Name: "clients", Title: "Clients",
+		Header: []string{"ADDR", "FIRST_SEEN", "LAST_SEEN", "SESSIONS", "USERS"}}
+	for _, c := range r.Clients {
+		clients.Rows = append(clients.Rows, []string{c.Addr, c.FirstSeen.Format(tableTime), c.LastSeen.Format(tableTime), itoa(c.Sessions), strings.Join(c.Users, ",")})
+	}
+	tables := []Table{
+		sessions,
+		statements,
+		queries("top_by_count", "Top queries by count", r.TopByCount),
+		queries("top_by_time", "Top queries by total time", r.TopByTime),
+		errors,
+		ddl,
+		clients,
+	}
+	if r.Groups != nil {
+		groups := Table{Name: "groups", Title: "Statements by " + strings.Join(r.Groups.By, ", ")}
+		for _, k := range r.Groups.By {
+			groups.Header = append(groups.Header, strings.ToUpper(k))
+		}
+		groups.Header = append(groups.Header, "COUNT", "ERRORS", "TOTAL_MS", "AVG_MS")
+		for _, g := range r.Groups.Groups {
+			row := append([]string{}, g.Keys...)
+			for i, k := range r.Groups.By {
+				if k == "digest" {
+					row[i] = shortDigest(row[i])
+				}
+			}
+			groups.Rows = append(groups.Rows, append(row, itoa(g.Count), itoa(g.Errors), ms(g.Total), ms(g.Total/int64(g.Count))))
+		}
+		tables = append(tables, groups)
+	}
+	return tables
+}
+
+// shortDigest shortens a digest for tables, like git shortens commit hashes.
+// The -digest filter accepts the short form as a prefix.
+func shortDigest(digest string) string {
+	if len(digest) > 16 {
+		return digest[:16]
+	}
+	return digest
+}
+
+// WriteTable prints the report as aligned text tables.
+func (r *Report) WriteTable(w io.Writer) error {
+	fmt.Fprintf(w, "Report: %d records from %s to %s\n", r.Records, r.From.Format(tableTime), r.To.Format(tableTime))
+	for _, t := range r.Tables() {
+		fmt.Fprintf(w, "\n## %s\n", t.Title)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(t.Header, "\t"))
+		for _, row := range t.Rows {
+			for i := range row {
+				// keep multi-line SQL on one line
+				row[i] = strings.Join(strings.Fields(row[i]), " ")
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON prints the report as one JSON object.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV prints the named section of the report as CSV with a header row,
+// or every section separated by blank lines if section is empty.
+func (r *Report) WriteCSV(w io.Writer, section string) error {
+	found := false
+	for _, t := range r.Tables() {
+		if len(section) > 0 && t.Name != section {
+			continue
+		}
+		if found {
+			fmt.Fprintln(w)
+		}
+		found = true
+		cw := csv.NewWriter(w)
+		if len(section) == 0 {
+			cw.Write([]string{"# " + t.Name})
+		}
+		cw.Write(t.Header)
+		cw.WriteAll(t.Rows)
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown section:%q", section)
+	}
+	return nil
+}
+
+func itoa(n int) string { return strconv.Itoa(n) }
+
+// ms formats microseconds as milliseconds.
+func ms(us int64) string {
+	return strconv.FormatFloat(float64(time.Duration(us)*time.Microsecond)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,307 @@
+// Package report aggregates audit records into a summary of the activity.
+package report
+
+import (
+	"sort"
+	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+)
+
+type SessionStat struct {
+	User       string `json:"user"`
+	Target     string `json:"target"`
+	Sessions   int    `json:"sessions"`
+	Statements int    `json:"statements"`
+	Errors     int    `json:"errors"`
+}
+
+type TypeStat struct {
+	Type   string `json:"type"`
+	Count  int    `json:"count"`
+	Errors int    `json:"errors"`
+	Total  int64  `json:"total_us"`
+}
+
+type QueryStat struct {
+	Digest string `json:"digest"`
+	Query  string `json:"query"` // normalized
+	Count  int    `json:"count"`
+	Errors int    `json:"errors"`
+	Total  int64  `json:"total_us"`
+	Max    int64  `json:"max_us"`
+}
+
+type ErrorStat struct {
+	User       string  `json:"user"`
+	Statements int     `json:"statements"`
+	Errors     int     `json:"errors"`
+	Rate       float64 `json:"rate"` // errors / statements
+}
+
+type DDLEvent struct {
+	Time         time.Time `json:"time"`
+	ConnectionID uint32    `json:"con_id"`
+	User         string    `json:"user"`
+	Addr         string    `json:"addr"`
+	Target       string    `json:"target"`
+	SQL          string    `json:"sql"`
+	Err          string    `json:"err,omitempty"`
+}
+
+type ClientStat struct {
+	Addr      string    `json:"addr"` // host of the client
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Sessions  int       `json:"sessions"`
+	Users     []string  `json:"users"`
+}
+
+// Report is the summary of a range of audit records.
+type Report struct {
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Records    int           `json:"records"`
+	Sessions   []SessionStat `json:"sessions"`
+	Statements []TypeStat    `json:"statements"`
+	TopByCount []QueryStat   `json:"top_by_count"`
+	TopByTime  []QueryStat   `json:"top_by_time"`
+	Errors     []ErrorStat   `json:"errors"`
+	DDL        []DDLEvent    `json:"ddl"`
+	Clients    []ClientStat  `json:"clients"`
+	Groups     *Groups       `json:"groups,omitempty"`
+}
+
+type sessionKey struct{ user, target string }
+
+type client struct {
+	ClientStat
+	users map[string]bool
+}
+
+// Builder aggregates records in log order.
+type Builder struct {
+	// Filter selects the statements and sessions to count. Nil counts everything.
+	Filter *decoder.Filter
+
+	top      int
+	joiner   *decoder.Joiner
+	report   Report
+	sessions map[sessionKey]*SessionStat
+	types    map[string]*TypeStat
+	queries  map[string]*QueryStat
+	errors   map[string]*ErrorStat
+	clients  map[string]*client
+	groupBy  []string
+	groups   map[string]*GroupStat
+}
+
+// NewBuilder returns a Builder that keeps the top queries.
+func NewBuilder(top int) *Builder {
+	return &Builder{
+		top:      top,
+		joiner:   decoder.NewJoiner(),
+		sessions: map[sessionKey]*SessionStat{},
+		types:    map[string]*TypeStat{},
+		queries:  map[string]*QueryStat{},
+		errors:   map[string]*ErrorStat{},
+		clients:  map[string]*client{},
+		groups:   map[string]*GroupStat{},
+	}
+}
+
+// Add takes the next record of the log.
+func (b *Builder) Add(rec decoder.Record) {
+	for _, r := range b.joiner.Add(rec) {
+		b.add(r)
+	}
+}
+
+func (b *Builder) add(rec decoder.Record) {
+	if b.Filter != nil && !b.Filter.Match(&rec) {
+		return
+	}
+	b.report.Records++
+	if b.report.From.IsZero() || rec.Datetime.Before(b.report.From) {
+		b.report.From = rec.Datetime
+	}
+	if rec.Datetime.After(b.report.To) {
+		b.report.To = rec.Datetime
+	}
+	c := b.client(rec)
+	c.users[rec.User] = true
+	if rec.Datetime.Before(c.FirstSeen) {
+		c.FirstSeen = rec.Datetime
+	}
+	if rec.Datetime.After(c.LastSeen) {
+		c.LastSeen = rec.Datetime
+	}
+	s := b.session(rec)
+	switch {
+	case rec.State == "connect":
+		s.Sessions++
+		c.Sessions++
+		return
+	case rec.State != "est" || len(rec.Command) == 0 || rec.Command == "COM_QUIT":
+		return
+	}
+	failed := 0
+	if len(rec.Err) > 0 {
+		failed = 1
+	}
+	s.Statements++
+	s.Errors += failed
+	e := b.errors[rec.User]
+	if e == nil {
+		e = &ErrorStat{User: rec.User}
+		b.errors[rec.User] = e
+	}
+	e.Statements++
+	e.Errors += failed
+	rec.Analyze()
+	b.addGroup(&rec, failed)
+
+	typ := decoder.StatementType(rec)
+	t := b.types[typ]
+	if t == nil {
+		t = &TypeStat{Type: typ}
+		b.types[typ] = t
+	}
+	t.Count++
+	t.Errors += failed
+	t.Total += rec.Duration
+
+	if rec.Command != "COM_QUERY" {
+		return
+	}
+	if len(rec.Statements) == 0 {
+		b.addQuery(rec, decoder.Statement{SQL: rec.Cmd, Digest: rec.Digest, Normalized: rec.Normalized, Class: rec.Class, Err: rec.Err, Duration: rec.Duration})
+		return
+	}
+	// each statement of a multi-statement query on its own
+	for _, s := range rec.Statements {
+		b.addQuery(rec, s)
+	}
+}
+
+func (b *Builder) addQuery(rec decoder.Record, s decoder.Statement) {
+	failed := 0
+	if len(s.Err) > 0 {
+		failed = 1
+	}
+	if s.Class == decoder.ClassDDL || s.Class == decoder.ClassDCL {
+		b.report.DDL = append(b.report.DDL, DDLEvent{
+			Time: rec.Datetime, ConnectionID: rec.ConnectionID, User: rec.User,
+			Addr: rec.Addr, Target: rec.Target, SQL: s.SQL, Err: s.Err,
+		})
+	}
+	q := b.queries[s.Digest]
+	if q == nil {
+		q = &QueryStat{Digest: s.Digest, Query: s.Normalized}
+		b.queries[s.Digest] = q
+	}
+	q.Count++
+	q.Errors += failed
+	q.Total += s.Duration
+	q.Max = max(q.Max, s.Duration)
+}
+
+func (b *Builder) session(rec decoder.Record) *SessionStat {
+	k := sessionKey{rec.User, rec.Target}
+	s := b.sessions[k]
+	if s == nil {
+		s = &SessionStat{User: rec.User, Target: rec.Target}
+		b.sessions[k] = s
+	}
+	return s
+}
+
+func (b *Builder) client(rec decoder.Record) *client {
+	host := host(rec.Addr)
+	c := b.clients[host]
+	if c == nil {
+		c = &client{ClientStat: ClientStat{Addr: host, FirstSeen: rec.Datetime, LastSeen: rec.Datetime}, users: map[string]bool{}}
+		b.clients[host] = c
+	}
+	return c
+}
+
+// Report returns the summary of the records added so far.
+func (b *Builder) Report() *Report {
+	for _, r := range b.joiner.Flush() {
+		b.add(r)
+	}
+	r := b.report
+	r.Sessions = []SessionStat{}
+	for _, s := range b.sessions {
+		r.Sessions = append(r.Sessions, *s)
+	}
+	sort.Slice(r.Sessions, func(i, j int) bool {
+		a, b := r.Sessions[i], r.Sessions[j]
+		if a.Sessions != b.Sessions {
+			return a.Sessions > b.Sessions
+		}
+		return a.User+"\x00"+a.Target < b.User+"\x00"+b.Target
+	})
+	r.Statements = []TypeStat{}
+	for _, t := range b.types {
+		r.Statements = append(r.Statements, *t)
+	}
+	sort.Slice(r.Statements, func(i, j int) bool {
+		a, b := r.Statements[i], r.Statements[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Type < b.Type
+	})
+	queries := []QueryStat{}
+	for _, q := range b.queries {
+		queries = append(queries, *q)
+	}
+	r.TopByCount = topQueries(queries, b.top, func(q QueryStat) int64 { return int64(q.Count) })
+	r.TopByTime = topQueries(queries, b.top, func(q QueryStat) int64 { return q.Total })
+	r.Errors = []ErrorStat{}
+	for _, e := range b.errors {
+		if e.Statements > 0 {
+			e.Rate = float64(e.Errors) / float64(e.Statements)
+		}
+		r.Errors = append(r.Errors, *e)
+	}
+	sort.Slice(r.Errors, func(i, j int) bool {
+		a, b := r.Errors[i], r.Errors[j]
+		if a.Rate != b.Rate {
+			return a.Rate > b.Rate
+		}
+		return a.User < b.User
+	})
+	if r.DDL == nil {
+		r.DDL = []DDLEvent{}
+	}
+	r.Clients = []ClientStat{}
+	for _, c := range b.clients {
+		c.Users = []string{}
+		for u := range c.users {
+			c.Users = append(c.Users, u)
+		}
+		sort.Strings(c.Users)
+		r.Clients = append(r.Clients, c.ClientStat)
+	}
+	sort.Slice(r.Clients, func(i, j int) bool { return r.Clients[i].Addr < r.Clients[j].Addr })
+	r.Groups = b.groupReport()
+	return &r
+}
+
+func topQueries(queries []QueryStat, n int, key func(q QueryStat) int64) []QueryStat {
+	res := append([]QueryStat{}, queries...)
+	sort.Slice(res, func(i, j int) bool {
+		a, b := key(res[i]), key(res[j])
+		if a != b {
+			return a > b
+		}
+		return res[i].Query < res[j].Query
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
@@ -0,0 +1,94 @@
+package report
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+)
+
+func TestReport(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(1700000000+sec, 0) }
+	errNoTable := "ERROR 1146 (42S02): Table 'db.t' doesn't exist"
+	records := []decoder.Record{
+		{Datetime: at(0), ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db1:3306", State: "connect"},
+		{Datetime: at(1), ConnectionID: 2, User: "user2", Addr: "10.0.0.2:50000", Target: "db1:3306", State: "connect"},
+		{Datetime: at(2), ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db1:3306", State: "est", Seq: 1, Command: "COM_QUERY", Cmd: "select * from t where id = 1"},
+		{Datetime: at(2), ConnectionID: 1, State: "result", Seq: 1, Rows: 1, Duration: 300},
+		{Datetime: at(3), ConnectionID: 2, State: "result", Seq: 1, Err: errNoTable, Duration: 100},
+		{Datetime: at(3), ConnectionID: 2, User: "user2", Addr: "10.0.0.2:50000", Target: "db1:3306", State: "est", Seq: 1, Command: "COM_QUERY", Cmd: "SELECT * FROM t WHERE id=2"},
+		{Datetime: at(4), ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db1:3306", State: "est", Seq: 2, Command: "COM_QUERY", Cmd: "/* tool */ alter table t add c int"},
+		{Datetime: at(4), ConnectionID: 1, State: "result", Seq: 2, Duration: 5000},
+		{Datetime: at(5), ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db1:3306", State: "est", Seq: 3, Command: "COM_PING", Cmd: "ping"},
+		{Datetime: at(5), ConnectionID: 1, State: "result", Seq: 3, Duration: 10},
+		{Datetime: at(6), ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db1:3306", State: "est", Seq: 4, Command: "COM_QUIT", Cmd: "quit"},
+		{Datetime: at(6), ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db1:3306", State: "disconnect", Err: "EOF"},
+	}
+	b := NewBuilder(1)
+	if err := b.SetGroupBy([]string{"user", "type"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		b.Add(rec)
+	}
+	got := b.Report()
+	query := "select * from `t` where `id` = ?"
+	queryDigest, _ := decoder.Fingerprint("select * from t where id = 1")
+	alterDigest, _ := decoder.Fingerprint("alter table t add c int")
+	want := &Report{
+		From:    at(0),
+		To:      at(6),
+		Records: 8,
+		Sessions: []SessionStat{
+			{User: "user1", Target: "db1:3306", Sessions: 1, Statements: 3},
+			{User: "user2", Target: "db1:3306", Sessions: 1, Statements: 1, Errors: 1},
+		},
+		Statements: []TypeStat{
+			{Type: "SELECT", Count: 2, Errors: 1, Total: 400},
+			{Type: "ALTER", Count: 1, Total: 5000},
+			{Type: "COM_PING", Count: 1, Total: 10},
+		},
+		TopByCount: []QueryStat{{Digest: queryDigest, Query: query, Count: 2, Errors: 1, Total: 400, Max: 300}},
+		TopByTime:  []QueryStat{{Digest: alterDigest, Query: "alter table `t` add `c` int", Count: 1, Total: 5000, Max: 5000}},
+		Errors: []ErrorStat{
+			{User: "user2", Statements: 1, Errors: 1, Rate: 1},
+			{User: "user1", Statements: 3},
+		},
+		DDL: []DDLEvent{
+			{Time: at(4), ConnectionID: 1, User: "user1", Addr: "10.0.0.1:50000", Target: "db1:3306", SQL: "/* tool */ alter table t add c int"},
+		},
+		Clients: []ClientStat{
+			{Addr: "10.0.0.1", FirstSeen: at(0), LastSeen: at(6), Sessions: 1, Users: []string{"user1"}},
+			{Addr: "10.0.0.2", FirstSeen: at(1), LastSeen: at(3), Sessions: 1, Users: []string{"user2"}},
+		},
+		Groups: &Groups{
+			By: []string{"user", "type"},
+			Groups: []GroupStat{
+				{Keys: []string{"user1", "ALTER"}, Count: 1, Total: 5000},
+				{Keys: []string{"user1", "COM_PING"}, Count: 1, Total: 10},
+				{Keys: []string{"user1", "SELECT"}, Count: 1, Total: 300},
+				{Keys: []string{"user2", "SELECT"}, Count: 1, Errors: 1, Total: 100},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("report mismatch (-want +got):\n%s", diff)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := got.WriteCSV(buf, "errors"); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "USER,STATEMENTS,ERRORS,RATE\nuser2,1,1,100.00%\nuser1,3,0,0.00%\n"
+	if diff := cmp.Diff(wantCSV, buf.String()); diff != "" {
+		t.Errorf("csv mismatch (-want +got):\n%s", diff)
+	}
+	if err := got.WriteCSV(buf, "nothing"); err == nil {
+		t.Errorf("unknown section: no error")
+	}
+	if err := b.SetGroupBy([]string{"nothing"}); err == nil {
+		t.Errorf("unknown group-by key: no error")
+	}
+}
@@ -0,0 +1,98 @@
+package route
+
+import (
+	"sync"
+	"time"
+)
+
+// Health is the circuit breaker of the backends: a backend that failed
+// some times in a row is skipped for a cooldown, then given one trial,
+// which closes the circuit again or opens it for another cooldown. It is
+// safe for concurrent use.
+type Health struct {
+	failures int // in a row that open the circuit, 0 never opens it
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	backends map[string]*backend
+}
+
+type backend struct {
+	failures  int       // in a row
+	openUntil time.Time // skipped until then once the circuit is open
+}
+
+// NewHealth returns a Health opening the circuit of a backend after
+// failures in a row, for cooldown.
+func NewHealth(failures int, cooldown time.Duration) *Health {
+	return &Health{failures: failures, cooldown: cooldown, backends: map[string]*backend{}}
+}
+
+// Allow reports whether addr may be connected to. Once the cooldown of an
+// open circuit is over, the first caller is let through for a trial and
+// the others wait for another cooldown.
+func (h *Health) Allow(addr string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.backends[addr]
+	if b == nil || !h.open(b) {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(h.cooldown)
+	return true
+}
+
+// Success records that addr answered. It reports whether its circuit was
+// open.
+func (h *Health) Success(addr string) (closed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.backends[addr]
+	if b == nil {
+		return false
+	}
+	delete(h.backends, addr)
+	return h.open(b)
+}
+
+// Failure records that addr did not answer. It reports whether this opened
+// its circuit.
+func (h *Health) Failure(addr string, now time.Time) (opened bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.backends[addr]
+	if b == nil {
+		b = &backend{}
+		h.backends[addr] = b
+	}
+	wasOpen := h.open(b)
+	b.failures++
+	if h.open(b) {
+		b.openUntil = now.Add(h.cooldown)
+	}
+	return !wasOpen && h.open(b)
+}
+
+func (h *Health) open(b *backend) bool {
+	return h.failures > 0 && b.failures >= h.failures
+}
+
+// Addresses returns the backends and replicas of all routes, with the port
+// added, each once.
+func (t *Table) Addresses() []string {
+	seen := map[string]bool{}
+	addrs := []string{}
+	for _, r := range t.Routes {
+		for _, b := range append(r.Backends[:len(r.Backends):len(r.Backends)], r.Replicas...) {
+			addr := AddPort(b)
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,63 @@
+package route
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth(2, 30*time.Second)
+	now := time.Unix(1700000000, 0)
+	type step struct {
+		name string
+		do   func() bool
+		want bool
+	}
+	steps := []step{
+		{"allowed", func() bool { return h.Allow("db1:3306", now) }, true},
+		{"first failure", func() bool { return h.Failure("db1:3306", now) }, false},
+		{"allowed after one failure", func() bool { return h.Allow("db1:3306", now) }, true},
+		{"second failure opens", func() bool { return h.Failure("db1:3306", now) }, true},
+		{"skipped while open", func() bool { return h.Allow("db1:3306", now.Add(29*time.Second)) }, false},
+		{"other backend", func() bool { return h.Allow("db2:3306", now) }, true},
+		{"trial after cooldown", func() bool { return h.Allow("db1:3306", now.Add(30*time.Second)) }, true},
+		{"one trial only", func() bool { return h.Allow("db1:3306", now.Add(31*time.Second)) }, false},
+		{"failed trial keeps it open", func() bool { return h.Failure("db1:3306", now.Add(31*time.Second)) }, false},
+		{"skipped after failed trial", func() bool { return h.Allow("db1:3306", now.Add(60*time.Second)) }, false},
+		{"success closes", func() bool { return h.Success("db1:3306") }, true},
+		{"allowed again", func() bool { return h.Allow("db1:3306", now.Add(60*time.Second)) }, true},
+		{"success of a closed one", func() bool { return h.Success("db1:3306") }, false},
+	}
+	for _, s := range steps {
+		if got := s.do(); got != s.want {
+			t.Errorf("%s: got %v, want %v", s.name, got, s.want)
+		}
+	}
+}
+
+func TestHealthWithoutBreaker(t *testing.T) {
+	h := NewHealth(0, time.Minute)
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 10; i++ {
+		if h.Failure("db1:3306", now) {
+			t.Fatal("circuit opened")
+		}
+	}
+	if !h.Allow("db1:3306", now) {
+		t.Error("backend skipped")
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	tbl, err := Load(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"sales-replica:3306", "sales-batch:3307", "sales-primary:3306", "[2001:db8::5]:3306", "sales-replica2:3306", "night:3306", "dev.internal:3306"}
+	if diff := cmp.Diff(want, tbl.Addresses()); diff != "" {
+		t.Errorf("addresses mismatch (-want +got):\n%s", diff)
+	}
+}
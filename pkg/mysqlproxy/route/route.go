@@ -0,0 +1,251 @@
+// Package route resolves the target named at login to backend addresses.
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the port of an address given without one.
+const DefaultPort = "3306"
+
+// Table maps logical target names to backends. Clients log in as
+// user@name and the first route of the name whose conditions the session
+// meets gives the backends.
+type Table struct {
+	Routes []Route `json:"routes"`
+}
+
+// Route is a rule of the table. Empty conditions match every session.
+type Route struct {
+	Name     string   `json:"name"`           // logical target, a path.Match pattern
+	From     []string `json:"from,omitempty"` // client networks in CIDR notation
+	DB       []string `json:"db,omitempty"`   // path.Match patterns of the database given at login
+	Days     []string `json:"days,omitempty"` // days of the week, "Mon" to "Sun"
+	Time     string   `json:"time,omitempty"` // "09:00-18:00" in local time; a window may span midnight
+	Backends []string `json:"backends"`       // addresses, tried in order
+	// addresses of the replicas taking the reads of the users that split
+	// them, tried in order
+	Replicas []string `json:"replicas,omitempty"`
+
+	nets       []*net.IPNet
+	days       uint8 // bit of each time.Weekday
+	start, end int   // minutes of the day
+}
+
+// Session is what a route is chosen by.
+type Session struct {
+	Target string    // what follows @ in the login name
+	Client net.Addr  // address of the client
+	DB     string    // database given at login
+	Time   time.Time // of the login
+}
+
+// Load reads a table in JSON and checks its routes.
+func Load(r io.Reader) (*Table, error) {
+	t := &Table{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(t); err != nil {
+		return nil, fmt.Errorf("route table: %w", err)
+	}
+	for i := range t.Routes {
+		if err := t.Routes[i].compile(); err != nil {
+			return nil, fmt.Errorf("route %d %q: %w", i+1, t.Routes[i].Name, err)
+		}
+	}
+	return t, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (r *Route) compile() error {
+	if _, err := path.Match(r.Name, ""); err != nil {
+		return err
+	}
+	if len(r.Backends) == 0 {
+		return errors.New("no backends")
+	}
+	for _, cidr := range r.From {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		r.nets = append(r.nets, n)
+	}
+	for _, db := range r.DB {
+		if _, err := path.Match(db, ""); err != nil {
+			return err
+		}
+	}
+	for _, day := range r.Days {
+		d, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+		r.days |= 1 << d
+	}
+	if len(r.Time) > 0 {
+		from, to, ok := strings.Cut(r.Time, "-")
+		var err error
+		if !ok {
+			return fmt.Errorf("time %q is not a window", r.Time)
+		}
+		if r.start, err = minutes(from); err != nil {
+			return err
+		}
+		if r.end, err = minutes(to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// minutes parses "15:04" into minutes of the day.
+func minutes(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("time %q: %w", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Lookup returns the first route of s.Target that s meets, or nil. named
+// is false if no route has the name, in which case the target is an
+// address itself.
+func (t *Table) Lookup(s Session) (r *Route, named bool) {
+	for i := range t.Routes {
+		r := &t.Routes[i]
+		if ok, _ := path.Match(r.Name, s.Target); !ok {
+			continue
+		}
+		named = true
+		if r.matches(s) {
+			return r, true
+		}
+	}
+	return nil, named
+}
+
+func (r *Route) matches(s Session) bool {
+	if len(r.nets) > 0 && !r.from(s.Client) {
+		return false
+	}
+	if len(r.DB) > 0 && !r.db(s.DB) {
+		return false
+	}
+	if r.days != 0 && r.days&(1<<s.Time.Weekday()) == 0 {
+		return false
+	}
+	if len(r.Time) > 0 {
+		m := s.Time.Hour()*60 + s.Time.Minute()
+		if r.start <= r.end {
+			return r.start <= m && m < r.end
+		}
+		return m >= r.start || m < r.end
+	}
+	return true
+}
+
+func (r *Route) from(addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// e.g. a client of a unix socket
+		return false
+	}
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Route) db(name string) bool {
+	for _, pattern := range r.DB {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AddPort adds DefaultPort to an address without a port, and makes an empty
+// address localhost. IPv6 literals may be given with or without brackets,
+// e.g. "[2001:db8::1]:3307", "[2001:db8::1]" or "2001:db8::1".
+func AddPort(s string) string {
+	if len(s) == 0 {
+		return net.JoinHostPort("localhost", DefaultPort)
+	}
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+	host := s
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.JoinHostPort(host, DefaultPort)
+}
+
+// File is a Table read from a file, and read again when the file changes.
+// It is safe for concurrent use.
+type File struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	table   *Table
+}
+
+// Open reads the table of a file.
+func Open(name string) (*File, error) {
+	f := &File{path: name}
+	if _, err := f.Table(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Table returns the table of the file. If the file was changed into a table
+// that cannot be read, the previous one is returned with the error.
+func (f *File) Table() (*Table, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return f.table, err
+	}
+	if f.table != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.table, nil
+	}
+	r, err := os.Open(f.path)
+	if err != nil {
+		return f.table, err
+	}
+	defer r.Close()
+	t, err := Load(r)
+	if err != nil {
+		return f.table, fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.table, f.modTime, f.size = t, fi.ModTime(), fi.Size()
+	return t, nil
+}
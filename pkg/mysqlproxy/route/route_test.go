@@ -0,0 +1,179 @@
+package route
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const table = `{"routes":[
+	{"name":"sales","from":["10.1.0.0/16","2001:db8::/32"],"backends":["sales-replica"]},
+	{"name":"sales","db":["report*"],"days":["Sat","Sun"],"backends":["sales-batch:3307"]},
+	{"name":"sales","time":"22:00-06:00","backends":["sales-batch:3307"]},
+	{"name":"sales","backends":["sales-primary","[2001:db8::5]:3306"],"replicas":["sales-replica","sales-replica2"]},
+	{"name":"night","time":"22:00-06:00","backends":["night"]},
+	{"name":"dev-*","backends":["dev.internal"]}
+]}`
+
+func TestLookup(t *testing.T) {
+	tbl, err := Load(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := func(s string) net.Addr { a, _ := net.ResolveTCPAddr("tcp", s); return a }
+	monday := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	saturday := time.Date(2024, 1, 6, 12, 0, 0, 0, time.Local)
+	testcase := []struct {
+		name     string
+		session  Session
+		backends []string
+		replicas []string
+		named    bool
+	}{
+		{
+			name:     "client network",
+			session:  Session{Target: "sales", Client: tcp("10.1.2.3:50000"), Time: monday},
+			backends: []string{"sales-replica"},
+			named:    true,
+		},
+		{
+			name:     "client ipv6 network",
+			session:  Session{Target: "sales", Client: tcp("[2001:db8::9]:50000"), Time: monday},
+			backends: []string{"sales-replica"},
+			named:    true,
+		},
+		{
+			name:     "database and days",
+			session:  Session{Target: "sales", Client: tcp("10.2.0.1:50000"), DB: "reports", Time: saturday},
+			backends: []string{"sales-batch:3307"},
+			named:    true,
+		},
+		{
+			name:     "database on another day",
+			session:  Session{Target: "sales", Client: tcp("10.2.0.1:50000"), DB: "reports", Time: monday},
+			backends: []string{"sales-primary", "[2001:db8::5]:3306"},
+			replicas: []string{"sales-replica", "sales-replica2"},
+			named:    true,
+		},
+		{
+			name:     "time window past midnight",
+			session:  Session{Target: "sales", Client: tcp("10.2.0.1:50000"), Time: monday.Add(11 * time.Hour)},
+			backends: []string{"sales-batch:3307"},
+			named:    true,
+		},
+		{
+			name:     "end of the time window",
+			session:  Session{Target: "sales", Client: tcp("10.2.0.1:50000"), Time: monday.Add(18 * time.Hour)},
+			backends: []string{"sales-primary", "[2001:db8::5]:3306"},
+			replicas: []string{"sales-replica", "sales-replica2"},
+			named:    true,
+		},
+		{
+			name:    "no route matches",
+			session: Session{Target: "night", Time: monday},
+			named:   true,
+		},
+		{
+			name:     "pattern",
+			session:  Session{Target: "dev-42", Time: monday},
+			backends: []string{"dev.internal"},
+			named:    true,
+		},
+		{
+			name:    "address",
+			session: Session{Target: "10.0.0.5:3306", Time: monday},
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			r, named := tbl.Lookup(tc.session)
+			var backends, replicas []string
+			if r != nil {
+				backends, replicas = r.Backends, r.Replicas
+			}
+			if diff := cmp.Diff(tc.backends, backends); diff != "" {
+				t.Errorf("backends mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.replicas, replicas); diff != "" {
+				t.Errorf("replicas mismatch (-want +got):\n%s", diff)
+			}
+			if named != tc.named {
+				t.Errorf("named = %v, want %v", named, tc.named)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	testcase := map[string]string{
+		"no backends":   `{"routes":[{"name":"a"}]}`,
+		"bad network":   `{"routes":[{"name":"a","from":["10.0.0.0/33"],"backends":["b"]}]}`,
+		"bad day":       `{"routes":[{"name":"a","days":["Someday"],"backends":["b"]}]}`,
+		"bad time":      `{"routes":[{"name":"a","time":"9-18","backends":["b"]}]}`,
+		"bad pattern":   `{"routes":[{"name":"[","backends":["b"]}]}`,
+		"unknown field": `{"routes":[{"name":"a","backend":["b"]}]}`,
+	}
+	for name, js := range testcase {
+		if _, err := Load(strings.NewReader(js)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestAddPort(t *testing.T) {
+	testcase := map[string]string{
+		"":                   "localhost:3306",
+		"db1":                "db1:3306",
+		"db1:3307":           "db1:3307",
+		"10.0.0.1":           "10.0.0.1:3306",
+		"2001:db8::1":        "[2001:db8::1]:3306",
+		"[2001:db8::1]":      "[2001:db8::1]:3306",
+		"[2001:db8::1]:3307": "[2001:db8::1]:3307",
+		"::1":                "[::1]:3306",
+	}
+	for in, want := range testcase {
+		if got := AddPort(in); got != want {
+			t.Errorf("AddPort(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "routes.json")
+	write := func(js string, mod time.Time) {
+		if err := os.WriteFile(name, []byte(js), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(`{"routes":[{"name":"a","backends":["b1"]}]}`, now)
+	f, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func() []string {
+		tbl, _ := f.Table()
+		r, _ := tbl.Lookup(Session{Target: "a"})
+		return r.Backends
+	}
+	write(`{"routes":[{"name":"a","backends":["b2"]}]}`, now.Add(time.Second))
+	if diff := cmp.Diff([]string{"b2"}, lookup()); diff != "" {
+		t.Errorf("changed table mismatch (-want +got):\n%s", diff)
+	}
+	// a broken file keeps the table read before
+	write(`{"routes":[{"name":"a"}]}`, now.Add(2*time.Second))
+	if _, err := f.Table(); err == nil {
+		t.Error("broken table: no error")
+	}
+	if diff := cmp.Diff([]string{"b2"}, lookup()); diff != "" {
+		t.Errorf("kept table mismatch (-want +got):\n%s", diff)
+	}
+}
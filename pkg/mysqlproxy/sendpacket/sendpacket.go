@@ -10,6 +10,20 @@ const (
 	maxBuf = 64 * 1024 * 1024
 )
 
+// Versions of the binary layout written by EncodePacket.
+const (
+	Version100     = 100 // time, id, user, db, addr, state, err, cmd, packets
+	Version101     = 101 // + target
+	Version102     = 102 // + seq, duration, rows, affected
+	Version103     = 103 // + capture
+	Version104     = 104 // + infile
+	Version105     = 105 // + truncated
+	Version106     = 106 // + attributes
+	Version107     = 107 // + parts
+	Version108     = 108 // + status
+	CurrentVersion = Version108
+)
+
 type SendPacket struct {
 	Datetime     int64  `json:"time"` // unix time
 	ConnectionID uint32 `json:"id,omitempty"`
@@ -20,6 +34,17 @@ type SendPacket struct {
 	Err          string `json:"err,omitempty"`     // 6
 	Packets      []byte `json:"packets,omitempty"` // 7
 	Cmd          string `json:"cmd,omitempty"`
+	Target       string `json:"target,omitempty"`        // address of the target mysql
+	Seq          uint32 `json:"seq,omitempty"`           // number of the command in the session
+	Duration     int64  `json:"duration,omitempty"`      // microseconds, of "result" records
+	Rows         uint64 `json:"rows,omitempty"`          // rows returned, of "result" records
+	Affected     uint64 `json:"affected,omitempty"`      // rows affected, of "result" records
+	Capture      []byte `json:"capture,omitempty"`       // JSON of the captured result set, of "result" records
+	Infile       []byte `json:"infile,omitempty"`        // JSON of the LOAD DATA LOCAL INFILE file, of "result" records
+	Truncated    uint64 `json:"truncated,omitempty"`     // payload length of a command whose Packets hold the beginning only
+	Attributes   []byte `json:"attributes,omitempty"`    // JSON of the query attributes of a command
+	Parts        []byte `json:"parts,omitempty"`         // JSON of the results of a response that holds several, of "result" records
+	Status       uint16 `json:"server_status,omitempty"` // server status flags ending the response, of "result" records
 }
 
 func writeBytes(w io.Writer, b []byte) error {
@@ -62,21 +87,59 @@ func EncodePacket(w io.Writer, bbp *SendPacket) error {
 	if err := writeBytes(w, bbp.Packets); err != nil {
 		return err
 	}
+	if err := writeBytes(w, []byte(bbp.Target)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bbp.Seq); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bbp.Duration); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bbp.Rows); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bbp.Affected); err != nil {
+		return err
+	}
+	if err := writeBytes(w, bbp.Capture); err != nil {
+		return err
+	}
+	if err := writeBytes(w, bbp.Infile); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bbp.Truncated); err != nil {
+		return err
+	}
+	if err := writeBytes(w, bbp.Attributes); err != nil {
+		return err
+	}
+	if err := writeBytes(w, bbp.Parts); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bbp.Status); err != nil {
+		return err
+	}
 	return nil
 }
 
 type Decoder struct {
-	buf []byte
-	r   io.Reader
+	buf     []byte
+	r       io.Reader
+	version int
 }
 
 func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{
-		buf: make([]byte, 1024),
-		r:   r,
+		buf:     make([]byte, 1024),
+		r:       r,
+		version: CurrentVersion,
 	}
 }
 
+// SetVersion makes the decoder read packets written in an older layout.
+func (d *Decoder) SetVersion(version int) { d.version = version }
+
 func (d *Decoder) readBytes(r io.Reader) ([]byte, error) {
 	var len uint32
 	if err := binary.Read(r, binary.LittleEndian, &len); err != nil {
@@ -141,5 +204,98 @@ func (d *Decoder) DecodePacket(bbp *SendPacket) error {
 	}
 	bbp.Packets = data
 
+	bbp.Target = ""
+	if d.version >= Version101 {
+		if bbp.Target, err = d.readString(); err != nil {
+			return err
+		}
+	}
+
+	bbp.Seq, bbp.Duration, bbp.Rows, bbp.Affected = 0, 0, 0, 0
+	if d.version >= Version102 {
+		if err := binary.Read(d.r, binary.LittleEndian, &bbp.Seq); err != nil {
+			return err
+		}
+		if err := binary.Read(d.r, binary.LittleEndian, &bbp.Duration); err != nil {
+			return err
+		}
+		if err := binary.Read(d.r, binary.LittleEndian, &bbp.Rows); err != nil {
+			return err
+		}
+		if err := binary.Read(d.r, binary.LittleEndian, &bbp.Affected); err != nil {
+			return err
+		}
+	}
+
+	bbp.Capture = nil
+	if d.version >= Version103 {
+		capture, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if len(capture) > 0 {
+			bbp.Capture = []byte(capture)
+		}
+	}
+
+	bbp.Infile = nil
+	if d.version >= Version104 {
+		infile, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if len(infile) > 0 {
+			bbp.Infile = []byte(infile)
+		}
+	}
+
+	bbp.Truncated = 0
+	if d.version >= Version105 {
+		if err := binary.Read(d.r, binary.LittleEndian, &bbp.Truncated); err != nil {
+			return err
+		}
+	}
+
+	bbp.Attributes = nil
+	if d.version >= Version106 {
+		attributes, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if len(attributes) > 0 {
+			bbp.Attributes = []byte(attributes)
+		}
+	}
+
+	bbp.Parts = nil
+	if d.version >= Version107 {
+		parts, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if len(parts) > 0 {
+			bbp.Parts = []byte(parts)
+		}
+	}
+
+	bbp.Status = 0
+	if d.version >= Version108 {
+		if err := binary.Read(d.r, binary.LittleEndian, &bbp.Status); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// readString reads the fields that follow Packets, which keeps referring to d.buf.
+func (d *Decoder) readString() (string, error) {
+	var len uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &len); err != nil {
+		return "", err
+	}
+	b := make([]byte, len)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -28,6 +28,17 @@ func TestEncodeDecode(t *testing.T) {
 				Err:          "xxxx",
 				Cmd:          "abc",
 				Packets:      []byte("abcabc"),
+				Target:       "127.0.0.1:3306",
+				Seq:          3,
+				Duration:     1500,
+				Rows:         10,
+				Affected:     2,
+				Capture:      []byte(`{"columns":[{"name":"id","type":"LONG"}]}`),
+				Infile:       []byte(`{"name":"a.csv","bytes":3,"sha256":"ba7816bf"}`),
+				Truncated:    20000000,
+				Attributes:   []byte(`{"traceparent":"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}`),
+				Parts:        []byte(`[{"affected":1},{"result_set":true,"rows":2}]`),
+				Status:       0x42,
 			},
 		},
 		{
@@ -104,5 +115,30 @@ func TestEncodeDecode(t *testing.T) {
 			}
 		})
 	})
+}
 
+func TestDecodeVersion100(t *testing.T) {
+	packet := SendPacket{Datetime: 1234, ConnectionID: 1, User: "user", State: "est", Cmd: "abc", Packets: []byte("abcabc"), Target: "db:3306", Seq: 1}
+	w := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := EncodePacket(w, &packet); err != nil {
+			t.Fatal(err)
+		}
+		// drop the fields added after v1.00
+		w.Truncate(w.Len() - 4 - len(packet.Target) - 4 - 8 - 8 - 8 - 4 - 4 - 8 - 4 - 4 - 2)
+	}
+	r := NewDecoder(w)
+	r.SetVersion(Version100)
+	want := packet
+	want.Target = ""
+	want.Seq = 0
+	for i := 0; i < 2; i++ {
+		res := SendPacket{Target: "stale"}
+		if err := r.DecodePacket(&res); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, res); diff != "" {
+			t.Errorf("packet mismatch (-want +got):\n%s", diff)
+		}
+	}
 }
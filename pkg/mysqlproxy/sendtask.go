@@ -2,14 +2,25 @@ package mysqlproxy
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/mask"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
 	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
 )
 
@@ -17,6 +28,7 @@ type LogWriter interface {
 	PushToLogChannel(ctx context.Context, sp *sendpacket.SendPacket) error
 	PutSendPacket(b *sendpacket.SendPacket)
 	GetSendPacket() *sendpacket.SendPacket
+	GrowPackets(b []byte, size int) []byte
 	CloseChannel()
 }
 
@@ -29,16 +41,64 @@ type SendTask struct {
 	ConnID uint32
 	Config *ProxyCfg
 	LogWriter
+	Tracker *protocol.Tracker // follows the responses of the target, may be nil
+	Masker  *mask.Masker      // may be nil
+	Capture bool              // the Tracker captures results, see ProxyCfg.CaptureUsers
+	// frames of the target, nil unless the proxy and the target use the compressed protocol
+	TargetFrames *protocol.Compressed
+	// the client sends query attributes with COM_QUERY and COM_STMT_EXECUTE
+	QueryAttributes bool
+	// the target takes them too, else they are left out of the commands sent
+	TargetAttributes bool
+	// takes the reads of a session that splits reads and writes, see
+	// ProxyCfg.SplitUsers; nil otherwise
+	Replica *Replica
+
+	seq         uint32 // number of the last command sent by the client
+	command     byte   // of the last command
+	commandSize uint64 // payload length of the last command, over all its packets
+	continued   bool   // the last packet of the command is followed by more
+	part        bool   // the last packet continues a command
+	infile      *infileSum
+	infileData  bool                        // the last packet is part of a LOAD DATA LOCAL INFILE file
+	attributes  map[string]string           // query attributes of the last command, until logged
+	params      map[uint32][]protocol.Param // bound by the last execution, by statement
+	longData    map[uint32]map[uint16]bool  // parameters sent by COM_STMT_SEND_LONG_DATA, by statement
+	toReplica   bool                        // the last command went to the Replica
+	db          string                      // current database of the session, under mu
+	usesDB      map[uint32]string           // databases selected by commands waiting for their results, by seq, under mu
+	pinned      bool                        // the rest of the session goes to the target, see pin
+	status      atomic.Uint32               // server status of the target after its last response
+
+	mu        sync.Mutex
+	captured  map[uint32]string          // queries whose captured results are masked, by seq
+	preparing map[uint32]bool            // COM_STMT_PREPARE of statements whose parameters are masked, by seq
+	sensitive map[uint32]bool            // statements whose parameters are masked, by id
+	infiles   map[uint32]protocol.Infile // files sent for LOAD DATA LOCAL INFILE, by seq
+}
+
+// infileSum sums up a LOAD DATA LOCAL INFILE file while it is sent.
+type infileSum struct {
+	hash  hash.Hash
+	bytes int64
 }
 
 func (st *SendTask) Worker(ctx context.Context) error {
 	var sp *sendpacket.SendPacket
+	var cmd *sendpacket.SendPacket // command continued in the next packets
 	defer func() {
 		if sp != nil {
 			st.PutSendPacket(sp)
 		}
+		if cmd != nil {
+			// never completed, the target does not run it
+			st.PutSendPacket(cmd)
+		}
 		st.sendState(ctx, "disconnect")
 	}()
+	st.mu.Lock()
+	st.db = st.DB
+	st.mu.Unlock()
 	st.sendState(ctx, "connect")
 	for {
 		select {
@@ -51,11 +111,50 @@ func (st *SendTask) Worker(ctx context.Context) error {
 		}
 		var err error
 		sp.Packets, err = st.writeBufferAndSend(ctx, sp.Packets)
+		sp.Seq = st.seq
+		// the result of a USE may have come while the command was read
+		sp.Db = st.database()
+		if st.toReplica {
+			sp.Target = st.Replica.Addr
+		}
 		if err != nil && err != io.EOF {
 			log.Printf("writeBufferAndSend err:%v", err)
 			return err
 		}
-		if len(sp.Packets) > 0 {
+		switch {
+		case st.infileData:
+			if st.Config.InfileContent && len(sp.Packets) > 4 {
+				sp.State = "infile"
+			} else {
+				// summed up in the result of the command
+				sp.Packets = sp.Packets[:0]
+			}
+		case st.part && cmd != nil:
+			st.appendPart(cmd, sp.Packets[4:])
+			sp.Packets = sp.Packets[:0]
+		case st.continued && len(sp.Packets) > 0:
+			// logged once the command is complete
+			cmd, sp = sp, nil
+		}
+		if cmd != nil && !st.continued {
+			if sp != nil {
+				st.PutSendPacket(sp)
+			}
+			sp, cmd = cmd, nil
+		}
+		if sp != nil && len(sp.Packets) > 0 {
+			if sp.State == "est" && sp.Packets[3] == 0 {
+				st.limitCommand(sp)
+				if st.attributes != nil {
+					sp.Attributes, _ = json.Marshal(st.attributes)
+					st.attributes = nil
+				}
+				if st.Masker != nil {
+					// the target has the command already
+					sp.Packets = st.Masker.MaskPacket(sp.Packets, sp.Db)
+					sp.Packets = st.maskParams(sp.Packets)
+				}
+			}
 			if err := st.PushToLogChannel(ctx, sp); err != nil {
 				return err
 			}
@@ -67,6 +166,31 @@ func (st *SendTask) Worker(ctx context.Context) error {
 	}
 }
 
+// appendPart adds the payload of a packet continuing the command of cmd,
+// as far as ProxyCfg.LogCommandLimit allows.
+func (st *SendTask) appendPart(cmd *sendpacket.SendPacket, payload []byte) {
+	if limit := st.Config.LogCommandLimit; limit > 0 {
+		payload = payload[:max(0, min(len(payload), limit+4-len(cmd.Packets)))]
+	}
+	n := len(cmd.Packets)
+	cmd.Packets = st.GrowPackets(cmd.Packets, n+len(payload))
+	copy(cmd.Packets[n:], payload)
+}
+
+// limitCommand cuts the payload of a command at ProxyCfg.LogCommandLimit
+// and marks it with the length of the whole payload if anything is left
+// out. The length in the header is at most that of one packet.
+func (st *SendTask) limitCommand(sp *sendpacket.SendPacket) {
+	if limit := st.Config.LogCommandLimit; limit > 0 && len(sp.Packets)-4 > limit {
+		sp.Packets = sp.Packets[:4+limit]
+	}
+	if st.commandSize > uint64(len(sp.Packets)-4) {
+		sp.Truncated = st.commandSize
+	}
+	length := min(len(sp.Packets)-4, mysql.MaxPayloadLen)
+	sp.Packets[0], sp.Packets[1], sp.Packets[2] = byte(length), byte(length>>8), byte(length>>16)
+}
+
 func (st *SendTask) sendState(ctx context.Context, state string) error {
 	sp := st.newSendPacket()
 	sp.State = state
@@ -74,12 +198,205 @@ func (st *SendTask) sendState(ctx context.Context, state string) error {
 	return st.PushToLogChannel(ctx, sp)
 }
 
+// sendResult logs the response of the target, or of the replica at addr,
+// to a command. It is called from the goroutine copying the responses of
+// the target to the client, and from the Worker for the replica.
+func (st *SendTask) sendResult(ctx context.Context, addr string, r protocol.Result) {
+	st.selectDB(r)
+	if st.Masker != nil {
+		st.prepared(r)
+	}
+	sp := st.newSendPacket()
+	sp.State = "result"
+	sp.Target = addr
+	sp.Seq = r.Seq
+	sp.Err = r.Err
+	sp.Duration = r.Duration.Microseconds()
+	sp.Rows = r.Rows
+	sp.Affected = r.Affected
+	sp.Status = r.Status
+	sp.Packets = sp.Packets[:0]
+	if st.Capture && st.Masker != nil {
+		query := st.takeQuery(r.Seq)
+		if r.Capture != nil {
+			st.Masker.MaskCapture(r.Capture, query, sp.Db)
+		}
+	}
+	if r.Capture != nil {
+		sp.Capture, _ = json.Marshal(r.Capture)
+	}
+	if len(r.Parts) > 0 {
+		sp.Parts, _ = json.Marshal(r.Parts)
+	}
+	if f, ok := st.takeInfile(r.Seq); ok {
+		f.Name = r.Infile
+		sp.Infile, _ = json.Marshal(f)
+	}
+	if err := st.PushToLogChannel(ctx, sp); err != nil {
+		st.PutSendPacket(sp)
+	}
+}
+
+// useDB remembers the database a command selects, with COM_INIT_DB or a
+// USE query, until its result.
+func (st *SendTask) useDB(seq uint32, payload []byte) {
+	var db string
+	switch payload[0] {
+	case mysql.COM_INIT_DB:
+		db = string(payload[1:])
+	case mysql.COM_QUERY:
+		var ok bool
+		if db, ok = decoder.UseDB(string(payload[1:])); !ok {
+			return
+		}
+	default:
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.usesDB == nil {
+		st.usesDB = map[uint32]string{}
+	}
+	st.usesDB[seq] = db
+}
+
+// selectDB makes the database selected by the command of r current if it
+// succeeded.
+func (st *SendTask) selectDB(r protocol.Result) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	db, ok := st.usesDB[r.Seq]
+	if !ok {
+		return
+	}
+	delete(st.usesDB, r.Seq)
+	if len(r.Err) == 0 {
+		st.db = db
+	}
+}
+
+// database returns the current database of the session.
+func (st *SendTask) database() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.db
+}
+
+// followStatement remembers whether a COM_STMT_PREPARE prepares a statement
+// whose parameters are masked, until its result tells the statement id, and
+// forgets the statements the command closes.
+func (st *SendTask) followStatement(seq uint32, payload []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch payload[0] {
+	case mysql.COM_STMT_PREPARE:
+		if !st.Masker.Sensitive(string(payload[1:]), st.db) {
+			return
+		}
+		if st.preparing == nil {
+			st.preparing = map[uint32]bool{}
+		}
+		st.preparing[seq] = true
+	case mysql.COM_STMT_CLOSE:
+		if len(payload) >= 5 {
+			delete(st.sensitive, binary.LittleEndian.Uint32(payload[1:]))
+		}
+	case mysql.COM_RESET_CONNECTION, mysql.COM_CHANGE_USER:
+		st.sensitive = nil
+	}
+}
+
+// prepared marks the statement prepared by the command of r as one whose
+// parameters are masked, if it is.
+func (st *SendTask) prepared(r protocol.Result) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.preparing[r.Seq] {
+		return
+	}
+	delete(st.preparing, r.Seq)
+	if len(r.Err) == 0 {
+		if st.sensitive == nil {
+			st.sensitive = map[uint32]bool{}
+		}
+		st.sensitive[r.Statement] = true
+	}
+}
+
+// maskParams redacts the parameters of a command executing a statement
+// whose parameters are masked, or sending data to it.
+func (st *SendTask) maskParams(packet []byte) []byte {
+	if len(packet) < 9 || packet[4] != mysql.COM_STMT_EXECUTE && packet[4] != mysql.COM_STMT_SEND_LONG_DATA {
+		return packet
+	}
+	st.mu.Lock()
+	sensitive := st.sensitive[binary.LittleEndian.Uint32(packet[5:])]
+	st.mu.Unlock()
+	if !sensitive {
+		return packet
+	}
+	return st.Masker.MaskParams(packet)
+}
+
+// keepQuery remembers the query of a command whose result is captured, so
+// that the result can be masked like the query.
+func (st *SendTask) keepQuery(seq uint32, payload []byte) {
+	if payload[0] != mysql.COM_QUERY {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.captured == nil {
+		st.captured = map[uint32]string{}
+	}
+	st.captured[seq] = string(payload[1:])
+}
+
+func (st *SendTask) takeQuery(seq uint32) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	query := st.captured[seq]
+	delete(st.captured, seq)
+	return query
+}
+
+// readInfile sums up a packet of a LOAD DATA LOCAL INFILE file. The file
+// ends with an empty packet, which must be read before it is sent to the
+// target, so that the sum is kept before the target answers.
+func (st *SendTask) readInfile(data []byte) {
+	if st.infile == nil {
+		st.infile = &infileSum{hash: sha256.New()}
+	}
+	if len(data) > 0 {
+		st.infile.hash.Write(data)
+		st.infile.bytes += int64(len(data))
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.infiles == nil {
+		st.infiles = map[uint32]protocol.Infile{}
+	}
+	st.infiles[st.seq] = protocol.Infile{Bytes: st.infile.bytes, SHA256: hex.EncodeToString(st.infile.hash.Sum(nil))}
+	st.infile = nil
+}
+
+func (st *SendTask) takeInfile(seq uint32) (protocol.Infile, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, ok := st.infiles[seq]
+	delete(st.infiles, seq)
+	return f, ok
+}
+
 func (st *SendTask) newSendPacket() *sendpacket.SendPacket {
 	sp := st.GetSendPacket()
+	*sp = sendpacket.SendPacket{Packets: sp.Packets}
 	sp.Datetime = time.Now().Unix()
 	sp.User = st.User
 	sp.Addr = st.Reader.RemoteAddr().String()
-	sp.Db = st.DB
+	sp.Target = st.Addr
+	sp.Db = st.database()
 	sp.ConnectionID = st.ConnID
 	sp.State = "est"
 	return sp
@@ -87,6 +404,10 @@ func (st *SendTask) newSendPacket() *sendpacket.SendPacket {
 
 func (st *SendTask) readFullMysqlPacket(ctx context.Context, buf []byte) (int, error) {
 	size := 0
+	if len(buf) == 0 {
+		// an empty packet, e.g. the end of a file: nothing to wait for
+		return 0, nil
+	}
 	for {
 		if err := st.Reader.SetReadDeadline(time.Now().Add(st.Config.ConTimeout)); err != nil {
 			return 0, err
@@ -118,7 +439,7 @@ func (st *SendTask) readFullMysqlPacket(ctx context.Context, buf []byte) (int, e
 }
 
 func (st *SendTask) writeBufferAndSend(ctx context.Context, dst []byte) ([]byte, error) {
-	dst = resizeSlice(dst, 4) //[]byte{0, 0, 0, 0}
+	dst = st.GrowPackets(dst, 4) //[]byte{0, 0, 0, 0}
 	n, err := st.readFullMysqlPacket(ctx, dst)
 	if err != nil {
 		if n == 0 && err == io.EOF {
@@ -129,21 +450,170 @@ func (st *SendTask) writeBufferAndSend(ctx context.Context, dst []byte) ([]byte,
 
 	length := int(uint32(dst[0]) | uint32(dst[1])<<8 | uint32(dst[2])<<16)
 	//log.Printf("dst:%v length:%d len(dst):%d, cap(dst):%d,dst[:4]:%v", dst, length, len(dst), cap(dst), dst[:4])
-	dst = resizeSlice(dst, length+4)
+	dst = st.GrowPackets(dst, length+4)
 	//log.Printf("header:%v length:%d len(dst):%d, cap(dst):%d,dst[:4]:%v", header, length, len(dst), cap(dst), dst[:4])
 	databuf := dst[4 : length+4]
 	if n, err := st.readFullMysqlPacket(ctx, databuf); err != nil {
 		return dst, fmt.Errorf("packet readFullMysqlPacket data err: %w n:%d want:%d", err, n, len(databuf))
 	}
-	if n, err := st.Writer.Write(dst[:length+4]); err != nil {
-		return dst, fmt.Errorf("netWrite err: %w n:%d", err, n)
+	st.infileData, st.part, st.toReplica = false, false, false
+	var plain []byte // the command without query attributes
+	to := decoder.ToPrimary
+	switch {
+	case st.infile != nil:
+		// the sequence id wraps around in a file of more than 256 packets
+		st.infileData = true
+		st.readInfile(databuf)
+	case dst[3] == 0 && length > 0:
+		// sequence id 0 starts a command
+		st.seq++
+		st.command, st.continued, st.infile = databuf[0], length == mysql.MaxPayloadLen, nil
+		st.commandSize = uint64(length)
+		st.attributes = nil
+		if st.QueryAttributes {
+			plain = st.readAttributes(databuf)
+		}
+		to = st.split(databuf, plain)
+		st.toReplica = to == decoder.ToReplica
+		if plain != nil && !st.TargetAttributes {
+			dst, length = st.setPayload(dst, plain), len(plain)
+			databuf = dst[4 : length+4]
+			st.commandSize = uint64(length)
+		}
+		if st.Capture && st.Masker != nil {
+			st.keepQuery(st.seq, databuf)
+		}
+		if !st.continued {
+			payload := databuf
+			if plain != nil {
+				payload = plain
+			}
+			st.useDB(st.seq, payload)
+		}
+		if st.Masker != nil {
+			payload := databuf
+			if plain != nil {
+				payload = plain
+			}
+			st.followStatement(st.seq, payload)
+		}
+		if !st.toReplica {
+			st.expect(databuf[0])
+		}
+	case !st.continued && st.command == mysql.COM_QUERY:
+		// the file the target requested for LOAD DATA LOCAL INFILE
+		st.infileData = true
+		st.readInfile(databuf)
+	case st.continued:
+		// a command longer than one packet
+		st.part = true
+		st.continued = length == mysql.MaxPayloadLen
+		st.commandSize += uint64(length)
+	}
+	if st.toReplica {
+		sent, err := st.sendReplica(ctx, dst[:length+4])
+		if err != nil {
+			return dst, fmt.Errorf("replica err: %w", err)
+		}
+		if !sent {
+			st.toReplica = false
+			st.expect(databuf[0])
+		}
+	}
+	if !st.toReplica {
+		if n, err := st.Writer.Write(dst[:length+4]); err != nil {
+			return dst, fmt.Errorf("netWrite err: %w n:%d", err, n)
+		}
+	}
+	switch to {
+	case decoder.ToBoth:
+		if !st.Replica.follow(databuf) {
+			st.pin("too many session settings")
+		}
+	case decoder.ToPin:
+		st.pin(fmt.Sprintf("command %#x sets what only the target has", databuf[0]))
+	}
+	if plain != nil {
+		// logged without the attributes, like with any other client
+		dst, length = st.setPayload(dst, plain), len(plain)
+		st.commandSize = uint64(length)
 	}
 	return dst[:length+4], nil
 }
 
-func resizeSlice(b []byte, size int) []byte {
-	if cap(b) < size {
-		return append(b, make([]byte, size-cap(b))...)
+// expect announces the command starting in the last packet to the target.
+func (st *SendTask) expect(code byte) {
+	if st.Tracker != nil {
+		st.Tracker.Expect(st.seq, code)
+	}
+	if st.TargetFrames != nil {
+		st.TargetFrames.Reset()
+	}
+}
+
+// setPayload replaces the payload of the packet in dst.
+func (st *SendTask) setPayload(dst, payload []byte) []byte {
+	dst = st.GrowPackets(dst, 4+len(payload))
+	dst[0], dst[1], dst[2] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16)
+	copy(dst[4:], payload)
+	return dst
+}
+
+// readAttributes reads the query attributes of a command and returns the
+// command as sent without them, or nil if it has none or is not read. It
+// follows the statements to know the parameters an execution does not bind
+// again.
+func (st *SendTask) readAttributes(payload []byte) []byte {
+	var plain []byte
+	var err error
+	switch payload[0] {
+	case mysql.COM_QUERY:
+		if st.continued {
+			// the attributes begin the command, which is sent as it is
+			log.Printf("query attributes of a command of %d bytes or more are not read", mysql.MaxPayloadLen)
+			return nil
+		}
+		st.attributes, plain, err = protocol.ParseQuery(payload)
+	case mysql.COM_STMT_EXECUTE:
+		if st.continued || len(payload) < 5 {
+			return nil
+		}
+		id := binary.LittleEndian.Uint32(payload[1:])
+		var bound []protocol.Param
+		st.attributes, plain, bound, err = protocol.ParseExecute(payload, st.params[id], st.longData[id])
+		delete(st.longData, id)
+		if err == nil {
+			if st.params == nil {
+				st.params = map[uint32][]protocol.Param{}
+			}
+			st.params[id] = bound
+		}
+	case mysql.COM_STMT_SEND_LONG_DATA:
+		if len(payload) >= 7 {
+			id := binary.LittleEndian.Uint32(payload[1:])
+			if st.longData == nil {
+				st.longData = map[uint32]map[uint16]bool{}
+			}
+			if st.longData[id] == nil {
+				st.longData[id] = map[uint16]bool{}
+			}
+			st.longData[id][binary.LittleEndian.Uint16(payload[5:])] = true
+		}
+	case mysql.COM_STMT_CLOSE, mysql.COM_STMT_RESET:
+		if len(payload) >= 5 {
+			id := binary.LittleEndian.Uint32(payload[1:])
+			delete(st.longData, id)
+			if payload[0] == mysql.COM_STMT_CLOSE {
+				delete(st.params, id)
+			}
+		}
+	case mysql.COM_RESET_CONNECTION, mysql.COM_CHANGE_USER:
+		st.params, st.longData = nil, nil
+	}
+	if err != nil {
+		log.Printf("query attributes of command %#x: %v", payload[0], err)
+		st.attributes = nil
+		return nil
 	}
-	return b[:size]
+	return plain
 }
@@ -0,0 +1,625 @@
+package mysqlproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/google/go-cmp/cmp"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/mask"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+// chanLog is a LogWriter handing the records to a channel.
+type chanLog struct {
+	records chan *sendpacket.SendPacket
+}
+
+func (l *chanLog) PushToLogChannel(ctx context.Context, sp *sendpacket.SendPacket) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case l.records <- sp:
+		return nil
+	}
+}
+func (l *chanLog) PutSendPacket(b *sendpacket.SendPacket) {}
+func (l *chanLog) GetSendPacket() *sendpacket.SendPacket  { return &sendpacket.SendPacket{} }
+func (l *chanLog) GrowPackets(b []byte, size int) []byte {
+	if cap(b) < size {
+		nb := make([]byte, size)
+		copy(nb, b)
+		return nb
+	}
+	return b[:size]
+}
+func (l *chanLog) CloseChannel() {}
+
+// command returns the packet of a command.
+func command(code byte, arg string) []byte {
+	n := 1 + len(arg)
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), 0, code}, arg...)
+}
+
+// okPacket is the response to a command, without rows, in autocommit.
+var okPacket = []byte{7, 0, 0, 1, mysql.OK_HEADER, 0, 0, 2, 0, 0, 0}
+
+func TestSendTaskCurrentDB(t *testing.T) {
+	testcase := []struct {
+		name    string
+		use     []byte
+		useResp []byte
+		db      string
+		want    string
+	}{
+		{
+			name:    "use query",
+			use:     command(mysql.COM_QUERY, "USE hr"),
+			useResp: okPacket,
+			db:      "hr",
+			want:    "INSERT INTO employees VALUES ('***')",
+		},
+		{
+			name:    "init db",
+			use:     command(mysql.COM_INIT_DB, "hr"),
+			useResp: okPacket,
+			db:      "hr",
+			want:    "INSERT INTO employees VALUES ('***')",
+		},
+		{
+			name:    "failed use",
+			use:     command(mysql.COM_QUERY, "USE hr"),
+			useResp: []byte{9, 0, 0, 1, mysql.ERR_HEADER, 0x19, 0x04, 'U', 'n', 'k', 'n', 'o', 'w'},
+			db:      "app",
+			want:    "INSERT INTO employees VALUES ('123-45-6789')",
+		},
+	}
+	masker, err := mask.New(mask.Config{Literals: []string{"hr.employees"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			client, proxy := net.Pipe()
+			defer client.Close()
+			logs := &chanLog{records: make(chan *sendpacket.SendPacket, 16)}
+			st := &SendTask{
+				Reader:    proxy,
+				Writer:    io.Discard,
+				DB:        "app",
+				Config:    &ProxyCfg{ConTimeout: time.Second},
+				LogWriter: logs,
+				Masker:    masker,
+			}
+			st.Tracker = protocol.NewTracker(false, func(r protocol.Result) { st.sendResult(ctx, "db1:3306", r) })
+			done := make(chan error, 1)
+			go func() { done <- st.Worker(ctx) }()
+			next := func(state string) *sendpacket.SendPacket {
+				t.Helper()
+				for {
+					select {
+					case sp := <-logs.records:
+						if sp.State == state {
+							return sp
+						}
+					case <-ctx.Done():
+						t.Fatalf("no %s record", state)
+					}
+				}
+			}
+			if _, err := client.Write(tc.use); err != nil {
+				t.Fatal(err)
+			}
+			next("est")
+			// the target answers before the client sends its next command
+			st.Tracker.Write(tc.useResp)
+			next("result")
+			if _, err := client.Write(command(mysql.COM_QUERY, "INSERT INTO employees VALUES ('123-45-6789')")); err != nil {
+				t.Fatal(err)
+			}
+			sp := next("est")
+			if sp.Db != tc.db {
+				t.Errorf("db = %q, want %q", sp.Db, tc.db)
+			}
+			if got := string(sp.Packets[5:]); got != tc.want {
+				t.Errorf("logged %q, want %q", got, tc.want)
+			}
+			client.Close()
+			<-done
+		})
+	}
+}
+
+func TestSendTaskMaskParams(t *testing.T) {
+	execute := func(id byte, value string) []byte {
+		arg := []byte{id, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, mysql.MYSQL_TYPE_VAR_STRING, 0, byte(len(value))}
+		return command(mysql.COM_STMT_EXECUTE, string(append(arg, value...)))
+	}
+	testcase := []struct {
+		name    string
+		prepare string
+		run     []byte
+		want    []byte
+	}{
+		{
+			name:    "execute on a masked table",
+			prepare: "INSERT INTO employees (ssn) VALUES (?)",
+			run:     execute(7, "123-45-6789"),
+			want:    command(mysql.COM_STMT_EXECUTE, "\x07\x00\x00\x00\x00\x01\x00\x00\x00"+mask.Redacted),
+		},
+		{
+			name:    "long data of a masked table",
+			prepare: "INSERT INTO employees (ssn) VALUES (?)",
+			run:     command(mysql.COM_STMT_SEND_LONG_DATA, "\x07\x00\x00\x00\x00\x00123-45-6789"),
+			want:    command(mysql.COM_STMT_SEND_LONG_DATA, "\x07\x00\x00\x00\x00\x00"+mask.Redacted),
+		},
+		{
+			name:    "credential",
+			prepare: "SET PASSWORD FOR app = ?",
+			run:     execute(7, "s3cret"),
+			want:    command(mysql.COM_STMT_EXECUTE, "\x07\x00\x00\x00\x00\x01\x00\x00\x00"+mask.Redacted),
+		},
+		{
+			name:    "another statement",
+			prepare: "INSERT INTO employees (ssn) VALUES (?)",
+			run:     execute(8, "42"),
+			want:    execute(8, "42"),
+		},
+		{
+			name:    "unmasked table",
+			prepare: "INSERT INTO app.logs (msg) VALUES (?)",
+			run:     execute(7, "hello"),
+			want:    execute(7, "hello"),
+		},
+	}
+	masker, err := mask.New(mask.Config{Credentials: true, Literals: []string{"hr.employees"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			client, proxy := net.Pipe()
+			defer client.Close()
+			logs := &chanLog{records: make(chan *sendpacket.SendPacket, 16)}
+			st := &SendTask{
+				Reader:    proxy,
+				Writer:    io.Discard,
+				DB:        "hr",
+				Config:    &ProxyCfg{ConTimeout: time.Second},
+				LogWriter: logs,
+				Masker:    masker,
+			}
+			st.Tracker = protocol.NewTracker(true, func(r protocol.Result) { st.sendResult(ctx, "db1:3306", r) })
+			done := make(chan error, 1)
+			go func() { done <- st.Worker(ctx) }()
+			next := func(state string) *sendpacket.SendPacket {
+				t.Helper()
+				for {
+					select {
+					case sp := <-logs.records:
+						if sp.State == state {
+							return sp
+						}
+					case <-ctx.Done():
+						t.Fatalf("no %s record", state)
+					}
+				}
+			}
+			if _, err := client.Write(command(mysql.COM_STMT_PREPARE, tc.prepare)); err != nil {
+				t.Fatal(err)
+			}
+			next("est")
+			// statement 7, no columns nor parameters
+			st.Tracker.Write([]byte{12, 0, 0, 1, mysql.OK_HEADER, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+			next("result")
+			if _, err := client.Write(tc.run); err != nil {
+				t.Fatal(err)
+			}
+			sp := next("est")
+			if diff := cmp.Diff(tc.want, sp.Packets); diff != "" {
+				t.Errorf("logged packet mismatch (-want +got):\n%s", diff)
+			}
+			client.Close()
+			<-done
+		})
+	}
+}
+
+// filePackets returns the packets of a LOAD DATA LOCAL INFILE file sent
+// after the request of the target, with the empty packet ending it.
+func filePackets(chunks []string) []byte {
+	b := []byte{}
+	for i, c := range append(chunks, "") {
+		b = append(b, byte(len(c)), byte(len(c)>>8), byte(len(c)>>16), byte(2+i))
+		b = append(b, c...)
+	}
+	return b
+}
+
+func TestSendTaskInfile(t *testing.T) {
+	many := make([]string, 300)
+	for i := range many {
+		many[i] = fmt.Sprintf("%d,x\n", i)
+	}
+	testcase := []struct {
+		name   string
+		user   string
+		chunks []string
+		denied bool
+	}{
+		{name: "file", user: "app", chunks: []string{"1,a\n", "2,b\n"}},
+		{name: "empty file", user: "app"},
+		{name: "sequence wraparound", user: "app", chunks: many},
+		{name: "denied user", user: "etl_batch", denied: true},
+	}
+	const query = "LOAD DATA LOCAL INFILE 'orders.csv' INTO TABLE orders"
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			config := &ProxyCfg{ConTimeout: time.Second, InfileContent: true, InfileDenyUsers: "etl*"}
+			if denied := (&ProxySrv{Config: config}).deniesInfile(tc.user); denied != tc.denied {
+				t.Fatalf("denied:%v want:%v", denied, tc.denied)
+			}
+			client, proxy := net.Pipe()
+			defer client.Close()
+			target, proxyTarget := net.Pipe()
+			defer target.Close()
+			logs := &chanLog{records: make(chan *sendpacket.SendPacket, 1024)}
+			st := &SendTask{
+				Reader:    proxy,
+				Writer:    proxyTarget,
+				Config:    config,
+				LogWriter: logs,
+			}
+			st.Tracker = protocol.NewTracker(false, func(r protocol.Result) { st.sendResult(ctx, "db1:3306", r) })
+			done := make(chan error, 1)
+			go func() { done <- st.Worker(ctx) }()
+			infiles := 0
+			next := func(state string) *sendpacket.SendPacket {
+				t.Helper()
+				for {
+					select {
+					case sp := <-logs.records:
+						if sp.State == "infile" {
+							infiles++
+						}
+						if sp.State == state {
+							return sp
+						}
+					case <-ctx.Done():
+						t.Fatalf("no %s record", state)
+					}
+				}
+			}
+			// send writes packets of the client and returns what the target received
+			send := func(packets []byte) []byte {
+				t.Helper()
+				go client.Write(packets)
+				got := make([]byte, len(packets))
+				if _, err := io.ReadFull(target, got); err != nil {
+					t.Fatal(err)
+				}
+				return got
+			}
+			sent := command(mysql.COM_QUERY, query)
+			if !tc.denied {
+				// the target requests the file, which it has once the empty packet is read
+				sent = append(sent, filePackets(tc.chunks)...)
+			}
+			if got := send(sent); !bytes.Equal(got, sent) {
+				t.Errorf("target received %d bytes, want %d", len(got), len(sent))
+			}
+			if sp := next("est"); sp.Seq != 1 {
+				t.Errorf("statement seq %d", sp.Seq)
+			}
+			response := append(append([]byte{11, 0, 0, 1, 0xfb}, "orders.csv"...), okPacket...)
+			if tc.denied {
+				// without CLIENT_LOCAL_FILES
+				response = append([]byte{9, 0, 0, 1, mysql.ERR_HEADER, 0x7c, 0x04}, "#42000"...)
+			}
+			st.Tracker.Write(response)
+			r := next("result")
+			if r.Seq != 1 {
+				t.Errorf("result seq %d", r.Seq)
+			}
+			if tc.denied {
+				if r.Infile != nil {
+					t.Errorf("infile of a denied user: %s", r.Infile)
+				}
+			} else {
+				content := strings.Join(tc.chunks, "")
+				sum := sha256.Sum256([]byte(content))
+				want := protocol.Infile{Name: "orders.csv", Bytes: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}
+				var got protocol.Infile
+				if err := json.Unmarshal(r.Infile, &got); err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("infile mismatch (-want +got):\n%s", diff)
+				}
+			}
+			// the next command follows the file, with sequence id 0 again
+			selectOne := command(mysql.COM_QUERY, "SELECT 1")
+			if got := send(selectOne); !bytes.Equal(got, selectOne) {
+				t.Errorf("target received %q, want %q", got, selectOne)
+			}
+			sp := next("est")
+			if sp.Seq != 2 || !bytes.Equal(sp.Packets, selectOne) {
+				t.Errorf("command seq:%d packets:%q", sp.Seq, sp.Packets)
+			}
+			if infiles != len(tc.chunks) {
+				t.Errorf("%d infile records, want %d", infiles, len(tc.chunks))
+			}
+			client.Close()
+			<-done
+		})
+	}
+}
+
+func TestSendTaskLongCommand(t *testing.T) {
+	// a query of two packets, the first one full
+	payload := append([]byte{mysql.COM_QUERY}, "SELECT '"...)
+	payload = append(payload, bytes.Repeat([]byte("x"), mysql.MaxPayloadLen)...)
+	payload = append(payload, "'"...)
+	frames := append([]byte{0xff, 0xff, 0xff, 0}, payload[:mysql.MaxPayloadLen]...)
+	rest := payload[mysql.MaxPayloadLen:]
+	frames = append(frames, byte(len(rest)), byte(len(rest)>>8), byte(len(rest)>>16), 1)
+	frames = append(frames, rest...)
+	testcase := []struct {
+		name      string
+		limit     int
+		logged    []byte // payload
+		truncated uint64
+	}{
+		{name: "whole", logged: payload},
+		{name: "limited", limit: 100, logged: payload[:100], truncated: uint64(len(payload))},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			client, proxy := net.Pipe()
+			target := &bytes.Buffer{}
+			logs := &chanLog{records: make(chan *sendpacket.SendPacket, 16)}
+			st := &SendTask{
+				Reader:    proxy,
+				Writer:    target,
+				Config:    &ProxyCfg{ConTimeout: time.Second, LogCommandLimit: tc.limit},
+				LogWriter: logs,
+			}
+			done := make(chan error, 1)
+			go func() { done <- st.Worker(ctx) }()
+			if _, err := client.Write(frames); err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+			<-done
+			close(logs.records)
+			commands := []*sendpacket.SendPacket{}
+			for sp := range logs.records {
+				if sp.State == "est" {
+					commands = append(commands, sp)
+				}
+			}
+			if len(commands) != 1 {
+				t.Fatalf("%d records of the command, want 1", len(commands))
+			}
+			sp := commands[0]
+			length := int(sp.Packets[0]) | int(sp.Packets[1])<<8 | int(sp.Packets[2])<<16
+			if want := min(len(tc.logged), mysql.MaxPayloadLen); length != want {
+				t.Errorf("header length %d, want %d", length, want)
+			}
+			if !bytes.Equal(sp.Packets[4:], tc.logged) {
+				t.Errorf("logged %d bytes of the payload, want %d", len(sp.Packets)-4, len(tc.logged))
+			}
+			if sp.Truncated != tc.truncated {
+				t.Errorf("truncated %d, want %d", sp.Truncated, tc.truncated)
+			}
+			if !bytes.Equal(target.Bytes(), frames) {
+				t.Errorf("target received %d bytes, want the %d bytes of the frames", target.Len(), len(frames))
+			}
+		})
+	}
+}
+
+// packetRecorder keeps the queries of the packets written to it, one
+// packet per write like the SendTask does.
+type packetRecorder struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, string(p[5:]))
+	return len(p), nil
+}
+
+func (r *packetRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.queries...)
+}
+
+func TestSendTaskSplit(t *testing.T) {
+	const (
+		primary = "primary:3306"
+		replica = "replica:3306"
+		inTrans = mysql.SERVER_STATUS_AUTOCOMMIT | mysql.SERVER_STATUS_IN_TRANS
+	)
+	type step struct {
+		query  string
+		to     string
+		status uint16 // of the response of the primary
+	}
+	testcase := []struct {
+		name    string
+		steps   []step
+		fails   bool     // the replica hangs up without a response
+		replica []string // queries run on the replica
+	}{
+		{
+			name:    "read",
+			steps:   []step{{"SELECT 1", replica, 0}},
+			replica: []string{"SELECT 1"},
+		},
+		{
+			name: "transaction",
+			steps: []step{
+				{"BEGIN", primary, inTrans},
+				{"SELECT 1", primary, inTrans},
+				{"COMMIT", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+				{"SELECT 2", replica, 0},
+			},
+			replica: []string{"SELECT 2"},
+		},
+		{
+			name: "autocommit off",
+			steps: []step{
+				{"SET autocommit = 0", primary, 0},
+				{"SELECT 1", primary, 0},
+				{"SET autocommit = 1", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+				{"SELECT 2", replica, 0},
+			},
+			replica: []string{"SET autocommit = 0", "SET autocommit = 1", "SELECT 2"},
+		},
+		{
+			name: "settings caught up",
+			steps: []step{
+				{"SET NAMES utf8mb4", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+				{"USE hr", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+				{"SELECT 1", replica, 0},
+				{"SELECT 2", replica, 0},
+			},
+			replica: []string{"SET NAMES utf8mb4", "USE hr", "SELECT 1", "SELECT 2"},
+		},
+		{
+			name: "pinned",
+			steps: []step{
+				{"SELECT 1", replica, 0},
+				{"SELECT 1 INTO @a", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+				{"SELECT @a", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+			},
+			replica: []string{"SELECT 1"},
+		},
+		{
+			name: "replica fails",
+			steps: []step{
+				{"SELECT 1", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+				{"SELECT 2", primary, mysql.SERVER_STATUS_AUTOCOMMIT},
+			},
+			fails:   true,
+			replica: []string{"SELECT 1"},
+		},
+	}
+	for _, tc := range testcase {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			client, proxy := net.Pipe()
+			defer client.Close()
+			toReplica, replicaConn := net.Pipe()
+			defer toReplica.Close()
+			// the replica answers OK to every command
+			replicaQueries := make(chan []string, 1)
+			go func() {
+				queries := []string{}
+				defer func() { replicaQueries <- queries }()
+				for {
+					seq, payload, err := readPacket(replicaConn)
+					if err != nil {
+						return
+					}
+					queries = append(queries, string(payload[1:]))
+					if tc.fails {
+						replicaConn.Close()
+						return
+					}
+					if err := writePacket(replicaConn, seq+1, []byte{mysql.OK_HEADER, 0, 0, 2, 0, 0, 0}); err != nil {
+						return
+					}
+				}
+			}()
+			logs := &chanLog{records: make(chan *sendpacket.SendPacket, 16)}
+			primaryQueries := &packetRecorder{}
+			st := &SendTask{
+				Reader:    proxy,
+				Writer:    primaryQueries,
+				Addr:      primary,
+				Config:    &ProxyCfg{ConTimeout: time.Second},
+				LogWriter: logs,
+				Replica:   NewReplica(replica, toReplica, toReplica, io.Discard, false),
+			}
+			st.status.Store(uint32(mysql.SERVER_STATUS_AUTOCOMMIT))
+			st.Tracker = protocol.NewTracker(false, func(r protocol.Result) {
+				if len(r.Err) == 0 {
+					st.status.Store(uint32(r.Status))
+				}
+				st.sendResult(ctx, primary, r)
+			})
+			done := make(chan error, 1)
+			go func() { done <- st.Worker(ctx) }()
+			next := func(state string) *sendpacket.SendPacket {
+				t.Helper()
+				for {
+					select {
+					case sp := <-logs.records:
+						if sp.State == state {
+							return sp
+						}
+					case <-ctx.Done():
+						t.Fatalf("no %s record", state)
+					}
+				}
+			}
+			wantPrimary := []string{}
+			for i, s := range tc.steps {
+				if _, err := client.Write(command(mysql.COM_QUERY, s.query)); err != nil {
+					t.Fatal(err)
+				}
+				if s.to == primary {
+					wantPrimary = append(wantPrimary, s.query)
+					if sp := next("est"); sp.Target != primary {
+						t.Errorf("step %d: %q sent to %s, want %s", i, s.query, sp.Target, primary)
+					}
+					st.Tracker.Write([]byte{7, 0, 0, 1, mysql.OK_HEADER, 0, 0, byte(s.status), byte(s.status >> 8), 0, 0})
+				}
+				// the replica answers before the command is logged
+				if r := next("result"); r.Target != s.to {
+					t.Errorf("step %d: result of %q from %s, want %s", i, s.query, r.Target, s.to)
+				}
+				if s.to == replica {
+					if sp := next("est"); sp.Target != replica {
+						t.Errorf("step %d: %q sent to %s, want %s", i, s.query, sp.Target, replica)
+					}
+				}
+			}
+			client.Close()
+			<-done
+			toReplica.Close()
+			if diff := cmp.Diff(wantPrimary, primaryQueries.get()); diff != "" {
+				t.Errorf("queries of the primary mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.replica, <-replicaQueries); diff != "" {
+				t.Errorf("queries of the replica mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
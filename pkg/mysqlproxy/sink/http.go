@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const httpTimeout = 30 * time.Second
+
+// httpSender POSTs each batch as a JSON array.
+type httpSender struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSender(url string, tlsConf *tls.Config) *httpSender {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConf != nil {
+		transport.TLSClientConfig = tlsConf
+	}
+	return &httpSender{
+		url:    url,
+		client: &http.Client{Transport: transport, Timeout: httpTimeout},
+	}
+}
+
+func (h *httpSender) Send(ctx context.Context, events []Event) error {
+	body := &bytes.Buffer{}
+	body.WriteByte('[')
+	for i, ev := range events {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(ev.JSON)
+	}
+	body.WriteByte(']')
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("post %s: %s %s", h.url, res.Status, msg)
+	}
+	return nil
+}
+
+func (h *httpSender) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,431 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kafka wire protocol, the subset needed by a producer.
+// Metadata v4 and Produce v3 with record batch v2 are understood by
+// every broker from Kafka 1.0 to 4.x.
+const (
+	apiKeyProduce    = 0
+	apiKeyMetadata   = 3
+	metadataVersion  = 4
+	produceVersion   = 3
+	kafkaClientID    = appName
+	kafkaAcksAll     = -1
+	kafkaTimeout     = 10 * time.Second
+	recordBatchMagic = 2
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaPartition struct {
+	id     int32
+	leader int32
+}
+
+// kafkaSender publishes events to a topic with acks=all. Each event is keyed
+// by its session ID and partitioned like the Java client (murmur2), so the
+// records of a session stay in order.
+type kafkaSender struct {
+	bootstrap  []string
+	topic      string
+	brokers    map[int32]string
+	partitions []kafkaPartition
+	conns      map[string]*kafkaConn
+	corrID     int32
+}
+
+func newKafkaSender(bootstrap []string, topic string) *kafkaSender {
+	return &kafkaSender{
+		bootstrap: bootstrap,
+		topic:     topic,
+		conns:     map[string]*kafkaConn{},
+	}
+}
+
+func (k *kafkaSender) Send(ctx context.Context, events []Event) error {
+	err := k.send(ctx, events)
+	if err != nil {
+		// refresh metadata and connections on the next attempt
+		k.Close()
+	}
+	return err
+}
+
+func (k *kafkaSender) send(ctx context.Context, events []Event) error {
+	if len(k.partitions) == 0 {
+		if err := k.refreshMetadata(ctx); err != nil {
+			return err
+		}
+	}
+	byLeader := map[int32]map[int32][]Event{}
+	for _, ev := range events {
+		p := k.partitions[partitionFor([]byte(ev.Key), len(k.partitions))]
+		if byLeader[p.leader] == nil {
+			byLeader[p.leader] = map[int32][]Event{}
+		}
+		byLeader[p.leader][p.id] = append(byLeader[p.leader][p.id], ev)
+	}
+	for leader, parts := range byLeader {
+		addr, ok := k.brokers[leader]
+		if !ok {
+			return fmt.Errorf("kafka: leader %d of topic %s not available", leader, k.topic)
+		}
+		conn, err := k.conn(ctx, addr)
+		if err != nil {
+			return err
+		}
+		if err := k.produce(conn, parts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *kafkaSender) Close() error {
+	for addr, c := range k.conns {
+		c.Close()
+		delete(k.conns, addr)
+	}
+	k.partitions = nil
+	return nil
+}
+
+func (k *kafkaSender) conn(ctx context.Context, addr string) (*kafkaConn, error) {
+	if c, ok := k.conns[addr]; ok {
+		return c, nil
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &kafkaConn{Conn: nc, r: bufio.NewReader(nc)}
+	k.conns[addr] = c
+	return c, nil
+}
+
+func (k *kafkaSender) refreshMetadata(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range k.bootstrap {
+		c, err := k.conn(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		req := &kafkaWriter{}
+		req.int32(1)
+		req.string(k.topic)
+		req.bool(true) // allow_auto_topic_creation
+		k.corrID++
+		res, err := c.roundTrip(apiKeyMetadata, metadataVersion, k.corrID, req.Bytes())
+		if err != nil {
+			c.Close()
+			delete(k.conns, addr)
+			lastErr = err
+			continue
+		}
+		return k.parseMetadata(res)
+	}
+	return fmt.Errorf("kafka: no bootstrap broker available: %w", lastErr)
+}
+
+func (k *kafkaSender) parseMetadata(b []byte) error {
+	r := &kafkaReader{b: b}
+	r.int32() // throttle_time_ms
+	brokers := map[int32]string{}
+	for i := r.int32(); i > 0; i-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster_id
+	r.int32()  // controller_id
+	var partitions []kafkaPartition
+	for i := r.int32(); i > 0; i-- {
+		code := r.int16()
+		name := r.string()
+		r.bool() // is_internal
+		if code != 0 {
+			return fmt.Errorf("kafka: metadata of topic %s: error code %d", name, code)
+		}
+		for j := r.int32(); j > 0; j-- {
+			r.int16() // error_code
+			p := kafkaPartition{id: r.int32(), leader: r.int32()}
+			r.int32Array() // replica_nodes
+			r.int32Array() // isr_nodes
+			if name == k.topic {
+				partitions = append(partitions, p)
+			}
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("kafka: topic %s has no partitions", k.topic)
+	}
+	// the partition index must match the position used by partitionFor
+	sorted := make([]kafkaPartition, len(partitions))
+	for _, p := range partitions {
+		if int(p.id) >= len(sorted) || p.id < 0 {
+			return fmt.Errorf("kafka: unexpected partition %d of topic %s", p.id, k.topic)
+		}
+		sorted[p.id] = p
+	}
+	k.brokers = brokers
+	k.partitions = sorted
+	return nil
+}
+
+func (k *kafkaSender) produce(c *kafkaConn, parts map[int32][]Event) error {
+	req := &kafkaWriter{}
+	req.int16(-1) // transactional_id
+	req.int16(kafkaAcksAll)
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(k.topic)
+	req.int32(int32(len(parts)))
+	for id, events := range parts {
+		req.int32(id)
+		req.bytes(recordBatch(events))
+	}
+	k.corrID++
+	res, err := c.roundTrip(apiKeyProduce, produceVersion, k.corrID, req.Bytes())
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{b: res}
+	for i := r.int32(); i > 0; i-- {
+		r.string() // name
+		for j := r.int32(); j > 0; j-- {
+			id := r.int32()
+			code := r.int16()
+			r.int64() // base_offset
+			r.int64() // log_append_time_ms
+			if code != 0 {
+				return fmt.Errorf("kafka: produce to %s/%d: error code %d", k.topic, id, code)
+			}
+		}
+	}
+	return r.err
+}
+
+// recordBatch encodes events as an uncompressed record batch (magic v2).
+func recordBatch(events []Event) []byte {
+	base := events[0].Time.UnixMilli()
+	maxTS := base
+	records := &kafkaWriter{}
+	for i, ev := range events {
+		ts := ev.Time.UnixMilli()
+		if ts > maxTS {
+			maxTS = ts
+		}
+		rec := &kafkaWriter{}
+		rec.int8(0) // attributes
+		rec.varint(ts - base)
+		rec.varint(int64(i))
+		rec.varint(int64(len(ev.Key)))
+		rec.Write([]byte(ev.Key))
+		rec.varint(int64(len(ev.JSON)))
+		rec.Write(ev.JSON)
+		rec.varint(0) // headers
+		records.varint(int64(rec.Len()))
+		records.Write(rec.Bytes())
+	}
+	body := &kafkaWriter{} // from attributes to the end, covered by the CRC
+	body.int16(0)          // attributes: no compression, create time
+	body.int32(int32(len(events) - 1))
+	body.int64(base)
+	body.int64(maxTS)
+	body.int64(-1) // producer_id
+	body.int16(-1) // producer_epoch
+	body.int32(-1) // base_sequence
+	body.int32(int32(len(events)))
+	body.Write(records.Bytes())
+
+	batch := &kafkaWriter{}
+	batch.int64(0)                             // base_offset
+	batch.int32(int32(4 + 1 + 4 + body.Len())) // batch_length
+	batch.int32(-1)                            // partition_leader_epoch
+	batch.int8(recordBatchMagic)
+	batch.int32(int32(crc32.Checksum(body.Bytes(), crc32c)))
+	batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+// partitionFor is the default partitioner of the Java client for keyed records.
+func partitionFor(key []byte, n int) int {
+	return int(uint32(murmur2(key))&0x7fffffff) % n
+}
+
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+type kafkaConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// roundTrip sends a request with header v1 and returns the response body
+// after the response header v0.
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, corrID int32, body []byte) ([]byte, error) {
+	req := &kafkaWriter{}
+	req.int32(0) // size, filled below
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(corrID)
+	req.string(kafkaClientID)
+	req.Write(body)
+	b := req.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	deadline := time.Now().Add(kafkaTimeout + writeTimeout)
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	var size int32
+	if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 {
+		return nil, fmt.Errorf("kafka: invalid response size %d", size)
+	}
+	res := make([]byte, size)
+	if _, err := io.ReadFull(c.r, res); err != nil {
+		return nil, err
+	}
+	if got := int32(binary.BigEndian.Uint32(res)); got != corrID {
+		return nil, fmt.Errorf("kafka: correlation id %d, want %d", got, corrID)
+	}
+	return res[4:], nil
+}
+
+type kafkaWriter struct{ bytes.Buffer }
+
+func (w *kafkaWriter) int8(v int8)   { w.WriteByte(byte(v)) }
+func (w *kafkaWriter) int16(v int16) { binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int32(v int32) { binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int64(v int64) { binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) bool(v bool) {
+	if v {
+		w.int8(1)
+		return
+	}
+	w.int8(0)
+}
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.Write(b)
+}
+func (w *kafkaWriter) varint(v int64) {
+	w.Write(binary.AppendVarint(nil, v))
+}
+
+var errShortKafkaResponse = errors.New("kafka: short response")
+
+// kafkaReader decodes big-endian fields; the first error sticks.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.b) < n {
+		r.err = errShortKafkaResponse
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) bool() bool   { return r.next(1)[0] != 0 }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+func (r *kafkaReader) int32Array() []int32 {
+	n := r.int32()
+	if n < 0 || int(n)*4 > len(r.b) {
+		if n > 0 {
+			r.err = errShortKafkaResponse
+		}
+		return nil
+	}
+	res := make([]int32, n)
+	for i := range res {
+		res[i] = r.int32()
+	}
+	return res
+}
+
+// parseKafkaURL splits "kafka://host1:9092,host2:9092/topic".
+func parseKafkaURL(host, path string) ([]string, string, error) {
+	topic := strings.Trim(path, "/")
+	if len(host) == 0 || len(topic) == 0 {
+		return nil, "", fmt.Errorf("kafka sink needs brokers and a topic: kafka://host:9092/topic")
+	}
+	return strings.Split(host, ","), topic, nil
+}
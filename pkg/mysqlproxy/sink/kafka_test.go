@@ -0,0 +1,282 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMurmur2(t *testing.T) {
+	// test vectors of org.apache.kafka.common.utils.UtilsTest
+	testcase := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, want := range testcase {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q)=%d want:%d", key, got, want)
+		}
+	}
+}
+
+type kafkaMessage struct {
+	Partition int32
+	Key       string
+	Value     string
+}
+
+// fakeBroker is an in-process single node Kafka broker that understands
+// Metadata v4 and Produce v3.
+type fakeBroker struct {
+	l          net.Listener
+	topic      string
+	partitions int32
+	mu         sync.Mutex
+	failures   int // produce requests answered with NOT_LEADER_OR_FOLLOWER
+	messages   []kafkaMessage
+}
+
+func startFakeBroker(t *testing.T, addr, topic string, partitions int32) *fakeBroker {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{l: l, topic: topic, partitions: partitions}
+	go b.serve()
+	t.Cleanup(func() { l.Close() })
+	return b
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *fakeBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		req := &kafkaReader{b: buf}
+		apiKey := req.int16()
+		apiVersion := req.int16()
+		corrID := req.int32()
+		req.string() // client_id
+		res := &kafkaWriter{}
+		res.int32(0)
+		res.int32(corrID)
+		switch {
+		case apiKey == apiKeyMetadata && apiVersion == metadataVersion:
+			b.metadata(res)
+		case apiKey == apiKeyProduce && apiVersion == produceVersion:
+			if err := b.produce(req, res); err != nil {
+				return
+			}
+		default:
+			return
+		}
+		out := res.Bytes()
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) metadata(res *kafkaWriter) {
+	host, port, _ := net.SplitHostPort(b.l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	res.int32(0) // throttle_time_ms
+	res.int32(1)
+	res.int32(0)
+	res.string(host)
+	res.int32(int32(p))
+	res.int16(-1) // rack
+	res.int16(-1) // cluster_id
+	res.int32(0)  // controller_id
+	res.int32(1)
+	res.int16(0)
+	res.string(b.topic)
+	res.bool(false)
+	res.int32(b.partitions)
+	// answer in reverse order, the client must index by partition id
+	for i := b.partitions - 1; i >= 0; i-- {
+		res.int16(0)
+		res.int32(i)
+		res.int32(0) // leader
+		res.int32(1)
+		res.int32(0)
+		res.int32(1)
+		res.int32(0)
+	}
+}
+
+func (b *fakeBroker) produce(req *kafkaReader, res *kafkaWriter) error {
+	req.int16() // transactional_id
+	if acks := req.int16(); acks != kafkaAcksAll {
+		return fmt.Errorf("acks:%d", acks)
+	}
+	req.int32() // timeout
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	code := int16(0)
+	if b.failures > 0 {
+		b.failures--
+		code = 6
+	}
+	stored := []kafkaMessage{}
+	res.int32(req.int32())
+	name := req.string()
+	res.string(name)
+	n := req.int32()
+	res.int32(n)
+	for ; n > 0; n-- {
+		partition := req.int32()
+		batch := req.next(int(req.int32()))
+		msgs, err := decodeRecordBatch(partition, batch)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, msgs...)
+		res.int32(partition)
+		res.int16(code)
+		res.int64(0)
+		res.int64(-1)
+	}
+	res.int32(0) // throttle_time_ms
+	if code == 0 {
+		b.messages = append(b.messages, stored...)
+	}
+	return req.err
+}
+
+func decodeRecordBatch(partition int32, batch []byte) ([]kafkaMessage, error) {
+	r := &kafkaReader{b: batch}
+	r.int64() // base_offset
+	if l := r.int32(); int(l) != len(r.b) {
+		return nil, fmt.Errorf("batch_length:%d rest:%d", l, len(r.b))
+	}
+	r.int32() // partition_leader_epoch
+	if magic := r.next(1)[0]; magic != recordBatchMagic {
+		return nil, fmt.Errorf("magic:%d", magic)
+	}
+	crc := uint32(r.int32())
+	if got := crc32.Checksum(r.b, crc32c); got != crc {
+		return nil, fmt.Errorf("crc:%x want:%x", got, crc)
+	}
+	r.next(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	count := r.int32()
+	varint := func() int64 {
+		v, n := binary.Varint(r.b)
+		r.b = r.b[n:]
+		return v
+	}
+	msgs := []kafkaMessage{}
+	for ; count > 0; count-- {
+		varint()  // length
+		r.next(1) // attributes
+		varint()  // timestamp_delta
+		varint()  // offset_delta
+		key := r.next(int(varint()))
+		value := r.next(int(varint()))
+		varint() // headers
+		msgs = append(msgs, kafkaMessage{Partition: partition, Key: string(key), Value: string(value)})
+	}
+	return msgs, r.err
+}
+
+func (b *fakeBroker) Messages() []kafkaMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]kafkaMessage{}, b.messages...)
+}
+
+func TestKafka(t *testing.T) {
+	broker := startFakeBroker(t, "127.0.0.1:0", "audit", 3)
+	broker.failures = 1
+	s, err := New("kafka://"+broker.l.Addr().String()+"/audit", Options{BatchSize: 10, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSink(t, s, testPacket(1, "q1"), testPacket(2, "q2"), testPacket(3, "q3"), testPacket(1, "q4"))
+
+	got := map[string][]string{}
+	for _, m := range broker.Messages() {
+		if want := int32(partitionFor([]byte(m.Key), 3)); m.Partition != want {
+			t.Errorf("key:%s partition:%d want:%d", m.Key, m.Partition, want)
+		}
+		rec := map[string]any{}
+		if err := json.Unmarshal([]byte(m.Value), &rec); err != nil {
+			t.Fatal(err)
+		}
+		got[m.Key] = append(got[m.Key], rec["cmd"].(string))
+	}
+	want := map[string][]string{"1": {"q1", "q4"}, "2": {"q2"}, "3": {"q3"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("messages mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestKafkaBrokerDown(t *testing.T) {
+	// reserve an address for a broker that is not running yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s, err := New("kafka://"+addr+"/audit", Options{Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := Group{s}
+	g.Publish(testPacket(1, "while down"))
+	done := make(chan error)
+	go func() { done <- s.Run(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	broker := startFakeBroker(t, addr, "audit", 1)
+	g.Publish(testPacket(1, "after restart"))
+	g.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	msgs := broker.Messages()
+	if len(msgs) != 2 || s.Dropped() != 0 {
+		t.Errorf("messages:%v dropped:%d", msgs, s.Dropped())
+	}
+}
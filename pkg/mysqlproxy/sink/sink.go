@@ -0,0 +1,243 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+// Event is an audit record rendered once and shared by all sinks.
+type Event struct {
+	Time   time.Time
+	Key    string // session (connection) ID
+	State  string
+	Failed bool
+	JSON   []byte // decoder.Record
+}
+
+// NewEvent renders sp with the JSON schema of mysql8-audit-log-decoder,
+// with the digest, class and tables of the query if analyze is set.
+func NewEvent(sp *sendpacket.SendPacket, analyze bool) (Event, error) {
+	rec := decoder.Decode(*sp)
+	if analyze {
+		rec.Analyze()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		Time:   rec.Datetime,
+		Key:    strconv.FormatUint(uint64(rec.ConnectionID), 10),
+		State:  rec.State,
+		Failed: len(rec.Err) > 0,
+		JSON:   b,
+	}, nil
+}
+
+// Sender delivers a batch of events to a destination.
+// A Sender is used by a single goroutine.
+type Sender interface {
+	Send(ctx context.Context, events []Event) error
+	Close() error
+}
+
+const maxBackoff = 30 * time.Second
+
+type Options struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	Retries       int // retries of a failed batch, forever if negative
+	Backoff       time.Duration
+	TLSConfig     *tls.Config
+	Analyze       bool // fill the digest, class and tables of queries
+}
+
+// Sink buffers events in its own queue and delivers them in batches with retry.
+// When the queue is full new events are dropped; the audit log file keeps them.
+type Sink struct {
+	name    string
+	sender  Sender
+	opt     Options
+	queue   chan Event
+	dropped atomic.Uint64
+}
+
+func NewSink(name string, sender Sender, opt Options) *Sink {
+	if opt.QueueSize <= 0 {
+		opt.QueueSize = 10000
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = 1
+	}
+	if opt.FlushInterval <= 0 {
+		opt.FlushInterval = time.Second
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = 100 * time.Millisecond
+	}
+	return &Sink{
+		name:   name,
+		sender: sender,
+		opt:    opt,
+		queue:  make(chan Event, opt.QueueSize),
+	}
+}
+
+// New returns the sink for rawURL:
+//
+//	syslog+udp://host:514, syslog+tcp://host:601, syslog+tls://host:6514 (RFC 5424)
+//	jsonl+tcp://host:port, jsonl+udp://host:port (newline-delimited JSON)
+//	http://host/path, https://host/path (batched POST of a JSON array)
+//	kafka://host1:9092,host2:9092/topic (keyed by session ID, at-least-once)
+func New(rawURL string, opt Options) (*Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse sink url:%q err:%w", rawURL, err)
+	}
+	var sender Sender
+	switch u.Scheme {
+	case "syslog", "syslog+udp":
+		sender = newStreamSender("udp", u.Host, nil, syslogFrame(false))
+	case "syslog+tcp":
+		sender = newStreamSender("tcp", u.Host, nil, syslogFrame(true))
+	case "syslog+tls":
+		sender = newStreamSender("tcp", u.Host, tlsConfig(opt.TLSConfig, u.Hostname()), syslogFrame(true))
+	case "jsonl+tcp":
+		sender = newStreamSender("tcp", u.Host, nil, jsonlFrame)
+	case "jsonl+udp":
+		sender = newStreamSender("udp", u.Host, nil, jsonlFrame)
+	case "http", "https":
+		sender = newHTTPSender(u.String(), opt.TLSConfig)
+	case "kafka":
+		brokers, topic, err := parseKafkaURL(u.Host, u.Path)
+		if err != nil {
+			return nil, err
+		}
+		sender = newKafkaSender(brokers, topic)
+		// at-least-once: keep the batch in the local buffer until the broker is back
+		opt.Retries = -1
+	default:
+		return nil, fmt.Errorf("unsupported sink scheme:%q", u.Scheme)
+	}
+	u.User = nil
+	return NewSink(u.Redacted(), sender, opt), nil
+}
+
+func tlsConfig(conf *tls.Config, serverName string) *tls.Config {
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	conf = conf.Clone()
+	if len(conf.ServerName) == 0 {
+		conf.ServerName = serverName
+	}
+	return conf
+}
+
+func (s *Sink) String() string { return s.name }
+
+// Dropped reports the number of events dropped because the queue was full
+// or the destination kept failing.
+func (s *Sink) Dropped() uint64 { return s.dropped.Load() }
+
+// Offer queues ev without blocking.
+func (s *Sink) Offer(ev Event) {
+	select {
+	case s.queue <- ev:
+	default:
+		if s.dropped.Add(1)%1000 == 1 {
+			log.Printf("sink:%s queue is full, dropped:%d", s.name, s.dropped.Load())
+		}
+	}
+}
+
+// Close stops accepting events. Run returns after the queued events are sent.
+func (s *Sink) Close() { close(s.queue) }
+
+func (s *Sink) Run(ctx context.Context) error {
+	defer s.sender.Close()
+	ticker := time.NewTicker(s.opt.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]Event, 0, s.opt.BatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-s.queue:
+			if !ok {
+				s.flush(ctx, batch)
+				return nil
+			}
+			batch = append(batch, ev)
+			if len(batch) < s.opt.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		batch = s.flush(ctx, batch)
+	}
+}
+
+func (s *Sink) flush(ctx context.Context, batch []Event) []Event {
+	if len(batch) == 0 {
+		return batch
+	}
+	backoff := s.opt.Backoff
+	for i := 0; ; i++ {
+		err := s.sender.Send(ctx, batch)
+		if err == nil {
+			break
+		}
+		if (s.opt.Retries >= 0 && i >= s.opt.Retries) || ctx.Err() != nil {
+			s.dropped.Add(uint64(len(batch)))
+			log.Printf("sink:%s dropped %d events err:%v", s.name, len(batch), err)
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+	return batch[:0]
+}
+
+// Group fans the record stream out to several sinks.
+// It implements the Subscriber of the audit log writer.
+type Group []*Sink
+
+func (g Group) Publish(sp *sendpacket.SendPacket) {
+	var events [2]*Event // rendered without and with Options.Analyze
+	for _, s := range g {
+		i := 0
+		if s.opt.Analyze {
+			i = 1
+		}
+		if events[i] == nil {
+			ev, err := NewEvent(sp, s.opt.Analyze)
+			if err != nil {
+				log.Printf("sink: cannot render event err:%v", err)
+				return
+			}
+			events[i] = &ev
+		}
+		s.Offer(*events[i])
+	}
+}
+
+func (g Group) Close() {
+	for _, s := range g {
+		s.Close()
+	}
+}
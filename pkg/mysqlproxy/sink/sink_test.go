@@ -0,0 +1,232 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/sendpacket"
+)
+
+func testPacket(id uint32, query string) *sendpacket.SendPacket {
+	return &sendpacket.SendPacket{
+		Datetime:     1700000000,
+		ConnectionID: id,
+		User:         "user1",
+		State:        "est",
+		Packets:      append([]byte{byte(len(query) + 1), 0, 0, 0, 0x03}, query...),
+	}
+}
+
+func runSink(t *testing.T, s *Sink, packets ...*sendpacket.SendPacket) {
+	t.Helper()
+	g := Group{s}
+	for _, sp := range packets {
+		g.Publish(sp)
+	}
+	g.Close()
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var syslogRe = regexp.MustCompile(`^<110>1 2023-11-14T22:13:20Z \S+ mysql8-audit-proxy \d+ est - (\{.*\})$`)
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, err := New("syslog+udp://"+pc.LocalAddr().String(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSink(t, s, testPacket(1, "select 1"))
+
+	buf := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := syslogRe.FindSubmatch(buf[:n])
+	if m == nil {
+		t.Fatalf("not a RFC 5424 message: %s", buf[:n])
+	}
+	rec := map[string]any{}
+	if err := json.Unmarshal(m[1], &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["cmd"] != "select 1" {
+		t.Errorf("cmd:%v", rec["cmd"])
+	}
+}
+
+// acceptLines accepts connections on l and sends every line read to the channel.
+func acceptLines(l net.Listener, split bufio.SplitFunc) chan string {
+	ch := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sc := bufio.NewScanner(conn)
+				sc.Split(split)
+				for sc.Scan() {
+					ch <- sc.Text()
+				}
+			}()
+		}
+	}()
+	return ch
+}
+
+// splitOctetCounted splits "LEN SP MSG" frames.
+func splitOctetCounted(data []byte, atEOF bool) (int, []byte, error) {
+	sp := strings.IndexByte(string(data), ' ')
+	if sp < 0 {
+		return 0, nil, nil
+	}
+	n, err := strconv.Atoi(string(data[:sp]))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < sp+1+n {
+		return 0, nil, nil
+	}
+	return sp + 1 + n, data[sp+1 : sp+1+n], nil
+}
+
+func TestSyslogTLS(t *testing.T) {
+	// borrow the test certificate of httptest
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := acceptLines(l, splitOctetCounted)
+	clientConf := ts.Client().Transport.(*http.Transport).TLSClientConfig
+	s, err := New("syslog+tls://"+l.Addr().String(), Options{TLSConfig: clientConf, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSink(t, s, testPacket(1, "select 1"), testPacket(2, "select 2"))
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-lines:
+			if !syslogRe.MatchString(line) {
+				t.Errorf("not a RFC 5424 message: %s", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestJSONLinesTCPReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := acceptLines(l, bufio.ScanLines)
+	s, err := New("jsonl+tcp://"+l.Addr().String(), Options{Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := s.sender.(*streamSender)
+	if err := sender.Send(context.Background(), []Event{{JSON: []byte(`{"n":1}`)}}); err != nil {
+		t.Fatal(err)
+	}
+	// the peer went away: the next send must redial
+	sender.conn.Close()
+	runSink(t, s, testPacket(7, "select 7"))
+
+	got := []string{}
+	for len(got) < 2 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout, got:%v", got)
+		}
+	}
+	if got[0] != `{"n":1}` || !strings.Contains(got[1], `"con_id":7`) {
+		t.Errorf("lines:%v", got)
+	}
+}
+
+type webhook struct {
+	mu      sync.Mutex
+	fails   int
+	batches [][]map[string]any
+}
+
+func (w *webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fails > 0 {
+		w.fails--
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	b, _ := io.ReadAll(r.Body)
+	batch := []map[string]any{}
+	if err := json.Unmarshal(b, &batch); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.batches = append(w.batches, batch)
+}
+
+func TestHTTPBatch(t *testing.T) {
+	hook := &webhook{fails: 1}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+	s, err := New(ts.URL+"/audit", Options{BatchSize: 2, Retries: 2, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSink(t, s, testPacket(1, "q1"), testPacket(2, "q2"), testPacket(3, "q3"))
+	got := [][]string{}
+	for _, batch := range hook.batches {
+		cmds := []string{}
+		for _, rec := range batch {
+			cmds = append(cmds, rec["cmd"].(string))
+		}
+		got = append(got, cmds)
+	}
+	if diff := cmp.Diff([][]string{{"q1", "q2"}, {"q3"}}, got); diff != "" {
+		t.Errorf("batches mismatch (-want +got):\n%s", diff)
+	}
+	if s.Dropped() != 0 {
+		t.Errorf("dropped:%d", s.Dropped())
+	}
+}
+
+func TestOfferFull(t *testing.T) {
+	s := NewSink("full", newStreamSender("udp", "127.0.0.1:9", nil, jsonlFrame), Options{QueueSize: 1})
+	s.Offer(Event{})
+	s.Offer(Event{})
+	if s.Dropped() != 1 {
+		t.Errorf("dropped:%d want:1", s.Dropped())
+	}
+}
@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 30 * time.Second
+
+	appName          = "mysql8-audit-proxy"
+	facilityLogAudit = 13
+	severityWarning  = 4
+	severityInfo     = 6
+)
+
+// streamSender writes framed events to a TCP, TLS or UDP connection,
+// redialing after a failed write.
+type streamSender struct {
+	network string
+	addr    string
+	tls     *tls.Config
+	frame   func(ev Event) []byte
+	conn    net.Conn
+}
+
+func newStreamSender(network, addr string, tlsConf *tls.Config, frame func(ev Event) []byte) *streamSender {
+	return &streamSender{network: network, addr: addr, tls: tlsConf, frame: frame}
+}
+
+func (s *streamSender) dial(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var err error
+	if s.tls != nil {
+		td := &tls.Dialer{NetDialer: dialer, Config: s.tls}
+		s.conn, err = td.DialContext(ctx, s.network, s.addr)
+		return err
+	}
+	s.conn, err = dialer.DialContext(ctx, s.network, s.addr)
+	return err
+}
+
+func (s *streamSender) Send(ctx context.Context, events []Event) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	err := s.write(events)
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
+
+func (s *streamSender) write(events []Event) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	if s.network == "udp" {
+		// one datagram per event
+		for _, ev := range events {
+			if _, err := s.conn.Write(s.frame(ev)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	for _, ev := range events {
+		buf.Write(s.frame(ev))
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+func (s *streamSender) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func jsonlFrame(ev Event) []byte {
+	return append(append([]byte{}, ev.JSON...), '\n')
+}
+
+var (
+	hostname, _ = os.Hostname()
+	procID      = strconv.Itoa(os.Getpid())
+)
+
+// syslogFrame formats events as RFC 5424 messages with the JSON record as MSG.
+// Stream transports use octet counting framing (RFC 6587, RFC 5425).
+func syslogFrame(octetCounting bool) func(ev Event) []byte {
+	return func(ev Event) []byte {
+		msg := syslogMessage(ev)
+		if octetCounting {
+			return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		return msg
+	}
+}
+
+func syslogMessage(ev Event) []byte {
+	severity := severityInfo
+	if ev.Failed {
+		severity = severityWarning
+	}
+	msgID := ev.State
+	if len(msgID) == 0 {
+		msgID = "-"
+	}
+	host := hostname
+	if len(host) == 0 {
+		host = "-"
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %s %s - ",
+		facilityLogAudit*8+severity,
+		ev.Time.UTC().Format(time.RFC3339),
+		host, appName, procID, msgID)
+	return append([]byte(header), ev.JSON...)
+}
@@ -0,0 +1,214 @@
+package mysqlproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/decoder"
+	"github.com/masahide/mysql8-audit-proxy/pkg/mysqlproxy/protocol"
+)
+
+// maxSettings is the number of session settings kept for a replica until
+// it runs them. A session that sets more stays on the primary.
+const maxSettings = 100
+
+var errReplicaCaps = errors.New("replica negotiated other capabilities than the target")
+
+// connectReplica connects sess to the first of the replicas whose circuit
+// is closed. If none connects, the session goes on without splitting.
+func (p *ProxySrv) connectReplica(ctx context.Context, sess *ClientSess, replicas []string) {
+	for _, addr := range replicas {
+		if !p.health.Allow(addr, time.Now()) {
+			continue
+		}
+		err := sess.ConnectToReplica(ctx, addr)
+		if err == nil {
+			if p.health.Success(addr) {
+				log.Printf("backend:%s up", addr)
+			}
+			log.Printf("split reads of user:%s to replica:%s", sess.TargetUser, addr)
+			return
+		}
+		log.Printf("replica:%s err: %v", addr, err)
+		var myErr *mysql.MyError
+		if errors.Is(err, errReplicaCaps) || errors.As(err, &myErr) && !backendDown(myErr) {
+			continue
+		}
+		if p.health.Failure(addr, time.Now()) {
+			log.Printf("backend:%s down, circuit open", addr)
+		}
+	}
+	log.Printf("no replica available for user:%s, reads go to the target", sess.TargetUser)
+}
+
+// Replica takes the reads of a session that splits reads and writes. The
+// SendTask copies the response of a read to the client before it reads the
+// next command, so that the responses of the replica and those of the
+// target never mix.
+type Replica struct {
+	Addr    string
+	Reader  io.Reader // responses of the replica
+	Writer  io.Writer // commands to the replica
+	Client  io.Writer // where the responses go, shared with the target
+	Tracker *protocol.Tracker
+
+	settings [][]byte // commands setting the session, run on the target but not yet on the replica
+	result   *protocol.Result
+	buf      []byte
+}
+
+// NewReplica returns a Replica for a session that negotiated
+// CLIENT_DEPRECATE_EOF or not.
+func NewReplica(addr string, r io.Reader, w, client io.Writer, deprecateEOF bool) *Replica {
+	rep := &Replica{Addr: addr, Reader: r, Writer: w, Client: client, buf: make([]byte, 16*1024)}
+	rep.Tracker = protocol.NewTracker(deprecateEOF, func(r protocol.Result) { rep.result = &r })
+	return rep
+}
+
+// follow keeps a command that set the session on the target, to be run on
+// the replica before its next read. It reports false if there are too many.
+func (r *Replica) follow(payload []byte) bool {
+	if len(r.settings) >= maxSettings {
+		return false
+	}
+	r.settings = append(r.settings, append([]byte(nil), payload...))
+	return true
+}
+
+// catchUp runs the settings kept for the replica, dropping their responses.
+func (r *Replica) catchUp() error {
+	for len(r.settings) > 0 {
+		payload := r.settings[0]
+		pkt := make([]byte, 4, 4+len(payload))
+		pkt[0], pkt[1], pkt[2] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16)
+		res, _, err := r.run(0, append(pkt, payload...), io.Discard)
+		if err != nil {
+			return err
+		}
+		if len(res.Err) > 0 {
+			return errors.New(res.Err)
+		}
+		r.settings = r.settings[1:]
+	}
+	r.settings = nil
+	return nil
+}
+
+// run sends the command in pkt to the replica and copies the response to w
+// until the Tracker sees its end. n is the number of bytes copied.
+func (r *Replica) run(seq uint32, pkt []byte, w io.Writer) (res protocol.Result, n int, err error) {
+	r.result = nil
+	r.Tracker.Expect(seq, pkt[4])
+	if _, err := r.Writer.Write(pkt); err != nil {
+		return res, 0, err
+	}
+	for r.result == nil {
+		nn, err := r.Reader.Read(r.buf)
+		if nn > 0 {
+			r.Tracker.Write(r.buf[:nn])
+			if _, err := w.Write(r.buf[:nn]); err != nil {
+				return res, n, err
+			}
+			n += nn
+		}
+		var netErr net.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &netErr) && netErr.Timeout():
+			// a long query, read again unless the session is done
+		case errors.Is(err, io.EOF) && r.result == nil:
+			return res, n, io.ErrUnexpectedEOF
+		default:
+			return res, n, err
+		}
+	}
+	return *r.result, n, nil
+}
+
+// split returns where a command goes, decoder.ToPrimary unless the session
+// splits reads and writes. Reads go to the primary while it is in a
+// transaction, explicit or with autocommit off.
+func (st *SendTask) split(payload []byte, plain []byte) int {
+	if st.Replica == nil || st.pinned || st.continued {
+		return decoder.ToPrimary
+	}
+	switch payload[0] {
+	case mysql.COM_QUERY:
+		if st.QueryAttributes {
+			if plain == nil {
+				// attributes not read, neither is the query
+				return decoder.ToPrimary
+			}
+			payload = plain
+		}
+		to := decoder.ReadWrite(string(payload[1:]))
+		if to == decoder.ToReplica && st.inTransaction() {
+			return decoder.ToPrimary
+		}
+		return to
+	case mysql.COM_INIT_DB:
+		return decoder.ToBoth
+	case mysql.COM_RESET_CONNECTION:
+		// the replica forgets the settings as well
+		st.Replica.settings = nil
+		return decoder.ToBoth
+	case mysql.COM_CHANGE_USER:
+		return decoder.ToPin
+	}
+	return decoder.ToPrimary
+}
+
+// inTransaction reports whether the primary is in a transaction after its
+// last response.
+func (st *SendTask) inTransaction() bool {
+	status := uint16(st.status.Load())
+	return status&mysql.SERVER_STATUS_IN_TRANS != 0 || status&mysql.SERVER_STATUS_AUTOCOMMIT == 0
+}
+
+// pin sends the rest of the session to the primary.
+func (st *SendTask) pin(reason string) {
+	if !st.pinned {
+		log.Printf("connID:%d reads stay on target:%s: %s", st.ConnID, st.Addr, reason)
+	}
+	st.pinned = true
+}
+
+// sendReplica runs the read in pkt on the replica and copies the response
+// to the client. It reports false if the replica failed before the client
+// got anything, in which case the read goes to the primary, as does the
+// rest of the session.
+func (st *SendTask) sendReplica(ctx context.Context, pkt []byte) (bool, error) {
+	if err := st.Replica.catchUp(); err != nil {
+		st.pin("replica " + st.Replica.Addr + " cannot follow the session: " + err.Error())
+		return false, nil
+	}
+	res, n, err := st.Replica.run(st.seq, pkt, st.Replica.Client)
+	if err != nil {
+		st.pin("replica " + st.Replica.Addr + ": " + err.Error())
+		if n > 0 {
+			return true, err
+		}
+		return false, nil
+	}
+	st.sendResult(ctx, st.Replica.Addr, res)
+	return true, nil
+}
+
+// lockedWriter is the client of a session whose responses come from the
+// target and from a replica.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,40 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalDir archives log files by copying them into Dir.
+type LocalDir struct {
+	Dir string
+}
+
+func (l *LocalDir) String() string { return "file://" + l.Dir }
+
+func (l *LocalDir) Upload(ctx context.Context, obj Object) error {
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(obj.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := filepath.Join(l.Dir, obj.Key)
+	tmp, err := os.CreateTemp(l.Dir, "."+obj.Key+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,155 @@
+package upload
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	sigAlgorithm  = "AWS4-HMAC-SHA256"
+)
+
+// S3 puts log files into an S3-compatible bucket using path-style requests
+// signed with AWS Signature Version 4.
+type S3 struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (s *S3) String() string { return "s3://" + s.Bucket + "/" + s.Prefix }
+
+func (s *S3) endpoint() string {
+	if len(s.Endpoint) > 0 {
+		return strings.TrimRight(s.Endpoint, "/")
+	}
+	return fmt.Sprintf("https://s3.%s.amazonaws.com", s.Region)
+}
+
+func (s *S3) objectKey(name string) string {
+	if len(s.Prefix) == 0 {
+		return name
+	}
+	return s.Prefix + "/" + name
+}
+
+func (s *S3) Upload(ctx context.Context, obj Object) error {
+	f, err := os.Open(obj.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	u, err := url.Parse(s.endpoint() + "/" + s.Bucket + "/" + s.objectKey(obj.Key))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = obj.Size
+	req.Header.Set("Content-Type", "application/gzip")
+	signV4(req, obj.SHA256, s.Region, s.AccessKey, s.SecretKey, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: put %s: %s %s", errStatus, u, res.Status, body)
+	}
+	return nil
+}
+
+// signV4 adds the x-amz-* headers and the Authorization header to req.
+// All headers already set on req, plus Host, are signed.
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonHeaders := &strings.Builder{}
+	for _, k := range names {
+		fmt.Fprintf(canonHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{sigAlgorithm, amzDate, scope, sha256Hex([]byte(canonRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgorithm, accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(v url.Values) string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		vals := v[k]
+		sort.Strings(vals)
+		for _, val := range vals {
+			parts = append(parts, url.QueryEscape(k)+"="+strings.ReplaceAll(url.QueryEscape(val), "+", "%20"))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
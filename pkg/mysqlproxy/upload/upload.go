@@ -0,0 +1,247 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	markerSuffix = ".uploaded"
+	queueSize    = 1024
+)
+
+// Object describes a closed audit log file to be shipped.
+type Object struct {
+	Path   string // local file path
+	Key    string // object name on the target, the base name of Path
+	Size   int64
+	SHA256 string // hex encoded
+}
+
+// Uploader stores a closed audit log file somewhere else.
+type Uploader interface {
+	Upload(ctx context.Context, obj Object) error
+	String() string
+}
+
+// S3Config holds the settings of an S3-compatible target.
+type S3Config struct {
+	Endpoint  string // e.g. "https://s3.ap-northeast-1.amazonaws.com" or "http://minio:9000"
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// New returns the Uploader for target.
+// "file:///path/to/archive" copies files into a local directory and
+// "s3://bucket/prefix" puts them into an S3-compatible bucket.
+func New(target string, s3conf S3Config) (Uploader, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("parse upload target:%q err:%w", target, err)
+	}
+	switch u.Scheme {
+	case "file", "":
+		if len(u.Path) == 0 {
+			return nil, fmt.Errorf("upload target:%q has no directory", target)
+		}
+		return &LocalDir{Dir: u.Path}, nil
+	case "s3":
+		if len(u.Host) == 0 {
+			return nil, fmt.Errorf("upload target:%q has no bucket", target)
+		}
+		return &S3{
+			Endpoint:  s3conf.Endpoint,
+			Region:    s3conf.Region,
+			Bucket:    u.Host,
+			Prefix:    strings.Trim(u.Path, "/"),
+			AccessKey: s3conf.AccessKey,
+			SecretKey: s3conf.SecretKey,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported upload target scheme:%q", u.Scheme)
+}
+
+// marker is written next to a log file once it has been uploaded.
+type marker struct {
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	Target     string    `json:"target"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Shipper uploads closed log files in the background with retry.
+// A marker file "<log file>.uploaded" is written on success, and files whose
+// marker matches the current content are not uploaded again.
+type Shipper struct {
+	Uploader Uploader
+	Retries  int
+	Backoff  time.Duration
+
+	queue   chan string
+	pending []string // shipped by Run before the queue
+}
+
+func NewShipper(u Uploader, retries int, backoff time.Duration) *Shipper {
+	return &Shipper{
+		Uploader: u,
+		Retries:  retries,
+		Backoff:  backoff,
+		queue:    make(chan string, queueSize),
+	}
+}
+
+// Enqueue schedules filePath for upload. It can be passed to
+// auditLogWriter.OnClose.
+func (s *Shipper) Enqueue(filePath string) {
+	select {
+	case s.queue <- filePath:
+	default:
+		log.Printf("upload queue is full, file:%s is not uploaded", filePath)
+	}
+}
+
+// Recover makes Run ship those of files that have no marker, e.g. files
+// closed before the proxy stopped, ahead of the queued ones.
+func (s *Shipper) Recover(files []string) {
+	for _, f := range files {
+		if _, err := os.Stat(f + markerSuffix); os.IsNotExist(err) {
+			s.pending = append(s.pending, f)
+		}
+	}
+}
+
+// Close stops accepting files. Run returns after the queued files are shipped.
+func (s *Shipper) Close() { close(s.queue) }
+
+func (s *Shipper) Run(ctx context.Context) error {
+	for len(s.pending) > 0 {
+		filePath := s.pending[0]
+		s.pending = s.pending[1:]
+		if err := s.Ship(ctx, filePath); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("upload file:%s to %s err:%v", filePath, s.Uploader, err)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case filePath, ok := <-s.queue:
+			if !ok {
+				return nil
+			}
+			if err := s.Ship(ctx, filePath); err != nil {
+				log.Printf("upload file:%s to %s err:%v", filePath, s.Uploader, err)
+			}
+		}
+	}
+}
+
+// Ship uploads filePath unless it has already been uploaded with the same content.
+func (s *Shipper) Ship(ctx context.Context, filePath string) error {
+	obj, err := newObject(filePath)
+	if err != nil {
+		return err
+	}
+	if m, err := readMarker(filePath); err == nil && m.SHA256 == obj.SHA256 && m.Size == obj.Size {
+		return nil
+	}
+	backoff := s.Backoff
+	for i := 0; ; i++ {
+		err = s.Uploader.Upload(ctx, obj)
+		if err == nil {
+			break
+		}
+		if i >= s.Retries {
+			return fmt.Errorf("give up after %d attempts: %w", i+1, err)
+		}
+		log.Printf("upload file:%s err:%v, retry in %s", filePath, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return writeMarker(filePath, marker{
+		SHA256:     obj.SHA256,
+		Size:       obj.Size,
+		Target:     s.Uploader.String(),
+		UploadedAt: time.Now(),
+	})
+}
+
+func newObject(filePath string) (Object, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return Object{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{
+		Path:   filePath,
+		Key:    filepath.Base(filePath),
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func readMarker(filePath string) (marker, error) {
+	m := marker{}
+	b, err := os.ReadFile(filePath + markerSuffix)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+func writeMarker(filePath string, m marker) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath+markerSuffix, b)
+}
+
+func writeFileAtomic(filePath string, b []byte) error {
+	tmp := filePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filePath)
+}
+
+// Command returns a hook that runs command with the closed file path as its
+// only argument. The command runs in the background and its failure is logged.
+func Command(command string) func(filePath string) {
+	return func(filePath string) {
+		go func() {
+			out, err := exec.Command(command, filePath).CombinedOutput()
+			if err != nil {
+				log.Printf("rotate command:%s file:%s err:%v output:%s", command, filePath, err, out)
+			}
+		}()
+	}
+}
+
+var errStatus = errors.New("unexpected status")
@@ -0,0 +1,350 @@
+// Package parquet writes flat Apache Parquet files.
+//
+// Only what the audit export needs is implemented: INT64 and BYTE_ARRAY
+// columns, optional (nullable) values, PLAIN encoding and GZIP pages with one
+// data page per column chunk.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const magic = "PAR1"
+
+// Type is a physical column type.
+type Type int32
+
+const (
+	Int64     Type = 2
+	ByteArray Type = 6
+)
+
+// ConvertedType tells readers how to interpret a physical type.
+type ConvertedType int32
+
+const (
+	NoConversion ConvertedType = iota
+	UTF8
+	TimestampMillis
+)
+
+var convertedTypes = map[ConvertedType]int32{
+	UTF8:            0,
+	TimestampMillis: 9,
+}
+
+const (
+	encodingPlain = 0
+	encodingRLE   = 3
+	codecGzip     = 2
+	pageTypeData  = 0
+)
+
+type Column struct {
+	Name      string
+	Type      Type
+	Converted ConvertedType
+	Optional  bool
+}
+
+type columnBuffer struct {
+	values   bytes.Buffer
+	defs     []byte
+	nulls    int64
+	min, max int64
+}
+
+type columnChunk struct {
+	offset       int64
+	numValues    int64
+	uncompressed int64
+	compressed   int64
+	nulls        int64
+	min, max     int64
+}
+
+type rowGroup struct {
+	chunks []columnChunk
+	size   int64
+	rows   int64
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Writer writes rows to a Parquet file. Rows are buffered in memory until
+// Flush, which writes them out as one row group.
+type Writer struct {
+	w       *countWriter
+	columns []Column
+	bufs    []columnBuffer
+	rows    int64
+	total   int64
+	groups  []rowGroup
+	// CreatedBy is recorded in the file footer.
+	CreatedBy string
+}
+
+func NewWriter(w io.Writer, columns []Column) (*Writer, error) {
+	for _, c := range columns {
+		if c.Type != Int64 && c.Type != ByteArray {
+			return nil, fmt.Errorf("column %s: unsupported type %d", c.Name, c.Type)
+		}
+	}
+	pw := &Writer{
+		w:       &countWriter{w: w},
+		columns: columns,
+		bufs:    make([]columnBuffer, len(columns)),
+	}
+	if _, err := io.WriteString(pw.w, magic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Rows returns the number of rows buffered for the current row group.
+func (w *Writer) Rows() int64 { return w.rows }
+
+// Write appends a row. Values are int64 for Int64 columns, string or []byte
+// for ByteArray columns, and nil for a null in an optional column.
+func (w *Writer) Write(row ...any) error {
+	if len(row) != len(w.columns) {
+		return fmt.Errorf("row has %d values, want %d", len(row), len(w.columns))
+	}
+	for i, v := range row {
+		if err := w.check(i, v); err != nil {
+			return err
+		}
+	}
+	for i, v := range row {
+		w.append(i, v)
+	}
+	w.rows++
+	return nil
+}
+
+func (w *Writer) check(i int, v any) error {
+	c := w.columns[i]
+	switch v.(type) {
+	case nil:
+		if !c.Optional {
+			return fmt.Errorf("column %s: null in a required column", c.Name)
+		}
+		return nil
+	case int64:
+		if c.Type == Int64 {
+			return nil
+		}
+	case string, []byte:
+		if c.Type == ByteArray {
+			return nil
+		}
+	}
+	return fmt.Errorf("column %s: unexpected value type %T", c.Name, v)
+}
+
+func (w *Writer) append(i int, v any) {
+	b := &w.bufs[i]
+	if v == nil {
+		b.defs = append(b.defs, 0)
+		b.nulls++
+		return
+	}
+	b.defs = append(b.defs, 1)
+	switch v := v.(type) {
+	case int64:
+		if int64(len(b.defs)) == b.nulls+1 || v < b.min {
+			b.min = v
+		}
+		if int64(len(b.defs)) == b.nulls+1 || v > b.max {
+			b.max = v
+		}
+		binary.Write(&b.values, binary.LittleEndian, v)
+	case string:
+		binary.Write(&b.values, binary.LittleEndian, uint32(len(v)))
+		b.values.WriteString(v)
+	case []byte:
+		binary.Write(&b.values, binary.LittleEndian, uint32(len(v)))
+		b.values.Write(v)
+	}
+}
+
+// Flush writes the buffered rows as a row group.
+func (w *Writer) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	g := rowGroup{rows: w.rows}
+	for i := range w.columns {
+		chunk, err := w.writeChunk(i)
+		if err != nil {
+			return err
+		}
+		g.chunks = append(g.chunks, chunk)
+		g.size += chunk.uncompressed
+		w.bufs[i] = columnBuffer{}
+	}
+	w.groups = append(w.groups, g)
+	w.total += w.rows
+	w.rows = 0
+	return nil
+}
+
+func (w *Writer) writeChunk(i int) (columnChunk, error) {
+	b := &w.bufs[i]
+	page := &bytes.Buffer{}
+	if w.columns[i].Optional {
+		levels := encodeLevels(b.defs)
+		binary.Write(page, binary.LittleEndian, uint32(len(levels)))
+		page.Write(levels)
+	}
+	page.Write(b.values.Bytes())
+
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	if _, err := zw.Write(page.Bytes()); err != nil {
+		return columnChunk{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return columnChunk{}, err
+	}
+
+	h := &compactWriter{}
+	h.begin(0)
+	h.i32(1, pageTypeData)
+	h.i32(2, int32(page.Len()))
+	h.i32(3, int32(compressed.Len()))
+	h.begin(5)
+	h.i32(1, int32(w.rows))
+	h.i32(2, encodingPlain)
+	h.i32(3, encodingRLE)
+	h.i32(4, encodingRLE)
+	h.end()
+	h.end()
+
+	chunk := columnChunk{
+		offset:       w.w.n,
+		numValues:    w.rows,
+		uncompressed: int64(h.Len() + page.Len()),
+		compressed:   int64(h.Len() + compressed.Len()),
+		nulls:        b.nulls,
+		min:          b.min,
+		max:          b.max,
+	}
+	if _, err := w.w.Write(h.Bytes()); err != nil {
+		return chunk, err
+	}
+	_, err := w.w.Write(compressed.Bytes())
+	return chunk, err
+}
+
+// encodeLevels encodes definition levels of bit width 1 with the RLE part of
+// the RLE/bit-packing hybrid encoding.
+func encodeLevels(levels []byte) []byte {
+	out := []byte{}
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		out = append(out, levels[i])
+		i = j
+	}
+	return out
+}
+
+// Close flushes the buffered rows and writes the file footer. It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	footer := w.footer()
+	if _, err := w.w.Write(footer); err != nil {
+		return err
+	}
+	if err := binary.Write(w.w, binary.LittleEndian, uint32(len(footer))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, magic)
+	return err
+}
+
+// footer serializes FileMetaData.
+func (w *Writer) footer() []byte {
+	c := &compactWriter{}
+	c.begin(0)
+	c.i32(1, 1)
+	c.list(2, ctStruct, len(w.columns)+1)
+	c.begin(0)
+	c.binary(4, []byte("schema"))
+	c.i32(5, int32(len(w.columns)))
+	c.end()
+	for _, col := range w.columns {
+		c.begin(0)
+		c.i32(1, int32(col.Type))
+		if col.Optional {
+			c.i32(3, 1)
+		} else {
+			c.i32(3, 0)
+		}
+		c.binary(4, []byte(col.Name))
+		if col.Converted != NoConversion {
+			c.i32(6, convertedTypes[col.Converted])
+		}
+		c.end()
+	}
+	c.i64(3, w.total)
+	c.list(4, ctStruct, len(w.groups))
+	for _, g := range w.groups {
+		c.begin(0)
+		c.list(1, ctStruct, len(g.chunks))
+		for i, chunk := range g.chunks {
+			col := w.columns[i]
+			c.begin(0)
+			c.i64(2, chunk.offset)
+			c.begin(3)
+			c.i32(1, int32(col.Type))
+			c.list(2, ctI32, 2)
+			c.varint(encodingPlain)
+			c.varint(encodingRLE)
+			c.list(3, ctBinary, 1)
+			c.bytes([]byte(col.Name))
+			c.i32(4, codecGzip)
+			c.i64(5, chunk.numValues)
+			c.i64(6, chunk.uncompressed)
+			c.i64(7, chunk.compressed)
+			c.i64(9, chunk.offset)
+			c.begin(12)
+			c.i64(3, chunk.nulls)
+			if col.Type == Int64 && chunk.nulls < chunk.numValues {
+				c.binary(5, binary.LittleEndian.AppendUint64(nil, uint64(chunk.max)))
+				c.binary(6, binary.LittleEndian.AppendUint64(nil, uint64(chunk.min)))
+			}
+			c.end()
+			c.end()
+			c.end()
+		}
+		c.i64(2, g.size)
+		c.i64(3, g.rows)
+		c.end()
+	}
+	if len(w.CreatedBy) > 0 {
+		c.binary(6, []byte(w.CreatedBy))
+	}
+	c.end()
+	return c.Bytes()
+}
@@ -0,0 +1,247 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// compactReader decodes Thrift compact structs into maps keyed by field id.
+type compactReader struct {
+	b   []byte
+	err error
+}
+
+func (r *compactReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("bad varint")
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *compactReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *compactReader) byte() byte {
+	if len(r.b) == 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *compactReader) value(typ byte) any {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case ctI32, ctI64:
+		return r.varint()
+	case ctBinary:
+		n := int(r.uvarint())
+		if n > len(r.b) {
+			r.err = io.ErrUnexpectedEOF
+			return nil
+		}
+		v := string(r.b[:n])
+		r.b = r.b[n:]
+		return v
+	case ctList:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := []any{}
+		for i := 0; i < n && r.err == nil; i++ {
+			list = append(list, r.value(h&0x0f))
+		}
+		return list
+	case ctStruct:
+		return r.structure()
+	}
+	r.err = fmt.Errorf("unsupported type %d", typ)
+	return nil
+}
+
+func (r *compactReader) structure() map[int16]any {
+	s := map[int16]any{}
+	var last int16
+	for r.err == nil {
+		h := r.byte()
+		if h == 0 {
+			break
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.varint())
+		}
+		s[id] = r.value(h & 0x0f)
+		last = id
+	}
+	return s
+}
+
+// readFile reads back every column of every row group of a file written by Writer.
+func readFile(t *testing.T, b []byte) (map[int16]any, [][][]any) {
+	t.Helper()
+	if string(b[:4]) != magic || string(b[len(b)-4:]) != magic {
+		t.Fatal("magic not found")
+	}
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	r := &compactReader{b: b[len(b)-8-size : len(b)-8]}
+	meta := r.structure()
+	if r.err != nil || len(r.b) != 0 {
+		t.Fatalf("footer err:%v rest:%d", r.err, len(r.b))
+	}
+	schema := meta[2].([]any)[1:]
+	groups := [][][]any{}
+	for _, g := range meta[4].([]any) {
+		columns := [][]any{}
+		for i, c := range g.(map[int16]any)[1].([]any) {
+			md := c.(map[int16]any)[3].(map[int16]any)
+			optional := schema[i].(map[int16]any)[3].(int64) == 1
+			columns = append(columns, readChunk(t, b, md, optional))
+		}
+		groups = append(groups, columns)
+	}
+	return meta, groups
+}
+
+func readChunk(t *testing.T, b []byte, md map[int16]any, optional bool) []any {
+	t.Helper()
+	r := &compactReader{b: b[md[9].(int64):]}
+	header := r.structure()
+	page := r.b[:header[3].(int64)]
+	if int64(len(b))-md[9].(int64)-int64(len(r.b)) != md[7].(int64)-int64(len(page)) {
+		t.Errorf("header size does not match total_compressed_size")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != header[2].(int64) {
+		t.Errorf("uncompressed_page_size:%d actual:%d", header[2], len(data))
+	}
+	n := int(header[5].(map[int16]any)[1].(int64))
+	defs := make([]byte, n)
+	for i := range defs {
+		defs[i] = 1
+	}
+	if optional {
+		l := binary.LittleEndian.Uint32(data)
+		lr := &compactReader{b: data[4 : 4+l]}
+		defs = defs[:0]
+		for len(lr.b) > 0 {
+			run := lr.uvarint()
+			if run&1 != 0 {
+				t.Fatal("bit-packed run")
+			}
+			v := lr.byte()
+			for ; run > 1; run -= 2 {
+				defs = append(defs, v)
+			}
+		}
+		data = data[4+l:]
+	}
+	values := []any{}
+	for _, d := range defs {
+		switch {
+		case d == 0:
+			values = append(values, nil)
+		case md[1].(int64) == int64(Int64):
+			values = append(values, int64(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		default:
+			l := binary.LittleEndian.Uint32(data)
+			values = append(values, string(data[4:4+l]))
+			data = data[4+l:]
+		}
+	}
+	if len(data) != 0 {
+		t.Errorf("%d bytes left in page", len(data))
+	}
+	return values
+}
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, []Column{
+		{Name: "time", Type: Int64, Converted: TimestampMillis},
+		{Name: "user", Type: ByteArray, Converted: UTF8},
+		{Name: "err", Type: ByteArray, Converted: UTF8, Optional: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.CreatedBy = "test"
+	rows := [][]any{
+		{int64(3000), "user1", nil},
+		{int64(1000), "user2", "denied"},
+		{int64(2000), "user1", nil},
+	}
+	for _, row := range rows[:2] {
+		if err := w.Write(row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(rows[2]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(int64(1), nil, nil); err == nil {
+		t.Error("null in a required column is accepted")
+	}
+	if err := w.Write("x", "user1", nil); err == nil {
+		t.Error("string in an int64 column is accepted")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, groups := readFile(t, buf.Bytes())
+	want := [][][]any{
+		{{int64(3000), int64(1000)}, {"user1", "user2"}, {nil, "denied"}},
+		{{int64(2000)}, {"user1"}, {nil}},
+	}
+	if diff := cmp.Diff(want, groups); diff != "" {
+		t.Errorf("values mismatch (-want +got):\n%s", diff)
+	}
+	if meta[3].(int64) != 3 || meta[6].(string) != "test" {
+		t.Errorf("num_rows:%v created_by:%v", meta[3], meta[6])
+	}
+	stats := meta[4].([]any)[0].(map[int16]any)[1].([]any)[0].(map[int16]any)[3].(map[int16]any)[12].(map[int16]any)
+	min := binary.LittleEndian.Uint64([]byte(stats[6].(string)))
+	max := binary.LittleEndian.Uint64([]byte(stats[5].(string)))
+	if min != 1000 || max != 3000 {
+		t.Errorf("min:%d max:%d", min, max)
+	}
+}
+
+func TestEncodeLevels(t *testing.T) {
+	got := encodeLevels([]byte{1, 1, 1, 0, 1})
+	want := []byte{3 << 1, 1, 1 << 1, 0, 1 << 1, 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("levels mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,86 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Type ids of the Thrift compact protocol.
+const (
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+// compactWriter serializes the Thrift structs of the Parquet metadata with
+// the compact protocol. Fields must be written in ascending id order.
+type compactWriter struct {
+	bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (c *compactWriter) uvarint(v uint64) {
+	c.Write(binary.AppendUvarint(nil, v))
+}
+
+func (c *compactWriter) varint(v int64) {
+	c.Write(binary.AppendVarint(nil, v))
+}
+
+func (c *compactWriter) field(id int16, typ byte) {
+	if delta := id - c.last; delta > 0 && delta <= 15 {
+		c.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		c.WriteByte(typ)
+		c.varint(int64(id))
+	}
+	c.last = id
+}
+
+func (c *compactWriter) i32(id int16, v int32) {
+	c.field(id, ctI32)
+	c.varint(int64(v))
+}
+
+func (c *compactWriter) i64(id int16, v int64) {
+	c.field(id, ctI64)
+	c.varint(v)
+}
+
+func (c *compactWriter) binary(id int16, b []byte) {
+	c.field(id, ctBinary)
+	c.bytes(b)
+}
+
+func (c *compactWriter) bytes(b []byte) {
+	c.uvarint(uint64(len(b)))
+	c.Write(b)
+}
+
+func (c *compactWriter) list(id int16, elem byte, n int) {
+	c.field(id, ctList)
+	if n < 15 {
+		c.WriteByte(byte(n)<<4 | elem)
+		return
+	}
+	c.WriteByte(0xf0 | elem)
+	c.uvarint(uint64(n))
+}
+
+// begin starts a struct, either as field id or, with id 0, as a list element.
+func (c *compactWriter) begin(id int16) {
+	if id > 0 {
+		c.field(id, ctStruct)
+	}
+	c.stack = append(c.stack, c.last)
+	c.last = 0
+}
+
+func (c *compactWriter) end() {
+	c.WriteByte(0)
+	c.last = c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+}